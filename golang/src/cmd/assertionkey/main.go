@@ -0,0 +1,209 @@
+// Assertionkey generates and rotates the keys that sign the assertions for
+// channel access tokens (see LINE_ASSERTION_KEY_FILE). To rotate:
+//
+//	go run ./cmd/assertionkey generate -out new-key.json
+//
+// prints the public JWK of a new key. Register it in the LINE Developers
+// Console, which answers with its kid, then
+//
+//	go run ./cmd/assertionkey add -set keys.json -key new-key.json -kid <kid> -activate
+//
+// puts it into the set and signs with it from the next token refresh on. Once
+// the bot issued a token with it, remove the old key from the console and
+//
+//	go run ./cmd/assertionkey remove -set keys.json -kid <old kid>
+//
+// Sets in Secrets Manager are edited the same way on a local copy.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/di-th-hm-ms/AI-English/lib"
+)
+
+const usage = `usage: assertionkey <command> [flags]
+
+commands:
+  generate -out file [-bits 2048]         write a new private key and print its public JWK
+  add -set file -key file -kid kid [-activate]
+                                          put a key into the set with the kid LINE gave it
+  activate -set file -kid kid             sign with the key from now on
+  remove -set file -kid kid               drop a key that is no longer registered
+  public -set file [-kid kid]             print the public JWKs to register with LINE`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+	command, args := os.Args[1], os.Args[2:]
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	out := flags.String("out", "", "file to write the new private key to")
+	bits := flags.Int("bits", 2048, "size of the new key")
+	setFile := flags.String("set", "", "the JWK set, as in LINE_ASSERTION_KEY_FILE")
+	keyFile := flags.String("key", "", "a private JWK or PEM key")
+	kid := flags.String("kid", "", "the kid LINE gave the key")
+	activate := flags.Bool("activate", false, "sign with the added key")
+	flags.Parse(args)
+
+	var err error
+	switch command {
+	case "generate":
+		err = generate(*out, *bits)
+	case "add":
+		err = add(*setFile, *keyFile, *kid, *activate)
+	case "activate":
+		err = editSet(*setFile, *kid, func(keys *lib.AssertionKeys) error {
+			if _, ok := keys.Key(*kid); !ok {
+				return fmt.Errorf("no key with the kid %q", *kid)
+			}
+			keys.Active = *kid
+			return nil
+		})
+	case "remove":
+		err = editSet(*setFile, *kid, func(keys *lib.AssertionKeys) error {
+			if keys.Active == *kid {
+				return fmt.Errorf("%q is the active key; activate another one first", *kid)
+			}
+			if !keys.Remove(*kid) {
+				return fmt.Errorf("no key with the kid %q", *kid)
+			}
+			return nil
+		})
+	case "public":
+		err = public(*setFile, *kid)
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func generate(out string, bits int) error {
+	if out == "" {
+		return fmt.Errorf("-out is needed for the private key")
+	}
+	if _, err := os.Stat(out); err == nil {
+		return fmt.Errorf("%s exists already", out)
+	}
+	key, err := lib.GenerateAssertionKey(bits)
+	if err != nil {
+		return err
+	}
+	if err = writeJSON(out, key); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Wrote the private key to %s. Register this public key in the LINE Developers Console:\n", out)
+	return printJSON(key.Public())
+}
+
+func add(setFile string, keyFile string, kid string, activate bool) error {
+	if keyFile == "" || kid == "" {
+		return fmt.Errorf("-key and -kid are needed")
+	}
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return err
+	}
+	added, err := lib.ParseAssertionKeys(data, kid)
+	if err != nil {
+		return err
+	}
+	if len(added.Keys) != 1 {
+		return fmt.Errorf("%s has %d keys, expected one", keyFile, len(added.Keys))
+	}
+	key := added.Keys[0]
+	key.Kid = kid
+	return editSet(setFile, kid, func(keys *lib.AssertionKeys) error {
+		keys.Put(key)
+		if activate || len(keys.Keys) == 1 {
+			keys.Active = kid
+		}
+		return nil
+	})
+}
+
+// Load the set, or start an empty one, change it and write it back.
+func editSet(setFile string, kid string, edit func(keys *lib.AssertionKeys) error) error {
+	if setFile == "" || kid == "" {
+		return fmt.Errorf("-set and -kid are needed")
+	}
+	keys := &lib.AssertionKeys{}
+	if data, err := os.ReadFile(setFile); err == nil {
+		if keys, err = lib.ParseAssertionKeys(data, ""); err != nil {
+			return fmt.Errorf("%s: %v", setFile, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err := edit(keys); err != nil {
+		return err
+	}
+	if err := writeJSON(setFile, keys); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%s has %d keys, %q is active\n", setFile, len(keys.Keys), keys.Active)
+	return nil
+}
+
+func public(setFile string, kid string) error {
+	data, err := os.ReadFile(setFile)
+	if err != nil {
+		return err
+	}
+	keys, err := lib.ParseAssertionKeys(data, "")
+	if err != nil {
+		return err
+	}
+	if kid != "" {
+		key, ok := keys.Key(kid)
+		if !ok {
+			return fmt.Errorf("no key with the kid %q", kid)
+		}
+		return printJSON(key.Public())
+	}
+	public := lib.AssertionKeys{Active: keys.Active}
+	for _, key := range keys.Keys {
+		public.Keys = append(public.Keys, key.Public())
+	}
+	return printJSON(public)
+}
+
+// Write the private keys readable by the owner only, replacing the file at once.
+func writeJSON(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".assertionkey-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	// CreateTemp makes it 0600
+	return os.Rename(tmp.Name(), path)
+}
+
+func printJSON(v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
@@ -0,0 +1,94 @@
+// Console talks to the bot in a terminal. Each line goes through the same
+// pipeline as a LINE text message: commands, validation, quota, the notebook,
+// the explanation and the picture. Replies are printed, cards line by line.
+//
+//	go run ./cmd/console [-user name] [-data dir | -memory] [-live] [-v]
+//
+// By default the data is kept under .console-data and explanations and
+// pictures are made up offline. With -live they come from openai (GPT_KEY)
+// and the web.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/di-th-hm-ms/AI-English/lib"
+	"github.com/joho/godotenv"
+)
+
+func main() {
+	user := flag.String("user", "local", "who you are; each user has their own notebook and quota")
+	dataDir := flag.String("data", ".console-data", "directory to keep the data in")
+	memory := flag.Bool("memory", false, "keep the data in memory only")
+	live := flag.Bool("live", false, "get explanations from openai and pictures from the web")
+	verbose := flag.Bool("v", false, "show the logs of the bot")
+	flag.Parse()
+
+	if *verbose {
+		lib.SetupLogging(os.Stderr, "text", "debug")
+	} else {
+		log.SetOutput(io.Discard)
+	}
+
+	if *memory {
+		lib.SetObjectStore(lib.NewMemoryStore())
+	} else {
+		store, err := lib.NewDirStore(*dataDir)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to open the data directory:", err)
+			os.Exit(1)
+		}
+		lib.SetObjectStore(store)
+	}
+
+	if *live {
+		if err := godotenv.Load("../../.env"); err != nil {
+			fmt.Fprintln(os.Stderr, "No .env file, using the environment")
+		}
+		config, err := lib.LoadConfig(os.Getenv("CONFIG_FILE"))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to load the configuration:", err)
+			os.Exit(1)
+		}
+		if config.OpenAI.APIKey == "" {
+			fmt.Fprintln(os.Stderr, "GPT_KEY is not set")
+			os.Exit(1)
+		}
+		lib.SetOpenAI(config.OpenAI)
+		lib.SetPexels(config.Pexels)
+	} else {
+		lib.SetExplainer(lib.OfflineExplanation)
+		lib.SetImageFinder(lib.PlaceholderImages)
+		lib.SetPronouncer(lib.OfflinePronunciation)
+	}
+
+	console := lib.NewConsoleMessenger(os.Stdout)
+	fmt.Println(`Type a word to look it up, or a command like "notebook" or "help".`)
+	fmt.Println(`":user <name>" switches the user, ":quit" leaves.`)
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for {
+		fmt.Printf("%s> ", *user)
+		if !scanner.Scan() {
+			fmt.Println()
+			return
+		}
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+			continue
+		case line == ":quit":
+			return
+		case strings.HasPrefix(line, ":user "):
+			*user = strings.TrimSpace(strings.TrimPrefix(line, ":user "))
+			continue
+		}
+		lib.HandleMessage(console, lib.ConsoleMessage(*user, line))
+	}
+}
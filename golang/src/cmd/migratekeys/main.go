@@ -0,0 +1,58 @@
+// Migratekeys moves the notebook entries, explanations and pictures stored
+// under the text of the word to the slug and hash keys the bot uses now, and
+// turns the lookups recorded under users/<id>/messages/ into notebook entries.
+//
+//	go run ./cmd/migratekeys [-apply] [-data dir]
+//
+// It reads the bucket of the configuration (CONFIG_FILE and the environment,
+// like the bot) or, with -data, the directory of cmd/console. Without -apply
+// it only prints what would move. It can run again; moved objects are skipped.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/di-th-hm-ms/AI-English/lib"
+)
+
+func main() {
+	apply := flag.Bool("apply", false, "move the objects instead of printing what would move")
+	dataDir := flag.String("data", "", "migrate the data directory of cmd/console instead of the bucket")
+	flag.Parse()
+
+	lib.SetupLogging(os.Stderr, "text", "info")
+	if *dataDir != "" {
+		store, err := lib.NewDirStore(*dataDir)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to open the data directory:", err)
+			os.Exit(1)
+		}
+		lib.SetObjectStore(store)
+	} else {
+		config, err := lib.LoadConfig(os.Getenv("CONFIG_FILE"))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to load the configuration:", err)
+			os.Exit(1)
+		}
+		lib.CreateSession(config.AWS)
+	}
+
+	result, err := lib.MigrateStorageKeys(context.Background(), !*apply, func(from string, to string) {
+		fmt.Printf("%s -> %s\n", from, to)
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "The migration stopped:", err)
+		os.Exit(1)
+	}
+	verb := "Moved"
+	if !*apply {
+		verb = "Would move"
+	}
+	fmt.Fprintf(os.Stderr, "%s %d objects, %d already had their new key, %d failed\n", verb, result.Moved, result.Skipped, result.Failed)
+	if result.Failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,120 @@
+// Replay sends captured webhooks (see WEBHOOK_CAPTURE_DIR) to the bot again.
+//
+//	go run ./cmd/replay -target http://localhost:8080/callback -secret $CHANNEL_SECRET capture.json...
+//
+// Without -target the captures are replayed in-process against the fake LINE
+// API, with the data in memory and offline explanations, and the calls the
+// bot made to LINE are printed.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+
+	"github.com/di-th-hm-ms/AI-English/lib"
+	"github.com/di-th-hm-ms/AI-English/lib/linetest"
+	"github.com/gin-gonic/gin"
+)
+
+func main() {
+	target := flag.String("target", "", "callback URL of a running bot; the fake LINE API is used when empty")
+	secret := flag.String("secret", os.Getenv("CHANNEL_SECRET"), "channel secret of the target to sign with")
+	verbose := flag.Bool("v", false, "show the logs of the bot")
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: replay [-target url -secret secret] capture.json...")
+		os.Exit(2)
+	}
+	captures := make([]*lib.WebhookCapture, 0, flag.NArg())
+	for _, path := range flag.Args() {
+		capture, err := lib.LoadWebhookCapture(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		captures = append(captures, capture)
+	}
+
+	if *target != "" {
+		if *secret == "" {
+			fmt.Fprintln(os.Stderr, "-secret or CHANNEL_SECRET is needed to sign the webhooks")
+			os.Exit(2)
+		}
+		for i, capture := range captures {
+			req, err := capture.Request(*target, *secret)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", flag.Arg(i), err)
+				os.Exit(1)
+			}
+			res.Body.Close()
+			fmt.Printf("%s: %d (captured %d)\n", flag.Arg(i), res.StatusCode, capture.Status)
+		}
+		return
+	}
+
+	if *verbose {
+		lib.SetupLogging(os.Stderr, "text", "debug")
+	} else {
+		log.SetOutput(io.Discard)
+		gin.SetMode(gin.ReleaseMode)
+		gin.DefaultWriter = io.Discard
+	}
+	replayOnFake(captures)
+}
+
+func replayOnFake(captures []*lib.WebhookCapture) {
+	const secret = "replay-channel-secret"
+	fake := linetest.NewServer(secret)
+	defer fake.Close()
+	if err := fake.Install(); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to set up the fake LINE API:", err)
+		os.Exit(1)
+	}
+	lib.SetObjectStore(lib.NewMemoryStore())
+	lib.SetExplainer(lib.OfflineExplanation)
+	lib.SetImageFinder(lib.PlaceholderImages)
+	lib.SetPronouncer(lib.OfflinePronunciation)
+
+	requests := make(chan *lib.LineRequest, 10)
+	lib.SetRequestQueue(requests)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go lib.Worker(requests, &wg)
+
+	router := lib.NewRouter()
+	for i, capture := range captures {
+		req, err := capture.Request("/callback", secret)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		fmt.Printf("%s: %d (captured %d)\n", flag.Arg(i), res.Code, capture.Status)
+	}
+	// wait for the workers to handle every event
+	close(requests)
+	wg.Wait()
+
+	for _, call := range fake.Calls() {
+		fmt.Printf("%s %s\n", call.Method, call.Path)
+		var body interface{}
+		if json.Unmarshal(call.Body, &body) == nil {
+			indented, _ := json.MarshalIndent(body, "  ", "  ")
+			fmt.Printf("  %s\n", indented)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package lib
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+var adminToken string
+
+// Only requests with "Authorization: Bearer <token>" reach the admin API.
+// The API is closed until a token is set.
+func SetAdminToken(token string) {
+	adminToken = token
+}
+
+func AdminAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := adminToken
+		given := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if token == "" || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		c.Next()
+	}
+}
+
+type adminImportRequest struct {
+	UserIDs []string `json:"userIds" binding:"required"`
+	// Either a list of words or the content of a CSV/plain text word list
+	Words []string `json:"words"`
+	Text  string   `json:"text"`
+	Tags  []string `json:"tags"`
+}
+
+// POST /admin/import pushes a word list into the notebooks of the users.
+func AdminImportHandler(c *gin.Context) {
+	var req adminImportRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// each word of the JSON list is a whole entry, commas and all
+	list := newWordList()
+	if err := list.parse([]byte(req.Text)); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	for _, word := range req.Words {
+		list.add(word, nil)
+	}
+	words, tags, rejected := list.words, list.tags, list.rejected
+	if len(words) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "no valid words", "rejected": rejected})
+		return
+	}
+	for i := range tags {
+		tags[i] = append(tags[i], req.Tags...)
+	}
+
+	jobIds := make([]string, 0, len(req.UserIDs))
+	for _, userId := range req.UserIDs {
+		job := StartImport(userId, words, tags, nil, true)
+		jobIds = append(jobIds, job.ID)
+	}
+	c.JSON(http.StatusAccepted, gin.H{"jobs": jobIds, "words": len(words), "rejected": rejected})
+}
+
+// GET /admin/import/:id reports the progress of an import.
+func AdminImportStatusHandler(c *gin.Context) {
+	job, exists := GetImportJob(c.Param("id"))
+	if !exists {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	c.JSON(http.StatusOK, job.Snapshot())
+}
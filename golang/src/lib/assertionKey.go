@@ -0,0 +1,279 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+)
+
+// The assertions for channel access tokens are signed with an RSA key whose
+// public half is registered with LINE, which answers with the kid of the key.
+// A set can hold the old and the new key while one is rotated out; the
+// active one signs. cmd/assertionkey generates keys and edits sets.
+
+// A JWK set with the kid of the key that signs.
+type AssertionKeys struct {
+	Active string         `json:"active,omitempty"`
+	Keys   []AssertionKey `json:"keys"`
+}
+
+// Parse a JWK set, a single JWK or an RSA private key in PEM. Keys without a
+// kid, like the PEM ones, get defaultKid.
+func ParseAssertionKeys(data []byte, defaultKid string) (*AssertionKeys, error) {
+	keys := &AssertionKeys{}
+	data = bytes.TrimSpace(data)
+	switch {
+	case bytes.HasPrefix(data, []byte("{")):
+		if err := json.Unmarshal(data, keys); err != nil {
+			return nil, err
+		}
+		if len(keys.Keys) == 0 {
+			var key AssertionKey
+			if err := json.Unmarshal(data, &key); err != nil {
+				return nil, err
+			}
+			keys.Keys = []AssertionKey{key}
+		}
+	case bytes.HasPrefix(data, []byte("-----BEGIN")):
+		for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+			privateKey, err := parsePEMKey(block)
+			if err != nil {
+				return nil, err
+			}
+			keys.Keys = append(keys.Keys, NewAssertionKey(privateKey, ""))
+		}
+	default:
+		return nil, errors.New("expected a JWK set, a JWK or a PEM key")
+	}
+
+	for i := range keys.Keys {
+		if keys.Keys[i].Kid == "" {
+			keys.Keys[i].Kid = defaultKid
+		}
+		if _, err := keys.Keys[i].PrivateKey(); err != nil {
+			return nil, fmt.Errorf("key %q: %v", keys.Keys[i].Kid, err)
+		}
+	}
+	return keys, nil
+}
+
+func parsePEMKey(block *pem.Block) (*rsa.PrivateKey, error) {
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if rsaKey, ok := key.(*rsa.PrivateKey); ok {
+			return rsaKey, nil
+		}
+		return nil, errors.New("the PEM key isn't an RSA key")
+	}
+	return nil, fmt.Errorf("unexpected PEM block %q", block.Type)
+}
+
+func (s *AssertionKeys) Key(kid string) (AssertionKey, bool) {
+	for _, key := range s.Keys {
+		if key.Kid == kid {
+			return key, true
+		}
+	}
+	return AssertionKey{}, false
+}
+
+// The key with the kid, or the active one when kid is empty, or the only one.
+func (s *AssertionKeys) Signer(kid string) (AssertionKey, error) {
+	if kid == "" {
+		kid = s.Active
+	}
+	if kid == "" {
+		if len(s.Keys) != 1 {
+			return AssertionKey{}, fmt.Errorf("%d assertion keys and none is active; set PH_KID or the active kid of the set", len(s.Keys))
+		}
+		if s.Keys[0].Kid == "" {
+			return AssertionKey{}, errors.New("the assertion key has no kid; set PH_KID to the kid LINE gave it")
+		}
+		return s.Keys[0], nil
+	}
+	key, ok := s.Key(kid)
+	if !ok {
+		return AssertionKey{}, fmt.Errorf("no assertion key with the kid %q", kid)
+	}
+	return key, nil
+}
+
+// Add the key, replacing the one with the same kid.
+func (s *AssertionKeys) Put(key AssertionKey) {
+	for i := range s.Keys {
+		if s.Keys[i].Kid == key.Kid {
+			s.Keys[i] = key
+			return
+		}
+	}
+	s.Keys = append(s.Keys, key)
+}
+
+func (s *AssertionKeys) Remove(kid string) bool {
+	for i := range s.Keys {
+		if s.Keys[i].Kid == kid {
+			s.Keys = append(s.Keys[:i], s.Keys[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func GenerateAssertionKey(bits int) (AssertionKey, error) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		return AssertionKey{}, err
+	}
+	return NewAssertionKey(privateKey, ""), nil
+}
+
+func NewAssertionKey(privateKey *rsa.PrivateKey, kid string) AssertionKey {
+	privateKey.Precompute()
+	b64 := func(n *big.Int) string { return base64.RawURLEncoding.EncodeToString(n.Bytes()) }
+	return AssertionKey{
+		Kid: kid,
+		Use: "sig",
+		Alg: "RS256",
+		Kty: "RSA",
+		N:   b64(privateKey.N),
+		E:   b64(big.NewInt(int64(privateKey.E))),
+		D:   b64(privateKey.D),
+		P:   b64(privateKey.Primes[0]),
+		Q:   b64(privateKey.Primes[1]),
+		DP:  b64(privateKey.Precomputed.Dp),
+		DQ:  b64(privateKey.Precomputed.Dq),
+		QI:  b64(privateKey.Precomputed.Qinv),
+	}
+}
+
+// The JWK to register with LINE, without the private parts.
+func (k AssertionKey) Public() AssertionKey {
+	return AssertionKey{Kid: k.Kid, Use: "sig", Alg: "RS256", Kty: "RSA", N: k.N, E: k.E}
+}
+
+func (k AssertionKey) PrivateKey() (*rsa.PrivateKey, error) {
+	if k.Kty != "" && k.Kty != "RSA" {
+		return nil, fmt.Errorf("expected an RSA key, not %s", k.Kty)
+	}
+	var values [5]*big.Int
+	for i, field := range []struct{ name, value string }{
+		{"n", k.N}, {"e", k.E}, {"d", k.D}, {"p", k.P}, {"q", k.Q},
+	} {
+		if field.value == "" {
+			return nil, fmt.Errorf("the key has no %s", field.name)
+		}
+		decoded, err := base64.RawURLEncoding.DecodeString(field.value)
+		if err != nil {
+			return nil, fmt.Errorf("the %s of the key: %v", field.name, err)
+		}
+		values[i] = new(big.Int).SetBytes(decoded)
+	}
+	privateKey := &rsa.PrivateKey{
+		PublicKey: rsa.PublicKey{N: values[0], E: int(values[1].Int64())},
+		D:         values[2],
+		Primes:    []*big.Int{values[3], values[4]},
+	}
+	if err := privateKey.Validate(); err != nil {
+		return nil, err
+	}
+	privateKey.Precompute()
+	return privateKey, nil
+}
+
+// SecretProvider fetches named secrets, like the assertion keys in
+// LINE_ASSERTION_KEY_SECRET. It is AWS Secrets Manager unless
+// SetSecretProvider changes it.
+type SecretProvider interface {
+	GetSecret(ctx context.Context, name string) ([]byte, error)
+}
+
+var secrets SecretProvider = awsSecrets{}
+
+// A nil provider is Secrets Manager again.
+func SetSecretProvider(p SecretProvider) {
+	if p == nil {
+		p = awsSecrets{}
+	}
+	secrets = p
+}
+
+// Secrets Manager with the AWS session of the bucket.
+type awsSecrets struct{}
+
+func (awsSecrets) GetSecret(ctx context.Context, name string) ([]byte, error) {
+	if awsSession == nil {
+		return nil, errors.New("no AWS session for Secrets Manager")
+	}
+	res, err := secretsmanager.New(awsSession).GetSecretValueWithContext(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(name),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if res.SecretString != nil {
+		return []byte(*res.SecretString), nil
+	}
+	return res.SecretBinary, nil
+}
+
+// Load the assertion keys of the channel from the secret, the file or the
+// P_* variables, in that order. PH_KID is the kid of the keys that come
+// without one, like PEM keys and the P_* ones, and picks the active key of a
+// set that names none; the active kid of a set wins, so cmd/assertionkey
+// activate takes effect wherever PH_KID is still set.
+func LoadAssertionKeys(ctx context.Context, config LineConfig) (*AssertionKeys, error) {
+	var keys *AssertionKeys
+	var err error
+	switch {
+	case config.KeySecret != "":
+		var data []byte
+		if data, err = secrets.GetSecret(ctx, config.KeySecret); err != nil {
+			return nil, fmt.Errorf("assertion keys in %s: %v", config.KeySecret, err)
+		}
+		keys, err = ParseAssertionKeys(data, config.KeyID)
+	case config.KeyFile != "":
+		var data []byte
+		if data, err = os.ReadFile(config.KeyFile); err != nil {
+			return nil, err
+		}
+		keys, err = ParseAssertionKeys(data, config.KeyID)
+	default:
+		key := config.AssertionKey
+		key.Kid = config.KeyID
+		if _, err = key.PrivateKey(); err == nil {
+			keys = &AssertionKeys{Keys: []AssertionKey{key}}
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the assertion keys: %v", err)
+	}
+	switch {
+	case keys.Active == "":
+		keys.Active = config.KeyID
+	case config.KeyID != "" && config.KeyID != keys.Active:
+		slog.Warn("PH_KID is ignored, the assertion key set names the active key", "active", keys.Active)
+	}
+	if _, err = keys.Signer(""); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
@@ -1,21 +1,20 @@
 package lib
 
 import (
-	"crypto/rsa"
-	"encoding/base64"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
-	"math/big"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
 	"strings"
+	"sync/atomic"
 	"time"
 
-	"github.com/dgrijalva/jwt-go"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/line/line-bot-sdk-go/linebot"
 )
 
@@ -26,177 +25,97 @@ type LineBot struct {
 	AccessToken string
 }
 
-var bot *LineBot
+// Workers read it while the token manager replaces it
+var bot atomic.Pointer[LineBot]
 
-// To generate JWT assertion
-var privateKeyJSON []byte
-
-func base64ToBigInt(base64String string) (*big.Int, error) {
-	decoded, err := base64.RawURLEncoding.DecodeString(base64String)
-	if err != nil {
-		return nil, err
-	}
-	return new(big.Int).SetBytes(decoded), nil
-}
-
-// Generate assertion JWT
-func GenerateJwtAssertion() (string, error) {
-	// var privateKey *rsa.PrivateKey
-	var privateKeyMap map[string]string
-
-	privateKeyJSON = []byte(fmt.Sprintf(`{
-		"alg": "%s",
-		"d": "%s",
-		"dp": "%s",
-		"dq": "%s",
-		"e": "%s",
-		"kty": "%s",
-		"n": "%s",
-		"p": "%s",
-		"q": "%s",
-		"qi": "%s"
-	  }`, os.Getenv("P_ALG"), os.Getenv("P_D"),
-		os.Getenv("P_DP"), os.Getenv("P_DQ"),
-		os.Getenv("P_E"), os.Getenv("P_KTY"), os.Getenv("P_N"),
-		os.Getenv("P_P"), os.Getenv("P_Q"), os.Getenv("P_QI")))
-
-	err := json.Unmarshal(privateKeyJSON, &privateKeyMap)
-	// log.Println(privateKeyJSON)
-	if err != nil {
-		log.Println("while ummarshaling")
-		return "", err
-	}
-
-	n, err := base64ToBigInt(privateKeyMap["n"])
-	if err != nil {
-		return "", err
-	}
-
-	e, err := base64ToBigInt(privateKeyMap["e"])
-	if err != nil {
-		return "", err
-	}
-
-	d, err := base64ToBigInt(privateKeyMap["d"])
+// Generate assertion JWT, signed with the active key of the channel
+func GenerateJwtAssertion(channelID string, keys *AssertionKeys) (string, error) {
+	key, err := keys.Signer("")
 	if err != nil {
 		return "", err
 	}
-
-	p, err := base64ToBigInt(privateKeyMap["p"])
-	if err != nil {
-		return "", err
-	}
-
-	q, err := base64ToBigInt(privateKeyMap["q"])
+	privateKey, err := key.PrivateKey()
 	if err != nil {
 		return "", err
 	}
 
-	dp, err := base64ToBigInt(privateKeyMap["dp"])
-	if err != nil {
-		return "", err
-	}
-
-	dq, err := base64ToBigInt(privateKeyMap["dq"])
-	if err != nil {
-		return "", err
-	}
-
-	qi, err := base64ToBigInt(privateKeyMap["qi"])
-	if err != nil {
-		return "", err
-	}
-
-	privateKey := &rsa.PrivateKey{
-		PublicKey: rsa.PublicKey{
-			N: n,
-			E: int(e.Int64()),
-		},
-		D:      d,
-		Primes: []*big.Int{p, q},
-		Precomputed: rsa.PrecomputedValues{
-			Dp:   dp,
-			Dq:   dq,
-			Qinv: qi,
-		},
-	}
-
 	// pId := 1660802481
-	id := os.Getenv("CHANNEL_ID")
 	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
-		"iss":       id,
-		"sub":       id,
+		"iss":       channelID,
+		"sub":       channelID,
 		"aud":       "https://api.line.me/",
 		"exp":       time.Now().Add(30 * time.Minute).Unix(), //The expiration time of the JWT.
 		"token_exp": 60 * 60 * 24 * 30,                       // This represents a valid expiration time for the channel access token in seconds.
 	})
 
-	token.Header["kid"] = os.Getenv("PH_KID")
+	token.Header["kid"] = key.Kid
 
 	jwtString, err := token.SignedString(privateKey)
 	if err != nil {
-		log.Println("while signing")
+		slog.Error("failed to sign the JWT", "err", err)
 		return "", err
 	}
 
 	return jwtString, nil
 }
 
-// Generate a new access token and register it to LINE server
-func GetNewAccessToken() (string, error) {
-
-	jwtAssertion, err := GenerateJwtAssertion()
-	if err != nil {
-		log.Println("error while generating a JWT: " + err.Error())
-		return "", err
-	}
+// A channel access token as LINE issues it
+type issuedToken struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+	KeyID       string `json:"key_id"`
+}
 
+// Generate a new access token and register it to LINE server
+func issueAccessToken(ctx context.Context, jwtAssertion string) (*issuedToken, error) {
 	data := url.Values{}
 	data.Set("grant_type", "client_credentials")
-	data.Set("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
+	data.Set("client_assertion_type", clientAssertionType)
 	data.Set("client_assertion", jwtAssertion)
 
-	req, err := http.NewRequest("POST", "https://api.line.me/oauth2/v2.1/token", strings.NewReader(data.Encode()))
-	if err != nil {
-		return "", err
+	var issued issuedToken
+	if err := postLineOAuth(ctx, "/oauth2/v2.1/token", data, &issued); err != nil {
+		return nil, fmt.Errorf("failed to obtain a new access token: %v", err)
 	}
-
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-
-	client := &http.Client{}
-	res, err := client.Do(req)
-	if err != nil {
-		return "", err
+	if issued.AccessToken == "" {
+		return nil, errors.New("access token not found in the response")
 	}
-	defer res.Body.Close()
+	return &issued, nil
+}
 
-	if res.StatusCode != http.StatusOK {
-		return "", errors.New("failed to obtain a new access token")
-	}
+const clientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
 
-	body, err := io.ReadAll(res.Body)
+// POST a form to the OAuth endpoints of LINE, decoding the JSON answer into result if it isn't nil.
+func postLineOAuth(ctx context.Context, path string, data url.Values, result interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, lineEndpoint+path, strings.NewReader(data.Encode()))
 	if err != nil {
-		return "", err
+		return err
 	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 
-	var result map[string]interface{}
-	err = json.Unmarshal(body, &result)
+	res, err := lineHTTPClient.Do(req)
 	if err != nil {
-		return "", err
+		return err
 	}
+	defer res.Body.Close()
 
-	accessToken, ok := result["access_token"].(string)
-	if !ok {
-		return "", errors.New("access token not found in the response")
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("request failed with status code: %d", res.StatusCode)
 	}
-
-	return accessToken, nil
-
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(result)
 }
 
 // check if the accdess token is valid
-func VerifyAccessToken(accessToken string) (map[string]interface{}, error) {
-	resp, err := http.Get("https://api.line.me/oauth2/v2.1/verify?access_token=" + accessToken)
+func VerifyAccessToken(ctx context.Context, accessToken string) (map[string]interface{}, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		lineEndpoint+"/oauth2/v2.1/verify?access_token="+url.QueryEscape(accessToken), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := lineHTTPClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -220,52 +139,80 @@ func VerifyAccessToken(accessToken string) (map[string]interface{}, error) {
 	return result, nil
 }
 
-// revoke the access token
-
-// Update the access token not in .env but in struct
-func NewLineBotClient() {
-	secret := os.Getenv("CHANNEL_SECRET")
-
-	accessToken, err := GetNewAccessToken()
-	if err != nil {
-		log.Println("error while generating a new access token: " + err.Error())
-	}
-
-	lbot, err := linebot.New(secret, accessToken)
-	if err != nil {
+// Issue channel access tokens with the assertion key, reusing the one a
+// previous run left if it's still valid, see ChannelTokens.
+func NewLineBotClient(config LineConfig) {
+	channelTokens = NewChannelTokens(config, nil)
+	if err := channelTokens.Start(context.Background()); err != nil {
 		// gets this server down temporarily
-		log.Fatalf("Failed to create LINE bot client: %v", err)
+		slog.Error("Failed to get a channel access token", "err", err)
+		os.Exit(1)
 	}
+}
 
-	bot = &LineBot{
-		Client:      lbot,
-		AccessToken: accessToken,
-	}
+// The manager of the tokens for RefreshToken and /debug/status, nil with a long-lived token.
+func SetChannelTokens(t *ChannelTokens) {
+	channelTokens = t
 }
 
-// refresh an access token periodically
-func RefreshTokenPeriodically(interval time.Duration) {
-	for {
-		time.Sleep(interval)
-		NewLineBotClient()
-		log.Println(bot.AccessToken)
+// Refresh the channel access token for the scheduler, keeping the current client on failure.
+func RefreshToken(ctx context.Context) error {
+	if channelTokens == nil {
+		return errors.New("no channel access tokens to refresh")
 	}
+	return channelTokens.Refresh(ctx)
 }
 
 // for debug
-func InitializeLinebotDebug() {
-	lbot, err := linebot.New(os.Getenv("CHANNEL_SECRET"), os.Getenv("CHANNEL_LONG_TERM_ACCESS_TOKEN"))
+func InitializeLinebotDebug(config LineConfig) {
+	lbot, err := newLinebotClient(config.ChannelSecret, config.LongTermAccessToken)
 	if err != nil {
 		// gets this server down temporarily
-		log.Fatalf("Failed to create LINE bot client: %v", err)
+		slog.Error("Failed to create LINE bot client", "err", err)
+		os.Exit(1)
 	}
 
-	bot = &LineBot{
+	bot.Store(&LineBot{
 		Client:      lbot,
-		AccessToken: os.Getenv("CHANNEL_LONG_TERM_ACCESS_TOKEN"),
-	}
+		AccessToken: config.LongTermAccessToken,
+	})
 }
 
+// The current client. Keep the result for one task rather than storing it:
+// the token manager swaps it when it refreshes the token.
 func GetBot() *LineBot {
-	return bot
+	return bot.Load()
+}
+
+// Where the Messaging API is. Tests point it at linetest.Server.
+var (
+	lineEndpoint     = linebot.APIEndpointBase
+	lineDataEndpoint = linebot.APIEndpointBaseData
+
+	lineHTTPClient = dependencyClient("line", nil)
+)
+
+func SetLineEndpoint(endpoint string) {
+	lineEndpoint = endpoint
+	lineDataEndpoint = endpoint
+}
+
+func newLinebotClient(secret string, accessToken string) (*linebot.Client, error) {
+	return linebot.New(secret, accessToken,
+		linebot.WithHTTPClient(lineHTTPClient),
+		linebot.WithEndpointBase(lineEndpoint),
+		linebot.WithEndpointBaseData(lineDataEndpoint))
+}
+
+// Use a bot with the given credentials, e.g. against linetest.Server.
+func SetLineBot(secret string, accessToken string) error {
+	lbot, err := newLinebotClient(secret, accessToken)
+	if err != nil {
+		return err
+	}
+	bot.Store(&LineBot{
+		Client:      lbot,
+		AccessToken: accessToken,
+	})
+	return nil
 }
@@ -0,0 +1,274 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Channel access tokens v2.1 last 30 days and a channel holds at most 30 of
+// them. ChannelTokens keeps using one until shortly before it expires,
+// revokes the ones it replaced and keeps its state in the store, so a
+// restart reuses the token instead of issuing another.
+type ChannelTokens struct {
+	config LineConfig
+	keys   *AssertionKeys
+	clock  Clock
+	// A new token is issued when the current one expires within this
+	RefreshBefore time.Duration
+
+	mu    sync.Mutex
+	state channelTokenState
+	// Valid key IDs the bot didn't issue, as of the last cleanUp
+	unknown []string
+}
+
+// The manager of NewLineBotClient, refreshed by RefreshToken
+var channelTokens *ChannelTokens
+
+// Where the tokens are kept. They are secrets like the rest of the bucket.
+const channelTokenKey = "bots/channel-token.json"
+
+// Replaced tokens are revoked after this, so requests that started with them can finish
+const revokeGrace = time.Minute
+
+type channelToken struct {
+	AccessToken  string    `json:"accessToken"`
+	KeyID        string    `json:"keyId"`
+	ExpiresAt    time.Time `json:"expiresAt"`
+	SupersededAt time.Time `json:"supersededAt,omitempty"`
+}
+
+type channelTokenState struct {
+	Current channelToken `json:"current"`
+	// Replaced tokens that are still to be revoked
+	Superseded []channelToken `json:"superseded,omitempty"`
+}
+
+// A nil clock is the real one.
+func NewChannelTokens(config LineConfig, clock Clock) *ChannelTokens {
+	if clock == nil {
+		clock = realClock{}
+	}
+	return &ChannelTokens{config: config, clock: clock, RefreshBefore: 24 * time.Hour}
+}
+
+// Use the stored token if LINE still accepts it, or issue one, and point the bot at it.
+func (t *ChannelTokens) Start(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	keys, err := LoadAssertionKeys(ctx, t.config)
+	if err != nil {
+		return err
+	}
+	t.keys = keys
+	if err = t.load(); err != nil {
+		slog.Warn("Failed to read the channel access token state", "err", err)
+	}
+
+	if current := t.state.Current; current.AccessToken != "" && !t.expiring() {
+		if _, err = VerifyAccessToken(ctx, current.AccessToken); err == nil {
+			slog.Info("Reusing the channel access token", "key_id", current.KeyID, "expires_at", current.ExpiresAt)
+			if err = SetLineBot(t.config.ChannelSecret, current.AccessToken); err != nil {
+				return err
+			}
+			t.cleanUp(ctx)
+			return nil
+		}
+		slog.Warn("The stored channel access token isn't usable", "key_id", current.KeyID, "err", err)
+	}
+	if err = t.rotate(ctx); err != nil {
+		return err
+	}
+	t.cleanUp(ctx)
+	return nil
+}
+
+// Issue a new token when the current one is about to expire, revoke the
+// replaced ones and look for tokens the bot doesn't know. It runs on the
+// scheduler, and loads the keys again so a rotated key signs without a restart.
+func (t *ChannelTokens) Refresh(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if keys, err := LoadAssertionKeys(ctx, t.config); err != nil {
+		slog.Error("Failed to load the assertion keys, signing with the previous ones", "err", err)
+	} else {
+		t.keys = keys
+	}
+	if t.expiring() {
+		if err := t.rotate(ctx); err != nil {
+			return err
+		}
+	}
+	t.cleanUp(ctx)
+	return nil
+}
+
+// When the current token expires; false before one is in use.
+func (t *ChannelTokens) ExpiresAt() (time.Time, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.state.Current.ExpiresAt, t.state.Current.AccessToken != ""
+}
+
+func (t *ChannelTokens) expiring() bool {
+	return t.clock.Now().Add(t.RefreshBefore).After(t.state.Current.ExpiresAt)
+}
+
+// Issue a token and swap the client to it. The previous token is revoked by a later cleanUp.
+func (t *ChannelTokens) rotate(ctx context.Context) error {
+	assertion, err := GenerateJwtAssertion(t.config.ChannelID, t.keys)
+	if err != nil {
+		return err
+	}
+	issued, err := issueAccessToken(ctx, assertion)
+	if err != nil {
+		return err
+	}
+	now := t.clock.Now()
+	if previous := t.state.Current; previous.AccessToken != "" {
+		previous.SupersededAt = now
+		t.state.Superseded = append(t.state.Superseded, previous)
+	}
+	t.state.Current = channelToken{
+		AccessToken: issued.AccessToken,
+		KeyID:       issued.KeyID,
+		ExpiresAt:   now.Add(time.Duration(issued.ExpiresIn) * time.Second),
+	}
+	// saved first: a token that is in use but not stored would leak on a restart
+	t.save()
+	if err = SetLineBot(t.config.ChannelSecret, issued.AccessToken); err != nil {
+		return err
+	}
+	slog.Info("Issued a channel access token", "key_id", issued.KeyID, "expires_at", t.state.Current.ExpiresAt)
+	return nil
+}
+
+// Revoke the replaced tokens and compare the valid key IDs with the ones the
+// bot knows. Failures are logged and tried again on the next refresh.
+func (t *ChannelTokens) cleanUp(ctx context.Context) {
+	now := t.clock.Now()
+	var remaining []channelToken
+	for _, old := range t.state.Superseded {
+		if now.Sub(old.SupersededAt) < revokeGrace {
+			remaining = append(remaining, old)
+			continue
+		}
+		if err := revokeAccessToken(ctx, t.config, old.AccessToken); err != nil {
+			slog.Warn("Failed to revoke a channel access token", "key_id", old.KeyID, "err", err)
+			remaining = append(remaining, old)
+			continue
+		}
+		slog.Info("Revoked a channel access token", "key_id", old.KeyID)
+	}
+	t.state.Superseded = remaining
+	defer t.save()
+
+	kids, err := t.listValidKeyIDs(ctx)
+	if err != nil {
+		slog.Warn("Failed to list the valid channel access tokens", "err", err)
+		return
+	}
+	valid := make(map[string]bool, len(kids))
+	for _, kid := range kids {
+		valid[kid] = true
+	}
+	// replaced tokens LINE doesn't list have expired or were revoked already
+	remaining = nil
+	known := map[string]bool{t.state.Current.KeyID: true}
+	for _, old := range t.state.Superseded {
+		if valid[old.KeyID] {
+			remaining = append(remaining, old)
+			known[old.KeyID] = true
+		}
+	}
+	t.state.Superseded = remaining
+
+	// tokens issued by earlier versions or leaked. The revoke endpoint takes
+	// the token itself, not its key ID, so the bot can only report them; they
+	// expire within 30 days or can be revoked in the LINE Developers Console.
+	var unknown []string
+	for _, kid := range kids {
+		if !known[kid] {
+			unknown = append(unknown, kid)
+		}
+	}
+	t.unknown = unknown
+	unknownChannelTokens.Set(float64(len(unknown)))
+	if len(unknown) > 0 {
+		slog.Warn("Channel access tokens the bot doesn't know are valid; they expire by themselves or can be revoked in the LINE Developers Console",
+			"key_ids", unknown)
+	}
+}
+
+// The key IDs of valid tokens the bot didn't issue, found by the last
+// Start or Refresh. See cleanUp.
+func (t *ChannelTokens) UnknownKeyIDs() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]string(nil), t.unknown...)
+}
+
+func (t *ChannelTokens) load() error {
+	if !store.Exists(channelTokenKey) {
+		return nil
+	}
+	data, err := store.Get(channelTokenKey)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &t.state)
+}
+
+func (t *ChannelTokens) save() {
+	data, err := json.Marshal(t.state)
+	if err == nil {
+		err = store.Put(channelTokenKey, data, "application/json")
+	}
+	if err != nil {
+		slog.Error("Failed to save the channel access token state", "err", err)
+	}
+}
+
+func revokeAccessToken(ctx context.Context, config LineConfig, accessToken string) error {
+	data := url.Values{}
+	data.Set("client_id", config.ChannelID)
+	data.Set("client_secret", config.ChannelSecret)
+	data.Set("access_token", accessToken)
+	return postLineOAuth(ctx, "/oauth2/v2.1/revoke", data, nil)
+}
+
+// The key IDs of every valid channel access token of the channel.
+func (t *ChannelTokens) listValidKeyIDs(ctx context.Context) ([]string, error) {
+	jwtAssertion, err := GenerateJwtAssertion(t.config.ChannelID, t.keys)
+	if err != nil {
+		return nil, err
+	}
+	query := url.Values{}
+	query.Set("client_assertion_type", clientAssertionType)
+	query.Set("client_assertion", jwtAssertion)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, lineEndpoint+"/oauth2/v2.1/tokens/kid?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := lineHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("request failed with status code: %d", res.StatusCode)
+	}
+	var result struct {
+		Kids []string `json:"kids"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return result.Kids, nil
+}
@@ -0,0 +1,63 @@
+package lib
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+)
+
+var (
+	chartBackground = color.RGBA{0xff, 0xff, 0xff, 0xff}
+	chartAxis       = color.RGBA{0xcc, 0xcc, 0xcc, 0xff}
+	chartBar        = color.RGBA{0x9c, 0xd3, 0xa8, 0xff}
+	chartHighlight  = color.RGBA{0x06, 0xc7, 0x55, 0xff}
+	chartEmpty      = color.RGBA{0xee, 0xee, 0xee, 0xff}
+)
+
+// Render a bar chart as a PNG, with the bar at highlight in a stronger color.
+// Labels are left to the message showing the chart, so no fonts are needed.
+func RenderBarChart(values []int, highlight int, width int, height int) ([]byte, error) {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), &image.Uniform{chartBackground}, image.Point{}, draw.Src)
+
+	padding := width / 20
+	baseline := height - padding
+	top := padding
+	draw.Draw(img, image.Rect(padding, baseline, width-padding, baseline+2), &image.Uniform{chartAxis}, image.Point{}, draw.Src)
+
+	if len(values) > 0 {
+		max := 1
+		for _, v := range values {
+			if v > max {
+				max = v
+			}
+		}
+
+		slot := (width - 2*padding) / len(values)
+		gap := slot / 5
+		for i, v := range values {
+			x0 := padding + i*slot + gap/2
+			x1 := x0 + slot - gap
+			barHeight := (baseline - top) * v / max
+
+			fill := chartBar
+			switch {
+			case v == 0:
+				// keep a stub so that empty days are still visible
+				fill = chartEmpty
+				barHeight = 4
+			case i == highlight:
+				fill = chartHighlight
+			}
+			draw.Draw(img, image.Rect(x0, baseline-barHeight, x1, baseline), &image.Uniform{fill}, image.Point{}, draw.Src)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,45 @@
+package lib
+
+import (
+	"strings"
+)
+
+// Chat commands are tried in order before a text is looked up as a word.
+// Each handler reports whether it took care of the text.
+var commandHandlers = []func(m Messenger, msg *IncomingMessage) bool{
+	handleNotebookCommand,
+	handleExportCommand,
+	handleWotdCommand,
+	handleProgressCommand,
+	handleSettingsCommand,
+	handleHelpCommand,
+}
+
+func handleCommand(m Messenger, msg *IncomingMessage) bool {
+	for _, handler := range commandHandlers {
+		if handler(m, msg) {
+			return true
+		}
+	}
+	return false
+}
+
+const helpText = `Send me an English word or phrase to learn it with a picture.
+
+notebook - your words
+notebook search <word>
+forget <word>
+export [anki|csv|quizlet]
+wotd - word of the day
+progress - your week
+settings`
+
+func handleHelpCommand(m Messenger, msg *IncomingMessage) bool {
+	if !strings.EqualFold(strings.TrimSpace(msg.Text), "help") {
+		return false
+	}
+	if err := m.Reply(msg, TextReply(helpText)); err != nil {
+		msg.Logger().Error("Failed to reply the help", "err", err)
+	}
+	return true
+}
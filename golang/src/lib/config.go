@@ -0,0 +1,347 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Config is everything the bot can be configured with. LoadConfig starts
+// from DefaultConfig, applies a JSON file if one is given and then the
+// environment variables in the env tags, which win over the file.
+type Config struct {
+	Production bool   `json:"production" env:"PRODUCTION"`
+	Port       string `json:"port" env:"PORT"`
+	// The token of the admin API and /debug/status; they are closed without one
+	AdminToken string `json:"adminToken" env:"ADMIN_TOKEN"`
+	// Lookups a user gets a day
+	DailyLookupLimit  int    `json:"dailyLookupLimit" env:"DAILY_LOOKUP_LIMIT"`
+	WebhookCaptureDir string `json:"webhookCaptureDir" env:"WEBHOOK_CAPTURE_DIR"`
+	// Where users reach the bot, e.g. https://bot.example.com; pushed charts
+	// are served from it instead of presigned links that expire
+	PublicURL string `json:"publicUrl" env:"PUBLIC_URL"`
+
+	Log     LogConfig     `json:"log"`
+	Tracing TracingConfig `json:"tracing"`
+	Queue   QueueConfig   `json:"queue"`
+	LINE    LineConfig    `json:"line"`
+	AWS     AWSConfig     `json:"aws"`
+	OpenAI  OpenAIConfig  `json:"openai"`
+	Pexels  PexelsConfig  `json:"pexels"`
+	TLS     TLSOptions    `json:"tls"`
+}
+
+type LogConfig struct {
+	// json or text
+	Format string `json:"format" env:"LOG_FORMAT"`
+	// debug, info, warn or error
+	Level string `json:"level" env:"LOG_LEVEL"`
+	// Days the webhook logs are kept
+	RetentionDays int `json:"retentionDays" env:"LOG_RETENTION_DAYS"`
+}
+
+type TracingConfig struct {
+	// otlp, stdout, console or none, see SetupTracing
+	Exporter string `json:"exporter" env:"OTEL_TRACES_EXPORTER"`
+}
+
+type QueueConfig struct {
+	Workers int `json:"workers" env:"WORKERS"`
+	// Events waiting for a worker before the webhook blocks
+	Size int `json:"size" env:"QUEUE_SIZE"`
+	// Words of imported lists explained at once, apart from the webhook workers
+	ImportWorkers int `json:"importWorkers" env:"IMPORT_WORKERS"`
+}
+
+type LineConfig struct {
+	ChannelID     string `json:"channelId" env:"CHANNEL_ID"`
+	ChannelSecret string `json:"channelSecret" env:"CHANNEL_SECRET"`
+	// Used in development instead of issuing tokens
+	LongTermAccessToken string `json:"longTermAccessToken" env:"CHANNEL_LONG_TERM_ACCESS_TOKEN"`
+	// The keys that sign the assertions for issuing channel access tokens, see
+	// LoadAssertionKeys: a JWK set, a JWK or a PEM file, a secret of the
+	// SecretProvider, or the key in P_* variables. Tokens the bot didn't issue
+	// are reported but not revoked, since LINE revokes by the token only.
+	KeyFile   string `json:"keyFile" env:"LINE_ASSERTION_KEY_FILE"`
+	KeySecret string `json:"keySecret" env:"LINE_ASSERTION_KEY_SECRET"`
+	// The kid LINE gave the key to sign with; the active key of the set when empty
+	KeyID        string       `json:"keyId" env:"PH_KID"`
+	AssertionKey AssertionKey `json:"assertionKey"`
+}
+
+// An RSA private key as a JWK. The public part is what is registered with LINE.
+type AssertionKey struct {
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg" env:"P_ALG"`
+	Kty string `json:"kty" env:"P_KTY"`
+	N   string `json:"n" env:"P_N"`
+	E   string `json:"e" env:"P_E"`
+	D   string `json:"d,omitempty" env:"P_D"`
+	P   string `json:"p,omitempty" env:"P_P"`
+	Q   string `json:"q,omitempty" env:"P_Q"`
+	DP  string `json:"dp,omitempty" env:"P_DP"`
+	DQ  string `json:"dq,omitempty" env:"P_DQ"`
+	QI  string `json:"qi,omitempty" env:"P_QI"`
+}
+
+type AWSConfig struct {
+	Region string `json:"region" env:"AWS_REGION"`
+	Bucket string `json:"bucket" env:"S3_BUCKET"`
+	// An S3-compatible service like MinIO or LocalStack instead of AWS, e.g. http://minio:9000
+	Endpoint string `json:"endpoint" env:"S3_ENDPOINT"`
+	// Where clients reach the endpoint, if not at the same address as the bot;
+	// the URLs of images are signed for it
+	PublicEndpoint string `json:"publicEndpoint" env:"S3_PUBLIC_ENDPOINT"`
+	// http://endpoint/bucket/key instead of http://bucket.endpoint/key, which MinIO needs
+	ForcePathStyle bool `json:"forcePathStyle" env:"S3_FORCE_PATH_STYLE"`
+	// Static credentials, as in development; the default chain of the SDK without them
+	AccessKeyID     string `json:"accessKeyId" env:"AWS_ACCESS_KEY_ID"`
+	SecretAccessKey string `json:"secretAccessKey" env:"AWS_SECRET_ACCESS_KEY"`
+	// A role to assume with those credentials, as in production
+	RoleName      string `json:"roleName" env:"IAM_ROLE_NAME"`
+	RoleAccountID string `json:"roleAccountId" env:"IAM_ROLE_ID"`
+	// What the trust policy of the role asks for, required with a role
+	ExternalID      string `json:"externalId" env:"IAM_EXTERNAL_ID"`
+	RoleSessionName string `json:"roleSessionName" env:"IAM_ROLE_SESSION_NAME"`
+}
+
+type OpenAIConfig struct {
+	APIKey string `json:"apiKey" env:"GPT_KEY"`
+	Model  string `json:"model" env:"OPENAI_MODEL"`
+}
+
+type PexelsConfig struct {
+	APIKey string `json:"apiKey" env:"PEXELS_API_KEY"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		DailyLookupLimit: 15,
+		Log: LogConfig{
+			Format:        "json",
+			Level:         "info",
+			RetentionDays: 1,
+		},
+		Tracing: TracingConfig{Exporter: "otlp"},
+		Queue:   QueueConfig{Workers: 5, Size: 10, ImportWorkers: 1},
+		AWS: AWSConfig{
+			Region:          "ap-northeast-1",
+			Bucket:          "linenglish",
+			RoleSessionName: "linenglish",
+		},
+		OpenAI: OpenAIConfig{Model: "gpt-3.5-turbo"},
+	}
+}
+
+// Load the config from the JSON file, if path isn't empty, and the
+// environment. It isn't validated yet, see Validate.
+func LoadConfig(path string) (*Config, error) {
+	config := DefaultConfig()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err = decoder.Decode(&config); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	if err := applyEnv(reflect.ValueOf(&config).Elem()); err != nil {
+		return nil, err
+	}
+
+	if config.TLS.Mode == "" {
+		config.TLS.Mode = TLSOff
+		// production takes HTTPS itself unless it's told it's behind a proxy
+		if config.Production {
+			switch {
+			case config.TLS.CertFile != "":
+				config.TLS.Mode = TLSFiles
+			case len(config.TLS.Domains) > 0:
+				config.TLS.Mode = TLSAutocert
+			}
+		}
+	}
+	if config.Port == "" {
+		config.Port = "8080"
+		if config.TLS.Mode == TLSFiles || config.TLS.Mode == TLSAutocert {
+			config.Port = "443"
+		}
+	}
+	return &config, nil
+}
+
+// Set the fields with an env tag from the environment, when the variable isn't empty.
+func applyEnv(v reflect.Value) error {
+	var problems []error
+	for i := 0; i < v.NumField(); i++ {
+		field, info := v.Field(i), v.Type().Field(i)
+		if field.Kind() == reflect.Struct {
+			if err := applyEnv(field); err != nil {
+				problems = append(problems, err)
+			}
+			continue
+		}
+		name := info.Tag.Get("env")
+		value := os.Getenv(name)
+		if name == "" || value == "" {
+			continue
+		}
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(value)
+		case reflect.Int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				problems = append(problems, fmt.Errorf("%s must be a number, not %q", name, value))
+				continue
+			}
+			field.SetInt(int64(n))
+		case reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				problems = append(problems, fmt.Errorf("%s must be true or false, not %q", name, value))
+				continue
+			}
+			field.SetBool(b)
+		case reflect.Slice:
+			field.Set(reflect.ValueOf(splitList(value)))
+		}
+	}
+	return errors.Join(problems...)
+}
+
+// The items of a comma-separated list, without spaces.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Check the config before anything starts, reporting every problem at once.
+func (c *Config) Validate() error {
+	var problems []error
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Errorf(format, args...))
+	}
+	require := func(value string, name string, why string) {
+		if value == "" {
+			problem("%s is required %s", name, why)
+		}
+	}
+
+	if port, err := strconv.Atoi(c.Port); err != nil || port <= 0 || port > 65535 {
+		problem("PORT must be a port number, not %q", c.Port)
+	}
+	if u, err := url.Parse(c.PublicURL); c.PublicURL != "" && (err != nil || u.Scheme == "" || u.Host == "") {
+		problem("PUBLIC_URL must be a URL like https://bot.example.com, not %q", c.PublicURL)
+	}
+	if c.DailyLookupLimit < 1 {
+		problem("DAILY_LOOKUP_LIMIT must be at least 1")
+	}
+	if c.Log.Format != "json" && c.Log.Format != "text" {
+		problem("LOG_FORMAT must be json or text, not %q", c.Log.Format)
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Log.Level)); err != nil {
+		problem("LOG_LEVEL must be debug, info, warn or error, not %q", c.Log.Level)
+	}
+	if c.Log.RetentionDays < 1 {
+		problem("LOG_RETENTION_DAYS must be at least 1")
+	}
+	switch c.Tracing.Exporter {
+	case "otlp", "stdout", "console", "none":
+	default:
+		problem("OTEL_TRACES_EXPORTER must be otlp, stdout, console or none, not %q", c.Tracing.Exporter)
+	}
+	if c.Queue.Workers < 1 {
+		problem("WORKERS must be at least 1")
+	}
+	if c.Queue.Size < 1 {
+		problem("QUEUE_SIZE must be at least 1")
+	}
+	if c.Queue.ImportWorkers < 1 {
+		problem("IMPORT_WORKERS must be at least 1")
+	}
+
+	require(c.LINE.ChannelSecret, "CHANNEL_SECRET", "to verify webhooks")
+	if c.Production {
+		require(c.LINE.ChannelID, "CHANNEL_ID", "to issue channel access tokens")
+		if c.LINE.KeyFile == "" && c.LINE.KeySecret == "" {
+			// the key in the environment, as before the key files
+			key := c.LINE.AssertionKey
+			for _, field := range []struct{ name, value string }{
+				{"PH_KID", c.LINE.KeyID}, {"P_N", key.N}, {"P_E", key.E}, {"P_D", key.D}, {"P_P", key.P}, {"P_Q", key.Q},
+			} {
+				require(field.value, field.name, "without LINE_ASSERTION_KEY_FILE or LINE_ASSERTION_KEY_SECRET")
+			}
+		}
+	} else {
+		require(c.LINE.LongTermAccessToken, "CHANNEL_LONG_TERM_ACCESS_TOKEN", "in development")
+	}
+
+	require(c.AWS.Region, "AWS_REGION", "for S3")
+	require(c.AWS.Bucket, "S3_BUCKET", "for the data")
+	for _, endpoint := range []struct{ name, value string }{
+		{"S3_ENDPOINT", c.AWS.Endpoint}, {"S3_PUBLIC_ENDPOINT", c.AWS.PublicEndpoint},
+	} {
+		if u, err := url.Parse(endpoint.value); endpoint.value != "" && (err != nil || u.Scheme == "" || u.Host == "") {
+			problem("%s must be a URL like http://minio:9000, not %q", endpoint.name, endpoint.value)
+		}
+	}
+	if c.AWS.PublicEndpoint != "" && c.AWS.Endpoint == "" {
+		problem("S3_PUBLIC_ENDPOINT needs S3_ENDPOINT")
+	}
+	// without either the credentials come from the default chain of the SDK
+	if c.AWS.AccessKeyID != "" || c.AWS.SecretAccessKey != "" {
+		require(c.AWS.AccessKeyID, "AWS_ACCESS_KEY_ID", "with AWS_SECRET_ACCESS_KEY")
+		require(c.AWS.SecretAccessKey, "AWS_SECRET_ACCESS_KEY", "with AWS_ACCESS_KEY_ID")
+	}
+	if c.AWS.RoleName != "" {
+		require(c.AWS.RoleAccountID, "IAM_ROLE_ID", "to assume IAM_ROLE_NAME")
+		require(c.AWS.RoleSessionName, "IAM_ROLE_SESSION_NAME", "to assume IAM_ROLE_NAME")
+		// a guessable default would let anyone told the role assume it
+		require(c.AWS.ExternalID, "IAM_EXTERNAL_ID", "to assume IAM_ROLE_NAME")
+	}
+
+	require(c.OpenAI.APIKey, "GPT_KEY", "for explanations")
+	require(c.OpenAI.Model, "OPENAI_MODEL", "for explanations")
+
+	switch c.TLS.Mode {
+	case TLSOff:
+		if c.Production {
+			problem("production needs TLS: set TLS_CERT_FILE and TLS_KEY_FILE, TLS_DOMAINS for autocert, or TLS_MODE=proxy behind a reverse proxy")
+		}
+	case TLSFiles:
+		require(c.TLS.CertFile, "TLS_CERT_FILE", "with TLS_MODE=files")
+		require(c.TLS.KeyFile, "TLS_KEY_FILE", "with TLS_MODE=files")
+	case TLSAutocert:
+		if len(c.TLS.Domains) == 0 {
+			problem("TLS_DOMAINS is required with TLS_MODE=autocert")
+		}
+	case TLSProxy:
+		for _, proxy := range c.TLS.TrustedProxies {
+			if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+				problem("TRUSTED_PROXIES has %q, which is neither an IP nor a CIDR", proxy)
+			}
+		}
+	default:
+		problem("TLS_MODE must be files, autocert, proxy or off, not %q", c.TLS.Mode)
+	}
+	return errors.Join(problems...)
+}
@@ -0,0 +1,110 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// ConsoleMessenger prints the replies to a terminal, to try the bot locally
+// without a LINE channel.
+type ConsoleMessenger struct {
+	out io.Writer
+	mu  sync.Mutex
+}
+
+func NewConsoleMessenger(out io.Writer) *ConsoleMessenger {
+	return &ConsoleMessenger{out: out}
+}
+
+func (c *ConsoleMessenger) Platform() string {
+	return "console"
+}
+
+func (c *ConsoleMessenger) Reply(msg *IncomingMessage, replies ...OutgoingReply) error {
+	return c.print("", replies)
+}
+
+func (c *ConsoleMessenger) Push(chatID string, replies ...OutgoingReply) error {
+	return c.print("[push to "+chatID+"] ", replies)
+}
+
+func (c *ConsoleMessenger) SenderName(msg *IncomingMessage) (string, error) {
+	return strings.TrimPrefix(msg.UserID, "console-"), nil
+}
+
+func (c *ConsoleMessenger) print(prefix string, replies []OutgoingReply) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, reply := range replies {
+		var err error
+		switch {
+		case len(reply.Cards) > 0:
+			if _, err = fmt.Fprintf(c.out, "%s[cards] %s\n", prefix, reply.AltText); err == nil {
+				for _, card := range reply.Cards {
+					if _, err = io.WriteString(c.out, consoleCard(card)); err != nil {
+						break
+					}
+				}
+			}
+		case reply.ImageURL != "":
+			_, err = fmt.Fprintf(c.out, "%s[image] %s\n", prefix, reply.ImageURL)
+		default:
+			_, err = fmt.Fprintf(c.out, "%s%s\n", prefix, reply.Text)
+		}
+		if err != nil {
+			return err
+		}
+		for _, quickReply := range reply.QuickReplies {
+			if _, err = fmt.Fprintf(c.out, "  [%s] %s\n", quickReply.Label, quickReply.Text); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// The lines of the card, indented under the message, with the buttons like quick replies.
+func consoleCard(card Card) string {
+	var b strings.Builder
+	line := func(text string) {
+		if text != "" {
+			fmt.Fprintf(&b, "  | %s\n", strings.ReplaceAll(text, "\n", "\n  | "))
+		}
+	}
+	line(card.Label)
+	line(card.Title)
+	line(card.Subtitle)
+	if card.ImageURL != "" {
+		line("[image] " + card.ImageURL)
+	}
+	for _, detail := range card.Details {
+		line(detail)
+	}
+	line(card.Text)
+	for _, field := range card.Fields {
+		line(field.Label + ": " + field.Value)
+	}
+	if len(card.Tags) > 0 {
+		line("#" + strings.Join(card.Tags, " #"))
+	}
+	for _, button := range card.Buttons {
+		line(fmt.Sprintf("[%s] %s", button.Label, button.Text))
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+// A text typed by a local user. Console users get their own notebooks
+// next to the LINE users.
+func ConsoleMessage(user string, text string) *IncomingMessage {
+	userId := "console-" + user
+	return &IncomingMessage{
+		Platform: "console",
+		UserID:   userId,
+		ChatID:   userId,
+		Text:     text,
+	}
+}
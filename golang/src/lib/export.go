@@ -0,0 +1,328 @@
+package lib
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ExportFormat string
+
+const (
+	ExportAnki    ExportFormat = "anki"
+	ExportCSV     ExportFormat = "csv"
+	ExportQuizlet ExportFormat = "quizlet"
+)
+
+// One notebook word with everything that goes on a flashcard. The picture
+// and the pronunciation are the names of files in the export.
+type exportCard struct {
+	entry      *VocabEntry
+	definition string
+	examples   []string
+	image      string
+	audio      string
+}
+
+// A file bundled with the cards
+type exportMedia struct {
+	name string
+	data []byte
+}
+
+// Anki and CSV exports are ZIPs of the cards and a media folder with their
+// pictures and pronunciations, since a link to the bucket expires in minutes.
+const exportMediaDir = "media/"
+
+// Pronunciations don't depend on the user, so every notebook shares one per word.
+func sharedAudioKey(word string) string {
+	return "bots/words/audio/" + textKey(word)
+}
+
+// The cached pronunciation of the word as mp3. An export doesn't wait for
+// openai, so a word looked up moments ago may go without one.
+func pronunciation(word string) ([]byte, bool) {
+	key := sharedAudioKey(word)
+	if !ObjectExists(key) {
+		return nil, false
+	}
+	return GetMessage(key)
+}
+
+// Make and cache the pronunciation of the word unless another notebook already did.
+func generatePronunciation(ctx context.Context, word string) error {
+	key := sharedAudioKey(word)
+	if ObjectExists(key) {
+		return nil
+	}
+	audio, err := pronounce(ctx, word)
+	if err != nil || len(audio) == 0 {
+		return err
+	}
+	return SaveObject(key, audio, "audio/mpeg")
+}
+
+// Words looked up wait here for their pronunciation, made off the reply path.
+var pronunciationQueue chan<- string
+
+// Share the queue the pronunciation worker consumes with the request workers.
+func SetPronunciationQueue(words chan<- string) {
+	pronunciationQueue = words
+}
+
+// Queue the word for a pronunciation. A full queue drops it; the next
+// lookup or import of the word tries again.
+func queuePronunciation(word string) {
+	if pronunciationQueue == nil {
+		return
+	}
+	select {
+	case pronunciationQueue <- word:
+	default:
+		slog.Debug("Dropped a pronunciation, the queue is full")
+	}
+}
+
+func PronunciationWorker(words <-chan string, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for word := range words {
+		if err := generatePronunciation(context.Background(), word); err != nil {
+			slog.Warn("Failed to get a pronunciation", "err", err)
+		}
+	}
+}
+
+// Exports are downloaded through links that expire in minutes, so a day is plenty.
+const exportTTL = 24 * time.Hour
+
+func exportsPrefix(userId string) string {
+	return fmt.Sprintf("users/%s/exports/", userId)
+}
+
+// Delete the exports of the user older than exportTTL. DataRetentionJob runs it for everyone.
+func PruneExports(userId string, now time.Time) error {
+	objects, err := ListObjects(exportsPrefix(userId))
+	if err != nil {
+		return err
+	}
+	for _, object := range objects {
+		if object.LastModified != nil && now.Sub(*object.LastModified) > exportTTL {
+			if err := DeleteObject(*object.Key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+var imageExtensions = map[string]string{
+	"image/gif":  ".gif",
+	"image/png":  ".png",
+	"image/webp": ".webp",
+}
+
+func imageExtension(data []byte) string {
+	if ext, known := imageExtensions[http.DetectContentType(data)]; known {
+		return ext
+	}
+	return ".jpg"
+}
+
+// Build the export file of the user's notebook.
+// It returns the file with its extension and content type.
+func BuildExport(userId string, format ExportFormat) ([]byte, string, string, error) {
+	if format != ExportAnki && format != ExportCSV && format != ExportQuizlet {
+		return nil, "", "", unknownFormatError(format)
+	}
+	entries, err := AllVocabulary(userId)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	cards := make([]*exportCard, 0, len(entries))
+	var media []exportMedia
+	for _, entry := range entries {
+		card := &exportCard{entry: entry}
+		if content, exists := GetMessage(explanationKey(userId, entry.Word)); exists {
+			card.definition, card.examples = splitExplanation(string(content), entry.Word)
+		}
+		cards = append(cards, card)
+		// Quizlet imports text only
+		if format == ExportQuizlet {
+			continue
+		}
+		if key := imageKey(userId, entry.Word); ObjectExists(key) {
+			if data, exists := GetMessage(key); exists {
+				card.image = textKey(entry.Word) + imageExtension(data)
+				media = append(media, exportMedia{card.image, data})
+			}
+		}
+		if data, exists := pronunciation(entry.Word); exists {
+			card.audio = textKey(entry.Word) + ".mp3"
+			media = append(media, exportMedia{card.audio, data})
+		}
+	}
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	switch format {
+	case ExportAnki:
+		// https://docs.ankiweb.net/importing/text-files.html#file-headers
+		buf.WriteString("#separator:tab\n#html:true\n#tags column:3\n")
+		w.Comma = '\t'
+		for _, card := range cards {
+			back := strings.ReplaceAll(card.definition, "\n", "<br>")
+			if len(card.examples) > 0 {
+				back += "<br><br><i>" + strings.Join(card.examples, "<br>") + "</i>"
+			}
+			// Anki finds the media by name in its collection.media folder
+			if card.image != "" {
+				back += fmt.Sprintf(`<br><img src="%s">`, card.image)
+			}
+			if card.audio != "" {
+				back += fmt.Sprintf("<br>[sound:%s]", card.audio)
+			}
+			w.Write([]string{card.entry.Word, back, strings.Join(card.entry.Tags, " ")})
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return nil, "", "", err
+		}
+		data, err := zipExport("notebook.txt", buf.Bytes(), media)
+		return data, "zip", "application/zip", err
+
+	case ExportCSV:
+		w.Write([]string{"word", "definition", "examples", "image", "audio", "tags", "lookup_count", "first_seen", "mastery"})
+		for _, card := range cards {
+			w.Write([]string{
+				card.entry.Word,
+				card.definition,
+				strings.Join(card.examples, "\n"),
+				mediaPath(card.image),
+				mediaPath(card.audio),
+				strings.Join(card.entry.Tags, " "),
+				strconv.Itoa(card.entry.LookupCount),
+				card.entry.FirstSeen.Format("2006-01-02"),
+				strconv.Itoa(card.entry.Mastery),
+			})
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return nil, "", "", err
+		}
+		data, err := zipExport("notebook.csv", buf.Bytes(), media)
+		return data, "zip", "application/zip", err
+
+	case ExportQuizlet:
+		// Quizlet's importer takes one "term<TAB>definition" per line
+		for _, card := range cards {
+			fmt.Fprintf(&buf, "%s\t%s\n", card.entry.Word, strings.Join(strings.Fields(card.definition), " "))
+		}
+		return buf.Bytes(), "txt", "text/plain", nil
+	}
+	return nil, "", "", unknownFormatError(format)
+}
+
+// The path of a media file in the export, relative to the cards.
+func mediaPath(name string) string {
+	if name == "" {
+		return ""
+	}
+	return exportMediaDir + name
+}
+
+func zipExport(name string, cards []byte, media []exportMedia) ([]byte, error) {
+	var buf bytes.Buffer
+	z := zip.NewWriter(&buf)
+	f, err := z.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(cards); err != nil {
+		return nil, err
+	}
+	for _, m := range media {
+		f, err := z.Create(mediaPath(m.name))
+		if err != nil {
+			return nil, err
+		}
+		if _, err := f.Write(m.data); err != nil {
+			return nil, err
+		}
+	}
+	if err := z.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+type unknownFormatError ExportFormat
+
+func (e unknownFormatError) Error() string {
+	return "unknown export format: " + string(e)
+}
+
+// Separate the definition from the example sentences in a generated explanation.
+// The first paragraph is the definition, later lines using the word are examples.
+func splitExplanation(content string, word string) (string, []string) {
+	paragraphs := strings.SplitN(strings.TrimSpace(content), "\n\n", 2)
+	definition := strings.TrimSpace(paragraphs[0])
+
+	var examples []string
+	if len(paragraphs) > 1 {
+		for _, line := range strings.Split(paragraphs[1], "\n") {
+			line = strings.TrimSpace(line)
+			if line != "" && strings.Contains(strings.ToLower(line), word) {
+				examples = append(examples, line)
+			}
+		}
+	}
+	return definition, examples
+}
+
+// Export the notebook and reply a short-lived download link:
+//
+//	export [anki|csv|quizlet]
+func handleExportCommand(m Messenger, msg *IncomingMessage) bool {
+	fields := strings.Fields(strings.ToLower(msg.Text))
+	if len(fields) == 0 || fields[0] != "export" || len(fields) > 2 {
+		return false
+	}
+	format := ExportAnki
+	if len(fields) == 2 {
+		format = ExportFormat(fields[1])
+	}
+
+	userId := msg.UserID
+	reply := "Sorry, we couldn't export your notebook. Try it later."
+	data, ext, contentType, err := BuildExport(userId, format)
+	if err != nil {
+		msg.Logger().Error("failed to build an export", "err", err)
+		if _, isUnknown := err.(unknownFormatError); isUnknown {
+			reply = "You can export as anki, csv or quizlet."
+		}
+	} else {
+		key := fmt.Sprintf("%s%s-%s.%s", exportsPrefix(userId), format, time.Now().Format("20060102150405"), ext)
+		if err = SaveObject(key, data, contentType); err != nil {
+			msg.Logger().Error("failed to upload an export", "err", err)
+		} else if url := GeneratePresignedUrl(key); url != "" {
+			reply = fmt.Sprintf("Your %s export is ready. The link expires in a few minutes:\n%s", format, url)
+			if format == ExportAnki {
+				reply += "\nImport notebook.txt and copy the files in media into Anki's collection.media folder."
+			}
+		}
+	}
+
+	if err = m.Reply(msg, TextReply(reply)); err != nil {
+		msg.Logger().Error("Failed to reply an export link", "err", err)
+	}
+	return true
+}
@@ -2,11 +2,13 @@ package lib
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
-	"os"
+	"time"
 )
 
 // openAI
@@ -48,63 +50,90 @@ type MsgData struct {
 
 const OpenaiURL = "https://api.openai.com/v1/chat/completions"
 
-// Including user's inpput and gpt's response
-var Conversation []Message
+var openaiClient = dependencyClient("openai", fixedOperation("chat"))
+
+// How the bot gets explanations. The console can swap it for OfflineExplanation.
+var explain = GetOpenaiChatResponse
+
+func SetExplainer(f func(ctx context.Context, input string) (*OpenaiResponse, error)) {
+	explain = f
+}
+
+// A canned explanation, to try the bot without calling openai.
+func OfflineExplanation(ctx context.Context, input string) (*OpenaiResponse, error) {
+	return &OpenaiResponse{
+		Object: "chat.completion",
+		Choices: []Choice{{
+			Messages: Message{
+				Role:    "assistant",
+				Content: fmt.Sprintf("%s: an offline explanation. Set GPT_KEY to get real ones.", input),
+			},
+			FinishReason: "stop",
+		}},
+	}, nil
+}
+
+var openaiConfig = DefaultConfig().OpenAI
+
+// The key and model for openai, before the workers start.
+func SetOpenAI(config OpenAIConfig) {
+	openaiConfig = config
+}
 
 // Get the crash course to user's input.
-func GetOpenaiChatResponse(input string) (*OpenaiResponse, error) {
-	apiKey := os.Getenv("GPT_KEY")
-	Conversation = append(Conversation, Message{
-		Role: "user",
-		// Content: `Teach me the meaning of the next word and show me
-		//  couple of short conversations including as many as phrasal verbs,
-		//  slangs and the next word in the conversations. "` + input + `"`,
-		Content: `Let me know the meaning about ` + input + ` concisely without any extra explanations`,
-	})
+func GetOpenaiChatResponse(ctx context.Context, input string) (*OpenaiResponse, error) {
+	// every word is asked on its own, so lookups, imports and the word of the day
+	// running at once don't share a history or grow it past the context window
 	reqBody := OpenaiRequest{
-		Model:    "gpt-3.5-turbo",
-		Messages: Conversation,
+		Model: openaiConfig.Model,
+		Messages: []Message{{
+			Role: "user",
+			// Content: `Teach me the meaning of the next word and show me
+			//  couple of short conversations including as many as phrasal verbs,
+			//  slangs and the next word in the conversations. "` + input + `"`,
+			Content: `Let me know the meaning about ` + input + ` concisely without any extra explanations`,
+		}},
 	}
 
 	// encode Json to string
 	reqJson, err := json.Marshal(reqBody)
 	if err != nil {
-		log.Println("an error while encoding JSON" + err.Error())
+		slog.Error("an error while encoding JSON", "err", err)
 		return nil, err
 	}
 
 	// create a request to openai
-	req, err := http.NewRequest("POST", OpenaiURL, bytes.NewBuffer(reqJson))
+	req, err := http.NewRequestWithContext(ctx, "POST", OpenaiURL, bytes.NewBuffer(reqJson))
 	if err != nil {
-		log.Println("an error while creating a request" + err.Error())
+		slog.Error("an error while creating a request", "err", err)
 		return nil, err
 	}
 
 	// set options into a header
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+apiKey)
+	req.Header.Set("Authorization", "Bearer "+openaiConfig.APIKey)
 
 	// Execute a request to openai
-	client := &http.Client{}
-	res, err := client.Do(req)
-	log.Println("openai req")
+	start := time.Now()
+	res, err := openaiClient.Do(req)
 	if err != nil {
-		log.Println("an error while encoding JSON" + err.Error())
+		slog.Error("an error while requesting openai", "err", err)
 		return nil, err
 	}
+	slog.Debug("openai request", "status", res.StatusCode, "latency", time.Since(start))
 
 	// set up io
 	defer func(Body io.ReadCloser) {
 		err := Body.Close()
 		if err != nil {
-			log.Println("an error while closing io" + err.Error())
+			slog.Error("an error while closing io", "err", err)
 		}
 	}(res.Body)
 
 	// read the body of response with io reader
 	body, err := io.ReadAll(res.Body)
 	if err != nil {
-		log.Println("an error while reading body of the response with io" + err.Error())
+		slog.Error("an error while reading body of the response with io", "err", err)
 		return nil, err
 	}
 
@@ -112,17 +141,62 @@ func GetOpenaiChatResponse(input string) (*OpenaiResponse, error) {
 	var openaiRes OpenaiResponse
 	err = json.Unmarshal(body, &openaiRes)
 	if err != nil {
-		log.Println("an error while parsing encoded JSON response" + err.Error())
+		slog.Error("an error while parsing encoded JSON response", "err", err)
 		return nil, err
 	}
 
-	if len(openaiRes.Choices) > 0 {
-		Conversation = append(Conversation, Message{
-			Role:    "assistant",
-			Content: openaiRes.Choices[0].Messages.Content,
-		})
-	}
+	openaiTokens.WithLabelValues("prompt").Add(float64(openaiRes.Usages.PromptTokens))
+	openaiTokens.WithLabelValues("completion").Add(float64(openaiRes.Usages.CompletionTokens))
 
 	return &openaiRes, nil
 
 }
+
+const (
+	OpenaiSpeechURL   = "https://api.openai.com/v1/audio/speech"
+	openaiSpeechModel = "tts-1"
+	openaiVoice       = "alloy"
+)
+
+var openaiSpeechClient = dependencyClient("openai", fixedOperation("speech"))
+
+// How the bot gets pronunciations as mp3. The console can swap it for OfflinePronunciation.
+var pronounce = GetOpenaiSpeech
+
+func SetPronouncer(f func(ctx context.Context, input string) ([]byte, error)) {
+	pronounce = f
+}
+
+// No audio, to try the bot without calling openai. Cards are exported without sound.
+func OfflinePronunciation(ctx context.Context, input string) ([]byte, error) {
+	return nil, nil
+}
+
+// Get the spoken input as mp3.
+func GetOpenaiSpeech(ctx context.Context, input string) ([]byte, error) {
+	reqJson, err := json.Marshal(map[string]string{
+		"model":           openaiSpeechModel,
+		"voice":           openaiVoice,
+		"input":           input,
+		"response_format": "mp3",
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", OpenaiSpeechURL, bytes.NewBuffer(reqJson))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+openaiConfig.APIKey)
+
+	res, err := openaiSpeechClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("openai returned %d for a pronunciation", res.StatusCode)
+	}
+	return io.ReadAll(res.Body)
+}
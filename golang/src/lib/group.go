@@ -0,0 +1,320 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// In a group or a room the bot only answers texts that mention it or start
+// with groupPrefix, e.g. "!hello" or "!quiz". Lookups still go to the sender's
+// own notebook and quota, and the replies go to the group.
+const groupPrefix = "!"
+
+// A group remembers this many of its latest lookups to make quizzes from.
+const groupWordLimit = 50
+
+// An unanswered quiz is given up on after this long.
+const groupQuizTimeout = 10 * time.Minute
+
+type GroupWord struct {
+	Word     string    `json:"word"`
+	UserID   string    `json:"userId"`
+	LookedUp time.Time `json:"lookedUp"`
+}
+
+type GroupQuiz struct {
+	Word      string    `json:"word"`
+	Hint      string    `json:"hint"`
+	Choices   []string  `json:"choices"`
+	StartedAt time.Time `json:"startedAt"`
+	// Everyone gets one try
+	Answered []string `json:"answered"`
+}
+
+// What the bot keeps about a group, at groups/<groupId>/state.json
+type GroupState struct {
+	GroupID string            `json:"groupId"`
+	Words   []GroupWord       `json:"words"`
+	Quiz    *GroupQuiz        `json:"quiz,omitempty"`
+	Scores  map[string]int    `json:"scores"`
+	Names   map[string]string `json:"names"`
+}
+
+var groupMu sync.Mutex
+
+func groupStateKey(groupId string) string {
+	return fmt.Sprintf("groups/%s/state.json", groupId)
+}
+
+func getGroupState(groupId string) *GroupState {
+	state := &GroupState{GroupID: groupId}
+	if content, exists := GetMessage(groupStateKey(groupId)); exists {
+		if err := json.Unmarshal(content, state); err != nil {
+			slog.Error("broken group state", "err", err)
+		}
+	}
+	if state.Scores == nil {
+		state.Scores = make(map[string]int)
+	}
+	if state.Names == nil {
+		state.Names = make(map[string]string)
+	}
+	return state
+}
+
+// Change the state of a group, saving it unless update returns false.
+func updateGroupState(groupId string, update func(state *GroupState) bool) error {
+	groupMu.Lock()
+	defer groupMu.Unlock()
+
+	state := getGroupState(groupId)
+	if !update(state) {
+		return nil
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return SaveObject(groupStateKey(groupId), data, "application/json")
+}
+
+// Remember a word looked up in the group so that quizzes can ask it.
+func rememberGroupWord(msg *IncomingMessage, word string) {
+	err := updateGroupState(msg.ChatID, func(state *GroupState) bool {
+		for i, w := range state.Words {
+			if w.Word == word {
+				state.Words = append(state.Words[:i], state.Words[i+1:]...)
+				break
+			}
+		}
+		state.Words = append(state.Words, GroupWord{Word: word, UserID: msg.UserID, LookedUp: time.Now()})
+		if len(state.Words) > groupWordLimit {
+			state.Words = state.Words[len(state.Words)-groupWordLimit:]
+		}
+		return true
+	})
+	if err != nil {
+		msg.Logger().Error("failed to remember a group word", "err", err)
+	}
+}
+
+// Commands that are about the sender's own data are kept out of the group.
+var personalCommands = []string{"notebook", "forget", "export", "wotd", "progress", "settings"}
+
+const groupHelpText = `Send "!<word>" or mention me to look up a word. It goes to your own notebook.
+
+!quiz - a quiz from the words looked up here
+!answer <word>
+!leaderboard`
+
+// Handle the commands in a group:
+//
+//	quiz                 start a quiz, or show the one running
+//	answer <word>        answer the quiz, once per member
+//	leaderboard          the scores of the group
+//	help
+//
+// It reports whether the text was a command, so that it is not looked up as a word.
+func handleGroupCommand(m Messenger, msg *IncomingMessage) bool {
+	fields := strings.Fields(strings.ToLower(msg.Text))
+	if len(fields) == 0 {
+		return false
+	}
+
+	var reply OutgoingReply
+	switch {
+	case fields[0] == "quiz" && len(fields) == 1:
+		reply = startGroupQuiz(msg)
+	case fields[0] == "answer" && len(fields) > 1:
+		reply = answerGroupQuiz(m, msg, strings.Join(fields[1:], " "))
+	case (fields[0] == "leaderboard" || fields[0] == "top") && len(fields) == 1:
+		reply = TextReply(leaderboard(getGroupState(msg.ChatID)))
+	case fields[0] == "help" && len(fields) == 1:
+		reply = TextReply(groupHelpText)
+	case containsString(personalCommands, fields[0]):
+		reply = TextReply(fmt.Sprintf("\"%s\" is about your own words. Send it to me in a 1:1 chat.", fields[0]))
+	default:
+		return false
+	}
+
+	if err := m.Reply(msg, reply); err != nil {
+		msg.Logger().Error("Failed to reply to a group command", "err", err)
+	}
+	return true
+}
+
+func startGroupQuiz(msg *IncomingMessage) OutgoingReply {
+	var reply OutgoingReply
+	err := updateGroupState(msg.ChatID, func(state *GroupState) bool {
+		var notice string
+		if state.Quiz != nil {
+			if time.Since(state.Quiz.StartedAt) < groupQuizTimeout {
+				reply = groupQuizMessage(state.Quiz, "")
+				return false
+			}
+			notice = fmt.Sprintf("Nobody got the last one, it was \"%s\".\n\n", state.Quiz.Word)
+		}
+
+		quiz := newGroupQuiz(state.Words)
+		if quiz == nil {
+			reply = TextReply(notice + "Look up some words here first, like \"!itinerary\", and I'll quiz you on them.")
+			state.Quiz = nil
+			return notice != ""
+		}
+		state.Quiz = quiz
+		reply = groupQuizMessage(quiz, notice)
+		return true
+	})
+	if err != nil {
+		msg.Logger().Error("failed to start a group quiz", "err", err)
+		return TextReply("Sorry, we're under maintenance. Try it later.")
+	}
+	return reply
+}
+
+// Make a quiz of a word the group looked up: its explanation with the word
+// hidden, and the word among others to choose from.
+func newGroupQuiz(words []GroupWord) *GroupQuiz {
+	for _, i := range rand.Perm(len(words)) {
+		word := words[i]
+		content, exists := GetMessage(explanationKey(word.UserID, word.Word))
+		if !exists {
+			continue
+		}
+
+		choices := []string{word.Word}
+		var others []string
+		for _, w := range words {
+			others = append(others, w.Word)
+		}
+		for _, segment := range wotdSegments {
+			others = append(others, segment.Words...)
+		}
+		for _, j := range rand.Perm(len(others)) {
+			if len(choices) == 4 {
+				break
+			}
+			if !containsString(choices, others[j]) {
+				choices = append(choices, others[j])
+			}
+		}
+		rand.Shuffle(len(choices), func(a, b int) { choices[a], choices[b] = choices[b], choices[a] })
+
+		return &GroupQuiz{
+			Word:      word.Word,
+			Hint:      quizHint(string(content), word.Word),
+			Choices:   choices,
+			StartedAt: time.Now(),
+		}
+	}
+	return nil
+}
+
+// A quiz hint is this long at most.
+const quizHintLength = 300
+
+func quizHint(explanation string, word string) string {
+	hidden := regexp.MustCompile(`(?i)`+regexp.QuoteMeta(word)).ReplaceAllString(explanation, "____")
+	runes := []rune(strings.TrimSpace(hidden))
+	if len(runes) > quizHintLength {
+		return string(runes[:quizHintLength]) + "..."
+	}
+	return string(runes)
+}
+
+func groupQuizMessage(quiz *GroupQuiz, notice string) OutgoingReply {
+	quickReplies := make([]QuickReply, 0, len(quiz.Choices))
+	for _, choice := range quiz.Choices {
+		// a long phrase is cut short on the button and answered in full
+		quickReplies = append(quickReplies, QuickReply{Label: quickReplyLabel(choice), Text: groupPrefix + "answer " + choice})
+	}
+	return TextReply(notice + "Which word is it?\n\n" + quiz.Hint).WithQuickReplies(quickReplies...)
+}
+
+func answerGroupQuiz(m Messenger, msg *IncomingMessage, answer string) OutgoingReply {
+	// look the name up outside the lock, it's a call to the platform
+	name, known := getGroupState(msg.ChatID).Names[msg.UserID]
+	if !known {
+		var err error
+		if name, err = m.SenderName(msg); err != nil {
+			msg.Logger().Error("Failed to get the name of a member", "err", err)
+			name = "someone"
+		}
+	}
+
+	var reply string
+	answered, correct := false, false
+	err := updateGroupState(msg.ChatID, func(state *GroupState) bool {
+		quiz := state.Quiz
+		if quiz == nil || time.Since(quiz.StartedAt) >= groupQuizTimeout {
+			reply = fmt.Sprintf("There's no quiz running. Send \"%squiz\" to start one.", groupPrefix)
+			return false
+		}
+		if containsString(quiz.Answered, msg.UserID) {
+			reply = fmt.Sprintf("You've had your try, %s. Let the others answer.", name)
+			return false
+		}
+
+		answered = true
+		state.Names[msg.UserID] = name
+		if !strings.EqualFold(answer, quiz.Word) {
+			quiz.Answered = append(quiz.Answered, msg.UserID)
+			reply = fmt.Sprintf("Not \"%s\", %s.", answer, name)
+			return true
+		}
+		correct = true
+		state.Scores[msg.UserID]++
+		state.Quiz = nil
+		reply = fmt.Sprintf("%s got it! It's \"%s\".\n\n%s", name, quiz.Word, leaderboard(state))
+		return true
+	})
+	if err != nil {
+		msg.Logger().Error("failed to answer a group quiz", "err", err)
+		return TextReply("Sorry, we're under maintenance. Try it later.")
+	}
+
+	if answered {
+		RecordActivity(msg.UserID, func(activity *DailyActivity) {
+			activity.QuizAnswered++
+			if correct {
+				activity.QuizCorrect++
+			}
+		})
+	}
+	return TextReply(reply)
+}
+
+// The leaderboard shows this many members.
+const leaderboardSize = 10
+
+func leaderboard(state *GroupState) string {
+	if len(state.Scores) == 0 {
+		return fmt.Sprintf("No scores yet. Send \"%squiz\" to start.", groupPrefix)
+	}
+	userIds := make([]string, 0, len(state.Scores))
+	for userId := range state.Scores {
+		userIds = append(userIds, userId)
+	}
+	sort.Slice(userIds, func(i, j int) bool {
+		if state.Scores[userIds[i]] != state.Scores[userIds[j]] {
+			return state.Scores[userIds[i]] > state.Scores[userIds[j]]
+		}
+		return state.Names[userIds[i]] < state.Names[userIds[j]]
+	})
+	if len(userIds) > leaderboardSize {
+		userIds = userIds[:leaderboardSize]
+	}
+
+	lines := []string{"Leaderboard"}
+	for i, userId := range userIds {
+		lines = append(lines, fmt.Sprintf("%d. %s  %d", i+1, state.Names[userId], state.Scores[userId]))
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,242 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// /healthz says the process is up, /readyz whether it can serve: the LINE
+// token is valid, S3 and the LLM answer and the queue has room. Orchestrators
+// take the bot out of rotation while /readyz fails.
+
+type readinessCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+var readinessChecks = []readinessCheck{
+	{"line", checkLineToken},
+	{"s3", checkStore},
+	{"llm", checkOpenai},
+	{"queue", checkQueue},
+}
+
+// Replace a readiness check, or add one. A nil check removes it, e.g. "llm"
+// with offline explanations.
+func SetReadinessCheck(name string, check func(ctx context.Context) error) {
+	readinessMu.Lock()
+	defer readinessMu.Unlock()
+	readinessCache = nil
+	for i, c := range readinessChecks {
+		if c.name == name {
+			if check == nil {
+				readinessChecks = append(readinessChecks[:i], readinessChecks[i+1:]...)
+			} else {
+				readinessChecks[i].check = check
+			}
+			return
+		}
+	}
+	if check != nil {
+		readinessChecks = append(readinessChecks, readinessCheck{name, check})
+	}
+}
+
+type CheckResult struct {
+	OK        bool    `json:"ok"`
+	Error     string  `json:"error,omitempty"`
+	LatencyMs float64 `json:"latencyMs"`
+}
+
+type Readiness struct {
+	Ready     bool                   `json:"ready"`
+	CheckedAt time.Time              `json:"checkedAt"`
+	Checks    map[string]CheckResult `json:"checks"`
+}
+
+const (
+	readinessTimeout = 3 * time.Second
+	// probes come every few seconds; LINE and openai don't need to hear about each
+	readinessCacheTTL = 10 * time.Second
+	// the webhook blocks when the queue is full, so stop taking traffic before that
+	queueSaturation = 0.9
+)
+
+var (
+	readinessMu    sync.Mutex
+	readinessCache *Readiness
+)
+
+// Run the checks at once, or return the last results while they are fresh.
+func CheckReadiness(ctx context.Context) *Readiness {
+	readinessMu.Lock()
+	defer readinessMu.Unlock()
+	if readinessCache != nil && time.Since(readinessCache.CheckedAt) < readinessCacheTTL {
+		return readinessCache
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, readinessTimeout)
+	defer cancel()
+	readiness := &Readiness{Ready: true, CheckedAt: time.Now(), Checks: make(map[string]CheckResult)}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range readinessChecks {
+		wg.Add(1)
+		go func(c readinessCheck) {
+			defer wg.Done()
+			start := time.Now()
+			err := c.check(ctx)
+			result := CheckResult{OK: err == nil, LatencyMs: float64(time.Since(start).Microseconds()) / 1000}
+			if err != nil {
+				result.Error = err.Error()
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			readiness.Checks[c.name] = result
+			readiness.Ready = readiness.Ready && result.OK
+		}(c)
+	}
+	wg.Wait()
+	readinessCache = readiness
+	return readiness
+}
+
+func checkLineToken(ctx context.Context) error {
+	current := GetBot()
+	if current == nil {
+		return errors.New("no LINE client")
+	}
+	_, err := VerifyAccessToken(ctx, current.AccessToken)
+	return err
+}
+
+func checkStore(ctx context.Context) error {
+	if _, isS3 := store.(s3Store); isS3 && s3Client == nil {
+		return errors.New("no S3 session")
+	}
+	// an empty prefix, so it's one small request
+	_, err := store.List("readyz/")
+	return err
+}
+
+var openaiModelsURL = "https://api.openai.com/v1/models"
+
+func checkOpenai(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, openaiModelsURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+openaiConfig.APIKey)
+	res, err := openaiClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("openai returned %d", res.StatusCode)
+	}
+	return nil
+}
+
+func checkQueue(ctx context.Context) error {
+	if requestQueue == nil {
+		return errors.New("no request queue")
+	}
+	if depth, capacity := len(requestQueue), cap(requestQueue); float64(depth) >= queueSaturation*float64(capacity) {
+		return fmt.Errorf("the queue is saturated: %d of %d", depth, capacity)
+	}
+	return nil
+}
+
+func HealthzHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+func ReadyzHandler(c *gin.Context) {
+	readiness := CheckReadiness(c.Request.Context())
+	status := http.StatusOK
+	if !readiness.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, readiness)
+}
+
+var startedAt = time.Now()
+
+type BuildStatus struct {
+	GoVersion string `json:"goVersion"`
+	Module    string `json:"module"`
+	Version   string `json:"version"`
+	Revision  string `json:"revision,omitempty"`
+	Time      string `json:"time,omitempty"`
+	Modified  bool   `json:"modified,omitempty"`
+}
+
+type DebugStatus struct {
+	StartedAt      time.Time   `json:"startedAt"`
+	Uptime         string      `json:"uptime"`
+	Build          BuildStatus `json:"build"`
+	TokenExpiresAt *time.Time  `json:"tokenExpiresAt"`
+	// Valid tokens of the channel the bot didn't issue
+	UnknownTokenKeyIDs []string         `json:"unknownTokenKeyIds,omitempty"`
+	AWSCredentials     CredentialStatus `json:"awsCredentials"`
+	QueueDepth         int              `json:"queueDepth"`
+	QueueCapacity      int              `json:"queueCapacity"`
+	Workers            []WorkerStatus   `json:"workers"`
+	Readiness          *Readiness       `json:"readiness"`
+}
+
+func buildStatus() BuildStatus {
+	var status BuildStatus
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return status
+	}
+	status.GoVersion = info.GoVersion
+	status.Module = info.Main.Path
+	status.Version = info.Main.Version
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			status.Revision = setting.Value
+		case "vcs.time":
+			status.Time = setting.Value
+		case "vcs.modified":
+			status.Modified = setting.Value == "true"
+		}
+	}
+	return status
+}
+
+// GET /debug/status, behind AdminAuth.
+func DebugStatusHandler(c *gin.Context) {
+	status := DebugStatus{
+		StartedAt:     startedAt,
+		Uptime:        time.Since(startedAt).Round(time.Second).String(),
+		Build:         buildStatus(),
+		QueueDepth:    len(requestQueue),
+		QueueCapacity: cap(requestQueue),
+		Workers:       WorkerStatuses(),
+		Readiness:     CheckReadiness(c.Request.Context()),
+	}
+	// the readiness has checked the token with LINE already
+	if channelTokens != nil {
+		if expiresAt, ok := channelTokens.ExpiresAt(); ok {
+			status.TokenExpiresAt = &expiresAt
+		}
+		status.UnknownTokenKeyIDs = channelTokens.UnknownKeyIDs()
+	}
+	if _, isS3 := store.(s3Store); isS3 {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), readinessTimeout)
+		defer cancel()
+		status.AWSCredentials = AWSCredentialStatus(ctx)
+	}
+	c.JSON(http.StatusOK, status)
+}
@@ -4,9 +4,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
-	"os"
 	"strings"
 )
 
@@ -26,7 +25,13 @@ type Photo struct {
 	PhotographerUrl string `json:"photographer_url"`
 }
 
-var apiKey = os.Getenv("PEXELS_API_KEY")
+var pexelsConfig PexelsConfig
+
+func SetPexels(config PexelsConfig) {
+	pexelsConfig = config
+}
+
+var pexelsClient = dependencyClient("pexels", fixedOperation("search"))
 
 func GetImagesFromPexels(input string) ([]Photo, error) {
 
@@ -38,11 +43,10 @@ func GetImagesFromPexels(input string) ([]Photo, error) {
 	}
 
 	// set auth to header
-	req.Header.Set("Authorization", apiKey)
+	req.Header.Set("Authorization", pexelsConfig.APIKey)
 
 	// exe sending a request
-	client := &http.Client{}
-	res, err := client.Do(req)
+	res, err := pexelsClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -60,7 +64,7 @@ func GetImagesFromPexels(input string) ([]Photo, error) {
 		return nil, err
 	}
 
-	log.Println(result.Photos)
+	slog.Debug("Found photos", "count", len(result.Photos))
 
 	return result.Photos, nil
 }
@@ -0,0 +1,368 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/line/line-bot-sdk-go/linebot"
+)
+
+// Word lists bigger than this are rejected before they are read.
+const maxImportFileSize = 1 << 20
+
+// Progress of importing a word list into one user's notebook.
+type ImportProgress struct {
+	ID         string    `json:"id"`
+	UserID     string    `json:"userId"`
+	Total      int       `json:"total"`
+	Done       int       `json:"done"`
+	Failed     int       `json:"failed"`
+	Rejected   []string  `json:"rejected"`
+	Started    time.Time `json:"started"`
+	Finished   bool      `json:"finished"`
+	FinishedAt time.Time `json:"finishedAt,omitempty"`
+}
+
+type ImportJob struct {
+	ImportProgress
+
+	notify bool
+	mu     sync.Mutex
+}
+
+var importJobs = make(map[string]*ImportJob)
+var importJobsMu sync.Mutex
+
+// Finished imports can be looked up for this long
+const importJobTTL = 24 * time.Hour
+
+// Imports have workers of their own, so a class-sized word list neither holds
+// up the webhooks nor sends more than a few requests to openai at a time.
+var (
+	importTasks        = make(chan func())
+	importWorkers      = DefaultConfig().Queue.ImportWorkers
+	importWorkersStart sync.Once
+)
+
+// Set before the first import; the workers start with it.
+func SetImportWorkers(n int) {
+	importWorkers = n
+}
+
+func startImportWorkers() {
+	importWorkersStart.Do(func() {
+		for i := 0; i < importWorkers; i++ {
+			go func() {
+				for task := range importTasks {
+					task()
+				}
+			}()
+		}
+	})
+}
+
+// Explanations and pictures don't depend on who imports the word, so an
+// import makes one per word and copies it into the notebooks.
+func sharedExplanationKey(word string) string {
+	return "bots/words/explanations/" + textKey(word)
+}
+
+func sharedImageKey(word string) string {
+	return "bots/words/images/" + textKey(word)
+}
+
+// Imports of the same word for different users wait for each other instead of explaining it twice
+var importWordLocks [64]sync.Mutex
+
+func importWordLock(word string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(word))
+	return &importWordLocks[h.Sum32()%uint32(len(importWordLocks))]
+}
+
+// The words of an import with their tags, and the entries that aren't words.
+type wordList struct {
+	words    []string
+	tags     [][]string
+	rejected []string
+	seen     map[string]bool
+}
+
+func newWordList() *wordList {
+	return &wordList{seen: make(map[string]bool)}
+}
+
+// Add an entry, checked with the same rules as chat input.
+func (l *wordList) add(raw string, tags []string) {
+	raw = RemoveExtraSpace(raw)
+	if raw == "" {
+		return
+	}
+	word, isSanitized := IsEnglishSentence(raw)
+	if !isSanitized {
+		l.rejected = append(l.rejected, raw)
+		return
+	}
+	if l.seen[word] {
+		return
+	}
+	l.seen[word] = true
+
+	var wordTags []string
+	for _, tag := range tags {
+		if tag = strings.ToLower(strings.TrimSpace(tag)); tag != "" {
+			wordTags = append(wordTags, tag)
+		}
+	}
+	l.words = append(l.words, word)
+	l.tags = append(l.tags, wordTags)
+}
+
+// Add the entries of a word list in CSV or plain text, one word per line.
+// With CSV the first column is the word and the rest are tags.
+func (l *wordList) parse(data []byte) error {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// the header of a CSV
+		if strings.EqualFold(RemoveExtraSpace(record[0]), "word") {
+			continue
+		}
+		l.add(record[0], record[1:])
+	}
+}
+
+// Parse a word list in CSV or plain text, one word per line.
+// With CSV the first column is the word and the rest are tags.
+// Entries failing the same rules as chat input are returned as rejected.
+func ParseWordList(data []byte) ([]string, [][]string, []string, error) {
+	l := newWordList()
+	if err := l.parse(data); err != nil {
+		return nil, nil, nil, err
+	}
+	return l.words, l.tags, l.rejected, nil
+}
+
+// Add the words to the user's notebook and explain the new ones in the background.
+// When notify is set the user gets progress messages.
+func StartImport(userId string, words []string, tags [][]string, rejected []string, notify bool) *ImportJob {
+	job := &ImportJob{
+		ImportProgress: ImportProgress{
+			ID:       fmt.Sprintf("%s-%d", userId, time.Now().UnixNano()),
+			UserID:   userId,
+			Total:    len(words),
+			Rejected: rejected,
+			Started:  time.Now(),
+		},
+		notify: notify,
+	}
+	importJobsMu.Lock()
+	pruneImportJobs(job.Started)
+	importJobs[job.ID] = job
+	importJobsMu.Unlock()
+
+	if notify {
+		msg := fmt.Sprintf("Importing %d words into your notebook.", job.Total)
+		if len(rejected) > 0 {
+			msg += fmt.Sprintf(" %d entries were skipped: %s", len(rejected), strings.Join(rejected, ", "))
+		}
+		job.push(msg)
+	}
+	if job.Total == 0 {
+		job.finish()
+		return job
+	}
+
+	startImportWorkers()
+	go func() {
+		for i, word := range words {
+			word, wordTags := word, tags[i]
+			importTasks <- func() {
+				job.record(importWord(userId, word, wordTags))
+			}
+		}
+	}()
+	return job
+}
+
+func GetImportJob(id string) (*ImportJob, bool) {
+	importJobsMu.Lock()
+	defer importJobsMu.Unlock()
+	pruneImportJobs(time.Now())
+	job, exists := importJobs[id]
+	return job, exists
+}
+
+// Forget the imports that finished longer than importJobTTL ago. The caller holds importJobsMu.
+func pruneImportJobs(now time.Time) {
+	for id, job := range importJobs {
+		job.mu.Lock()
+		expired := job.Finished && now.Sub(job.FinishedAt) > importJobTTL
+		job.mu.Unlock()
+		if expired {
+			delete(importJobs, id)
+		}
+	}
+}
+
+// Copy the progress for reporting while workers keep updating it.
+func (job *ImportJob) Snapshot() ImportProgress {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	return job.ImportProgress
+}
+
+func importWord(userId string, word string, tags []string) error {
+	if _, _, err := AddToNotebook(userId, word, tags); err != nil {
+		return err
+	}
+	if ObjectExists(explanationKey(userId, word)) {
+		return nil
+	}
+	lock := importWordLock(word)
+	lock.Lock()
+	defer lock.Unlock()
+	if !ObjectExists(sharedExplanationKey(word)) {
+		if err := PregenerateExplanation(userId, word); err != nil {
+			return err
+		}
+		// share what was made for this user with the next ones
+		if err := copyObject(explanationKey(userId, word), sharedExplanationKey(word)); err != nil {
+			slog.Warn("Failed to share an explanation", "err", err)
+		}
+		if ObjectExists(imageKey(userId, word)) {
+			if err := copyObject(imageKey(userId, word), sharedImageKey(word)); err != nil {
+				slog.Warn("Failed to share a picture", "err", err)
+			}
+		}
+		return nil
+	}
+	if err := copyObject(sharedExplanationKey(word), explanationKey(userId, word)); err != nil {
+		return err
+	}
+	if ObjectExists(sharedImageKey(word)) {
+		return copyObject(sharedImageKey(word), imageKey(userId, word))
+	}
+	return nil
+}
+
+// Generate and cache the explanation, picture and pronunciation of a word before the user asks.
+func PregenerateExplanation(userId string, word string) error {
+	res, err := explain(context.Background(), word)
+	if err != nil {
+		return err
+	}
+	if len(res.Choices) == 0 {
+		return errors.New("no explanation was generated for " + word)
+	}
+	if err = SaveObject(explanationKey(userId, word), []byte(res.Choices[0].Messages.Content), "text/plain"); err != nil {
+		return err
+	}
+	findImages(context.Background(), word, 1, userId)
+	// the worker is already off the reply path, so the pronunciation is made here
+	if err = generatePronunciation(context.Background(), word); err != nil {
+		slog.Warn("Failed to get a pronunciation", "err", err)
+	}
+	return nil
+}
+
+func (job *ImportJob) record(err error) {
+	job.mu.Lock()
+	job.Done++
+	if err != nil {
+		job.Failed++
+		slog.Error("failed to import a word", "err", err)
+	}
+	done, total := job.Done, job.Total
+	job.mu.Unlock()
+
+	switch {
+	case done == total:
+		job.finish()
+	case job.notify && done%(total/4+1) == 0:
+		job.push(fmt.Sprintf("Imported %d of %d words...", done, total))
+	}
+}
+
+func (job *ImportJob) finish() {
+	job.mu.Lock()
+	job.Finished = true
+	job.FinishedAt = time.Now()
+	msg := fmt.Sprintf("Finished importing %d words. Send \"notebook\" to see them.", job.Done-job.Failed)
+	if job.Failed > 0 {
+		msg += fmt.Sprintf(" %d words couldn't be explained yet and will be explained when you look them up.", job.Failed)
+	}
+	job.mu.Unlock()
+
+	if job.notify {
+		job.push(msg)
+	}
+}
+
+func (job *ImportJob) push(msg string) {
+	if _, err := GetBot().Client.PushMessage(job.UserID, linebot.NewTextMessage(msg)).Do(); err != nil {
+		slog.Error("Failed to push an import progress", "err", err)
+	}
+}
+
+// Import a word list sent as a file in the chat into the sender's notebook.
+func handleFileMessage(event *linebot.Event, message *linebot.FileMessage) {
+	name := strings.ToLower(message.FileName)
+	if !strings.HasSuffix(name, ".csv") && !strings.HasSuffix(name, ".txt") {
+		if _, err := GetBot().Client.ReplyMessage(event.ReplyToken,
+			linebot.NewTextMessage("Send a word list as a .csv or .txt file to import it.")).Do(); err != nil {
+			slog.Error("Failed to reply about an unsupported file", "err", err)
+		}
+		return
+	}
+	if message.FileSize > maxImportFileSize {
+		if _, err := GetBot().Client.ReplyMessage(event.ReplyToken,
+			linebot.NewTextMessage("The word list is too big. Split it into files under "+strconv.Itoa(maxImportFileSize>>10)+"KB.")).Do(); err != nil {
+			slog.Error("Failed to reply about a big file", "err", err)
+		}
+		return
+	}
+
+	words, tags, rejected, err := readWordListFile(message.ID)
+	if err != nil {
+		slog.Error("failed to read a word list", "err", err)
+		if _, err = GetBot().Client.ReplyMessage(event.ReplyToken,
+			linebot.NewTextMessage("Sorry, we couldn't read the word list.")).Do(); err != nil {
+			slog.Error("Failed to reply about a broken file", "err", err)
+		}
+		return
+	}
+	StartImport(event.Source.UserID, words, tags, rejected, true)
+}
+
+func readWordListFile(messageId string) ([]string, [][]string, []string, error) {
+	content, err := GetBot().Client.GetMessageContent(messageId).Do()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer content.Content.Close()
+
+	data, err := io.ReadAll(io.LimitReader(content.Content, maxImportFileSize))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return ParseWordList(data)
+}
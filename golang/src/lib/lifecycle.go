@@ -0,0 +1,137 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/line/line-bot-sdk-go/linebot"
+)
+
+// How long the data of a user who blocked the bot is kept in case they come back.
+const dataRetention = 30 * 24 * time.Hour
+
+// A new friend, or a friend who unblocked the bot.
+func handleFollowEvent(event *linebot.Event) {
+	userId := event.Source.UserID
+	// ask LINE before taking the lock on the profile
+	res, err := GetBot().Client.GetProfile(userId).Do()
+	if err != nil {
+		slog.Error("Failed to get the LINE profile", "err", err)
+	}
+
+	var existed bool
+	profile, err := UpdateProfile(userId, func(profile *UserProfile, exists bool) bool {
+		existed = exists
+		if res != nil {
+			profile.DisplayName = res.DisplayName
+			if profile.NativeLanguage == "" {
+				profile.NativeLanguage = res.Language
+			}
+		}
+		profile.Active = true
+		profile.FollowedAt = time.Now()
+		profile.UnfollowedAt = time.Time{}
+		profile.PurgeAfter = time.Time{}
+		if !exists {
+			profile.OnboardingStep = onboardingSteps[0].name
+		}
+		return true
+	})
+	if err != nil {
+		slog.Error("failed to save a profile", "err", err)
+	}
+	linkRichMenu(profile)
+
+	var replies []OutgoingReply
+	if existed {
+		replies = append(replies, TextReply(fmt.Sprintf("Welcome back, %s! Your notebook is right where you left it.", profile.DisplayName)))
+	} else {
+		replies = append(replies,
+			TextReply(fmt.Sprintf("Hi %s! Send me any English word or phrase and I'll explain it with a picture.", profile.DisplayName)),
+			onboardingQuestion(onboardingSteps[0], ""))
+	}
+	if _, err := GetBot().Client.ReplyMessage(event.ReplyToken, lineMessages(replies)...).Do(); err != nil {
+		slog.Error("Failed to reply to a follow", "err", err)
+	}
+}
+
+// The user blocked the bot. Nothing can be sent to them any more.
+func handleUnfollowEvent(event *linebot.Event) {
+	userId := event.Source.UserID
+	_, err := UpdateProfile(userId, func(profile *UserProfile, exists bool) bool {
+		profile.Active = false
+		profile.UnfollowedAt = time.Now()
+		profile.PurgeAfter = profile.UnfollowedAt.Add(dataRetention)
+		return true
+	})
+	if err != nil {
+		slog.Error("failed to save a profile", "err", err)
+	}
+
+	if sub, exists := GetWotdSubscription(userId); exists && !sub.OptOut {
+		sub.OptOut = true
+		if err := SaveWotdSubscription(sub); err != nil {
+			slog.Error("failed to unsubscribe from the word of the day", "err", err)
+		}
+	}
+}
+
+func handleJoinEvent(event *linebot.Event) {
+	if _, err := GetBot().Client.ReplyMessage(event.ReplyToken,
+		linebot.NewTextMessage("Hi everyone! Send \"!<word>\" or mention me to look up an English word, "+
+			"and \"!quiz\" to test each other on the words you looked up. Send \"!help\" for more.")).Do(); err != nil {
+		slog.Error("Failed to reply to a join", "err", err)
+	}
+}
+
+// The bot was removed from a group or a room. Its words and scores go with it.
+func handleLeaveEvent(event *linebot.Event) {
+	slog.Info("Left a chat", "source_type", event.Source.Type)
+	if err := DeleteObject(groupStateKey(chatID(event.Source))); err != nil {
+		slog.Error("failed to delete the group state", "err", err)
+	}
+}
+
+// Delete the data of users who blocked the bot longer than the retention ago,
+// and the exports everyone has downloaded.
+// It runs on the scheduler.
+func DataRetentionJob(ctx context.Context) error {
+	userIds, err := ListUserIDs()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, userId := range userIds {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err := PruneExports(userId, now); err != nil {
+			slog.Error("failed to delete old exports", "err", err)
+		}
+		profile, exists := Profiles.Get(userId)
+		if !exists || profile.Active || profile.PurgeAfter.IsZero() || now.Before(profile.PurgeAfter) {
+			continue
+		}
+		if err := purgeUserData(userId); err != nil {
+			slog.Error("failed to delete the data of a user", "err", err)
+			continue
+		}
+		slog.Info("Deleted the data of an inactive user")
+	}
+	return nil
+}
+
+func purgeUserData(userId string) error {
+	for _, prefix := range []string{
+		fmt.Sprintf("users/%s/", userId),
+		fmt.Sprintf("bots/users/%s/", userId),
+	} {
+		if err := DeletePrefix(prefix); err != nil {
+			return err
+		}
+	}
+	DeleteObject(wotdSubscriptionKey(userId))
+	return Profiles.Delete(userId)
+}
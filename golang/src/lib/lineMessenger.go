@@ -0,0 +1,247 @@
+package lib
+
+import (
+	"log/slog"
+	"strings"
+	"sync"
+	"unicode/utf16"
+
+	"github.com/line/line-bot-sdk-go/linebot"
+)
+
+// The Messenger of LINE, sending with the current bot client.
+type lineMessenger struct{}
+
+func LineMessenger() Messenger {
+	return lineMessenger{}
+}
+
+func (lineMessenger) Platform() string {
+	return "line"
+}
+
+func (lineMessenger) Reply(msg *IncomingMessage, replies ...OutgoingReply) error {
+	_, err := GetBot().Client.ReplyMessage(msg.ReplyToken, lineMessages(replies)...).WithContext(msg.Context()).Do()
+	return err
+}
+
+func (lineMessenger) Push(chatID string, replies ...OutgoingReply) error {
+	_, err := GetBot().Client.PushMessage(chatID, lineMessages(replies)...).Do()
+	return err
+}
+
+// The name the sender has in the group, or their LINE name in a 1:1 chat.
+func (lineMessenger) SenderName(msg *IncomingMessage) (string, error) {
+	var res *linebot.UserProfileResponse
+	var err error
+	switch {
+	case !msg.Group:
+		res, err = GetBot().Client.GetProfile(msg.UserID).WithContext(msg.Context()).Do()
+	// LINE IDs start with U for users, C for groups and R for rooms
+	case strings.HasPrefix(msg.ChatID, "R"):
+		res, err = GetBot().Client.GetRoomMemberProfile(msg.ChatID, msg.UserID).WithContext(msg.Context()).Do()
+	default:
+		res, err = GetBot().Client.GetGroupMemberProfile(msg.ChatID, msg.UserID).WithContext(msg.Context()).Do()
+	}
+	if err != nil {
+		return "", err
+	}
+	return res.DisplayName, nil
+}
+
+func lineMessages(replies []OutgoingReply) []linebot.SendingMessage {
+	messages := make([]linebot.SendingMessage, 0, len(replies))
+	for _, reply := range replies {
+		var message linebot.SendingMessage
+		switch {
+		case len(reply.Cards) > 0:
+			message = linebot.NewFlexMessage(reply.AltText, flexCards(reply.Cards))
+		case reply.ImageURL != "":
+			message = linebot.NewImageMessage(reply.ImageURL, reply.ImageURL)
+		default:
+			message = linebot.NewTextMessage(reply.Text)
+		}
+		if len(reply.QuickReplies) > 0 {
+			buttons := make([]*linebot.QuickReplyButton, 0, len(reply.QuickReplies))
+			for _, quickReply := range reply.QuickReplies {
+				buttons = append(buttons, linebot.NewQuickReplyButton("", linebot.NewMessageAction(quickReplyLabel(quickReply.Label), quickReply.Text)))
+			}
+			message = message.WithQuickReplies(linebot.NewQuickReplyItems(buttons...))
+		}
+		messages = append(messages, message)
+	}
+	return messages
+}
+
+// One card as a bubble, more as a carousel.
+func flexCards(cards []Card) linebot.FlexContainer {
+	if len(cards) == 1 {
+		return flexBubble(cards[0], "")
+	}
+	carousel := &linebot.CarouselContainer{Type: linebot.FlexContainerTypeCarousel}
+	for _, card := range cards {
+		// narrower bubbles in a carousel so the next one peeks in, and the
+		// narrowest for a card of buttons only, e.g. to the next page
+		size := linebot.FlexBubbleSizeTypeKilo
+		if card.Title == "" {
+			size = linebot.FlexBubbleSizeTypeMicro
+		}
+		carousel.Contents = append(carousel.Contents, flexBubble(card, size))
+	}
+	return carousel
+}
+
+const flexMutedColor = "#888888"
+
+func flexBubble(card Card, size linebot.FlexBubbleSizeType) *linebot.BubbleContainer {
+	bubble := &linebot.BubbleContainer{Type: linebot.FlexContainerTypeBubble, Size: size}
+	if card.ImageURL != "" {
+		bubble.Hero = &linebot.ImageComponent{
+			Type:        linebot.FlexComponentTypeImage,
+			URL:         card.ImageURL,
+			Size:        linebot.FlexImageSizeTypeFull,
+			AspectRatio: linebot.FlexImageAspectRatioType2to1,
+			AspectMode:  linebot.FlexImageAspectModeTypeFit,
+		}
+	}
+
+	var body []linebot.FlexComponent
+	if card.Label != "" {
+		body = append(body, &linebot.TextComponent{Type: linebot.FlexComponentTypeText, Text: card.Label, Size: linebot.FlexTextSizeTypeSm, Color: flexMutedColor})
+	}
+	if card.Title != "" {
+		body = append(body, &linebot.TextComponent{Type: linebot.FlexComponentTypeText, Text: card.Title, Size: linebot.FlexTextSizeTypeXl, Weight: linebot.FlexTextWeightTypeBold, Wrap: true})
+	}
+	if card.Subtitle != "" {
+		body = append(body, &linebot.TextComponent{Type: linebot.FlexComponentTypeText, Text: card.Subtitle, Size: linebot.FlexTextSizeTypeXs, Color: flexMutedColor})
+	}
+	for _, detail := range card.Details {
+		body = append(body, &linebot.TextComponent{Type: linebot.FlexComponentTypeText, Text: detail, Size: linebot.FlexTextSizeTypeSm, Color: flexMutedColor})
+	}
+	if card.Text != "" {
+		body = append(body, &linebot.TextComponent{Type: linebot.FlexComponentTypeText, Text: card.Text, Wrap: true})
+	}
+	for _, field := range card.Fields {
+		body = append(body, &linebot.BoxComponent{
+			Type:   linebot.FlexComponentTypeBox,
+			Layout: linebot.FlexBoxLayoutTypeHorizontal,
+			Contents: []linebot.FlexComponent{
+				&linebot.TextComponent{Type: linebot.FlexComponentTypeText, Text: field.Label, Color: flexMutedColor},
+				&linebot.TextComponent{Type: linebot.FlexComponentTypeText, Text: field.Value, Align: linebot.FlexComponentAlignTypeEnd, Weight: linebot.FlexTextWeightTypeBold},
+			},
+		})
+	}
+	if len(card.Tags) > 0 {
+		body = append(body, &linebot.TextComponent{Type: linebot.FlexComponentTypeText, Text: "#" + strings.Join(card.Tags, " #"), Size: linebot.FlexTextSizeTypeXs, Wrap: true})
+	}
+	if len(body) > 0 {
+		bubble.Body = &linebot.BoxComponent{
+			Type:     linebot.FlexComponentTypeBox,
+			Layout:   linebot.FlexBoxLayoutTypeVertical,
+			Spacing:  linebot.FlexComponentSpacingTypeSm,
+			Contents: body,
+		}
+	}
+
+	if len(card.Buttons) > 0 {
+		buttons := make([]linebot.FlexComponent, 0, len(card.Buttons))
+		for _, button := range card.Buttons {
+			component := &linebot.ButtonComponent{
+				Type:   linebot.FlexComponentTypeButton,
+				Height: linebot.FlexButtonHeightTypeSm,
+				Action: linebot.NewMessageAction(button.Label, button.Text),
+			}
+			if button.Primary {
+				component.Style = linebot.FlexButtonStyleTypePrimary
+			}
+			buttons = append(buttons, component)
+		}
+		bubble.Footer = &linebot.BoxComponent{
+			Type:     linebot.FlexComponentTypeBox,
+			Layout:   linebot.FlexBoxLayoutTypeHorizontal,
+			Spacing:  linebot.FlexComponentSpacingTypeSm,
+			Contents: buttons,
+		}
+	}
+	return bubble
+}
+
+// Users of the other platforms have their IDs prefixed, LINE's start with U.
+// Only LINE users can get a push from LINE.
+func isLineUser(userId string) bool {
+	return strings.HasPrefix(userId, "U")
+}
+
+func isGroupChat(source *linebot.EventSource) bool {
+	return source.Type == linebot.EventSourceTypeGroup || source.Type == linebot.EventSourceTypeRoom
+}
+
+// Where replies and pushes go: the group or room, or the user in a 1:1 chat.
+func chatID(source *linebot.EventSource) string {
+	switch source.Type {
+	case linebot.EventSourceTypeGroup:
+		return source.GroupID
+	case linebot.EventSourceTypeRoom:
+		return source.RoomID
+	}
+	return source.UserID
+}
+
+var (
+	botUserIDOnce sync.Once
+	botUser       string
+)
+
+func botUserID() string {
+	botUserIDOnce.Do(func() {
+		res, err := GetBot().Client.GetBotInfo().Do()
+		if err != nil {
+			slog.Error("Failed to get the bot info", "err", err)
+			return
+		}
+		botUser = res.UserID
+	})
+	return botUser
+}
+
+// Turn a text message event into an IncomingMessage. In a group the text is
+// addressed to the bot when it mentions the bot or starts with groupPrefix.
+func lineIncomingMessage(event *linebot.Event, message *linebot.TextMessage) *IncomingMessage {
+	msg := &IncomingMessage{
+		Platform:   "line",
+		UserID:     event.Source.UserID,
+		ChatID:     chatID(event.Source),
+		Group:      isGroupChat(event.Source),
+		Text:       message.Text,
+		ReplyToken: event.ReplyToken,
+	}
+	if msg.Group {
+		msg.Text, msg.Addressed = addressedText(message)
+	}
+	return msg
+}
+
+// Get the text addressed to the bot in a group, without the mention or the prefix.
+// It reports false when the message is for the other members.
+func addressedText(message *linebot.TextMessage) (string, bool) {
+	text := strings.TrimSpace(message.Text)
+	if strings.HasPrefix(text, groupPrefix) {
+		return strings.TrimSpace(strings.TrimPrefix(text, groupPrefix)), true
+	}
+	if message.Mention == nil {
+		return "", false
+	}
+	for _, mentionee := range message.Mention.Mentionees {
+		if mentionee.UserID == "" || mentionee.UserID != botUserID() {
+			continue
+		}
+		// the index and the length count UTF-16 code units
+		units := utf16.Encode([]rune(message.Text))
+		if mentionee.Index < 0 || mentionee.Index+mentionee.Length > len(units) {
+			return "", false
+		}
+		rest := append(append([]uint16{}, units[:mentionee.Index]...), units[mentionee.Index+mentionee.Length:]...)
+		return strings.TrimSpace(string(utf16.Decode(rest))), true
+	}
+	return "", false
+}
@@ -0,0 +1,3 @@
+// Package linetest stands in for LINE in tests and local tools, so that the
+// fakes aren't built into the bot.
+package linetest
@@ -0,0 +1,98 @@
+package linetest
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/di-th-hm-ms/AI-English/lib"
+	"github.com/line/line-bot-sdk-go/linebot"
+)
+
+var _ lib.RichMenuAPI = (*RichMenuAPI)(nil)
+
+// RichMenuAPI keeps menus in memory in place of LINE.
+type RichMenuAPI struct {
+	mu      sync.Mutex
+	Menus   map[string]*linebot.RichMenuResponse
+	Images  map[string][]byte
+	Default string
+	Links   map[string]string
+	Created int
+	nextID  int
+}
+
+func NewRichMenuAPI() *RichMenuAPI {
+	return &RichMenuAPI{
+		Menus:  make(map[string]*linebot.RichMenuResponse),
+		Images: make(map[string][]byte),
+		Links:  make(map[string]string),
+	}
+}
+
+func (f *RichMenuAPI) ListRichMenus() ([]*linebot.RichMenuResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	menus := make([]*linebot.RichMenuResponse, 0, len(f.Menus))
+	for _, menu := range f.Menus {
+		menus = append(menus, menu)
+	}
+	return menus, nil
+}
+
+func (f *RichMenuAPI) CreateRichMenu(menu linebot.RichMenu) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextID++
+	f.Created++
+	id := fmt.Sprintf("richmenu-%d", f.nextID)
+	f.Menus[id] = &linebot.RichMenuResponse{
+		RichMenuID:  id,
+		Size:        menu.Size,
+		Selected:    menu.Selected,
+		Name:        menu.Name,
+		ChatBarText: menu.ChatBarText,
+		Areas:       menu.Areas,
+	}
+	return id, nil
+}
+
+func (f *RichMenuAPI) UploadRichMenuImage(richMenuID string, img []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, exists := f.Menus[richMenuID]; !exists {
+		return fmt.Errorf("no rich menu %s", richMenuID)
+	}
+	f.Images[richMenuID] = img
+	return nil
+}
+
+func (f *RichMenuAPI) DeleteRichMenu(richMenuID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.Menus, richMenuID)
+	delete(f.Images, richMenuID)
+	// as on LINE, its users get the default menu
+	for userID, linked := range f.Links {
+		if linked == richMenuID {
+			delete(f.Links, userID)
+		}
+	}
+	return nil
+}
+
+func (f *RichMenuAPI) SetDefaultRichMenu(richMenuID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Default = richMenuID
+	return nil
+}
+
+func (f *RichMenuAPI) LinkUserRichMenu(userID string, richMenuID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, exists := f.Menus[richMenuID]; !exists {
+		return fmt.Errorf("no rich menu %s", richMenuID)
+	}
+	f.Links[userID] = richMenuID
+	return nil
+}
@@ -0,0 +1,344 @@
+package linetest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/di-th-hm-ms/AI-English/lib"
+)
+
+// Server stands in for the Messaging API in end-to-end tests. It answers
+// replies, pushes, message content, profiles and the OAuth endpoints, and
+// records every call it gets. Tokens it issues are valid until revoked.
+type Server struct {
+	URL    string
+	Secret string
+
+	server *httptest.Server
+	mu     sync.Mutex
+	calls  []Call
+	// content of messages by ID, for GetMessageContent
+	contents map[string][]byte
+	// display names by user ID, for the profile endpoints
+	names map[string]string
+	// the valid access tokens and their key IDs
+	tokens map[string]string
+	issued int
+	// calls to fail by path, see FailNext
+	failures map[string]outage
+	// what to do during the next call to a path, see OnNext
+	hooks map[string]func()
+}
+
+type outage struct {
+	left   int
+	status int
+}
+
+type Call struct {
+	Method string
+	Path   string
+	Body   []byte
+}
+
+// A reply or a push as the bot sent it.
+type Messages struct {
+	ReplyToken string                   `json:"replyToken"`
+	To         string                   `json:"to"`
+	Messages   []map[string]interface{} `json:"messages"`
+}
+
+const (
+	AccessToken = "fake-access-token"
+	BotUserID   = "Ufakebot"
+)
+
+func NewServer(secret string) *Server {
+	f := &Server{
+		Secret:   secret,
+		contents: make(map[string][]byte),
+		names:    make(map[string]string),
+		tokens:   map[string]string{AccessToken: "fake-key"},
+		failures: make(map[string]outage),
+		hooks:    make(map[string]func()),
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.handle))
+	f.URL = f.server.URL
+	return f
+}
+
+// Point the bot at the fake server.
+func (f *Server) Install() error {
+	lib.SetLineEndpoint(f.URL)
+	return lib.SetLineBot(f.Secret, AccessToken)
+}
+
+func (f *Server) Close() {
+	f.server.Close()
+}
+
+func (f *Server) SetMessageContent(messageId string, content []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.contents[messageId] = content
+}
+
+func (f *Server) SetDisplayName(userId string, name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.names[userId] = name
+}
+
+func (f *Server) handle(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	f.mu.Lock()
+	f.calls = append(f.calls, Call{Method: r.Method, Path: r.URL.Path, Body: body})
+	failure, failing := f.failures[r.URL.Path]
+	if failing {
+		if failure.left--; failure.left == 0 {
+			delete(f.failures, r.URL.Path)
+		} else {
+			f.failures[r.URL.Path] = failure
+		}
+	}
+	hook := f.hooks[r.URL.Path]
+	delete(f.hooks, r.URL.Path)
+	f.mu.Unlock()
+	if hook != nil {
+		hook()
+	}
+	if failing {
+		http.Error(w, `{"message":"The fake is failing"}`, failure.status)
+		return
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/oauth2/") {
+		f.handleOAuth(w, r, body)
+		return
+	}
+	if !f.ValidToken(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")) {
+		http.Error(w, `{"message":"Authentication failed"}`, http.StatusUnauthorized)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.URL.Path == "/v2/bot/info":
+		writeJSON(w, map[string]string{"userId": BotUserID, "displayName": "AI English"})
+	case len(parts) == 5 && parts[2] == "message" && parts[4] == "content":
+		f.mu.Lock()
+		content, exists := f.contents[parts[3]]
+		f.mu.Unlock()
+		if !exists {
+			http.Error(w, `{"message":"Not found"}`, http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", http.DetectContentType(content))
+		w.Write(content)
+	case len(parts) == 4 && parts[2] == "profile":
+		f.writeProfile(w, parts[3])
+	case len(parts) == 6 && (parts[2] == "group" || parts[2] == "room") && parts[4] == "member":
+		f.writeProfile(w, parts[5])
+	case r.URL.Path == "/v2/bot/richmenu/list":
+		writeJSON(w, map[string]interface{}{"richmenus": []interface{}{}})
+	default:
+		// replies, pushes and the rest only need to succeed
+		writeJSON(w, map[string]interface{}{})
+	}
+}
+
+func (f *Server) handleOAuth(w http.ResponseWriter, r *http.Request, body []byte) {
+	form, _ := url.ParseQuery(string(body))
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.URL.Path {
+	case "/oauth2/v2.1/verify":
+		if _, valid := f.tokens[r.URL.Query().Get("access_token")]; !valid {
+			http.Error(w, `{"error":"invalid_request","error_description":"access token expired"}`, http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, map[string]interface{}{"scope": "profile chat_message.write", "client_id": "1234567890", "expires_in": 2592000})
+	case "/oauth2/v2.1/token":
+		f.issued++
+		token, kid := fmt.Sprintf("%s-%d", AccessToken, f.issued), fmt.Sprintf("fake-key-%d", f.issued)
+		f.tokens[token] = kid
+		writeJSON(w, map[string]interface{}{
+			"access_token": token,
+			"expires_in":   2592000,
+			"token_type":   "Bearer",
+			"key_id":       kid,
+		})
+	case "/oauth2/v2.1/revoke":
+		// LINE answers 200 for tokens that are already invalid too
+		delete(f.tokens, form.Get("access_token"))
+		writeJSON(w, map[string]interface{}{})
+	case "/oauth2/v2.1/tokens/kid":
+		kids := []string{}
+		for _, kid := range f.tokens {
+			kids = append(kids, kid)
+		}
+		sort.Strings(kids)
+		writeJSON(w, map[string]interface{}{"kids": kids})
+	default:
+		http.Error(w, `{"error":"not_found"}`, http.StatusNotFound)
+	}
+}
+
+// Answer the next n calls to the path with the status, like an outage of LINE.
+func (f *Server) FailNext(path string, n int, status int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures[path] = outage{left: n, status: status}
+}
+
+// Run the function while the next call to the path is in flight, before it is
+// answered, e.g. to change what the bot is working on.
+func (f *Server) OnNext(path string, hook func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.hooks[path] = hook
+}
+
+// Whether the token was issued and not revoked. AccessToken is valid from the start.
+func (f *Server) ValidToken(token string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, valid := f.tokens[token]
+	return valid
+}
+
+func (f *Server) writeProfile(w http.ResponseWriter, userId string) {
+	f.mu.Lock()
+	name, exists := f.names[userId]
+	f.mu.Unlock()
+	if !exists {
+		name = "User " + userId
+	}
+	writeJSON(w, map[string]string{"userId": userId, "displayName": name, "language": "ja"})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// Every call so far, in order.
+func (f *Server) Calls() []Call {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Call(nil), f.calls...)
+}
+
+func (f *Server) messages(path string) []Messages {
+	var sent []Messages
+	for _, call := range f.Calls() {
+		if call.Method != http.MethodPost || call.Path != path {
+			continue
+		}
+		var messages Messages
+		if err := json.Unmarshal(call.Body, &messages); err == nil {
+			sent = append(sent, messages)
+		}
+	}
+	return sent
+}
+
+func (f *Server) Replies() []Messages {
+	return f.messages("/v2/bot/message/reply")
+}
+
+func (f *Server) Pushes() []Messages {
+	return f.messages("/v2/bot/message/push")
+}
+
+// Wait until the bot replied n times. Events are handled by the workers,
+// so replies come after the webhook has returned.
+func (f *Server) WaitForReplies(n int, timeout time.Duration) ([]Messages, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		replies := f.Replies()
+		if len(replies) >= n {
+			return replies, nil
+		}
+		if time.Now().After(deadline) {
+			return replies, fmt.Errorf("got %d replies, want %d", len(replies), n)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// Build a signed webhook request for the events.
+func NewWebhookRequest(secret string, events ...map[string]interface{}) (*http.Request, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"destination": BotUserID,
+		"events":      events,
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, "/callback", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Line-Signature", lib.SignWebhook(secret, body))
+	return req, nil
+}
+
+// A text message from a user in a 1:1 chat, as in a webhook.
+func TextMessageEvent(userId string, replyToken string, text string) map[string]interface{} {
+	return map[string]interface{}{
+		"type":       "message",
+		"mode":       "active",
+		"timestamp":  time.Now().UnixMilli(),
+		"replyToken": replyToken,
+		"source":     map[string]string{"type": "user", "userId": userId},
+		"message":    map[string]string{"type": "text", "id": replyToken + "-message", "text": text},
+	}
+}
+
+// A text message from a member of a group, as in a webhook.
+func GroupTextMessageEvent(groupId string, userId string, replyToken string, text string) map[string]interface{} {
+	event := TextMessageEvent(userId, replyToken, text)
+	event["source"] = map[string]string{"type": "group", "groupId": groupId, "userId": userId}
+	return event
+}
+
+// The name the bot is mentioned by in a group.
+const BotMention = "@AI English"
+
+// A text message from a member of a group that starts by mentioning the bot.
+func MentionEvent(groupId string, userId string, replyToken string, text string) map[string]interface{} {
+	event := GroupTextMessageEvent(groupId, userId, replyToken, BotMention+" "+text)
+	event["message"] = map[string]interface{}{
+		"type": "text",
+		"id":   replyToken + "-message",
+		"text": BotMention + " " + text,
+		"mention": map[string]interface{}{
+			"mentionees": []map[string]interface{}{
+				{"index": 0, "length": len(BotMention), "userId": BotUserID},
+			},
+		},
+	}
+	return event
+}
+
+// A follow of a new friend, as in a webhook.
+func FollowEvent(userId string, replyToken string) map[string]interface{} {
+	return map[string]interface{}{
+		"type":       "follow",
+		"mode":       "active",
+		"timestamp":  time.Now().UnixMilli(),
+		"replyToken": replyToken,
+		"source":     map[string]string{"type": "user", "userId": userId},
+	}
+}
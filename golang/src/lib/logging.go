@@ -0,0 +1,94 @@
+package lib
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+// Logs are structured with slog. SetupLogging writes them as JSON, or as text
+// for reading in a terminal, and every message and attribute goes through
+// redaction first, so a token or a presigned URL never reaches the logs.
+func SetupLogging(w io.Writer, format string, level string) {
+	var minLevel slog.Level
+	if err := minLevel.UnmarshalText([]byte(level)); err != nil {
+		minLevel = slog.LevelInfo
+	}
+	options := &slog.HandlerOptions{Level: minLevel, ReplaceAttr: redactAttr}
+
+	var handler slog.Handler
+	if format == "text" {
+		handler = slog.NewTextHandler(w, options)
+	} else {
+		handler = slog.NewJSONHandler(w, options)
+	}
+	// this also sends what is still logged with the log package through the handler
+	slog.SetDefault(slog.New(handler))
+}
+
+// Attributes with these in their name are never logged.
+var secretKeys = []string{"token", "secret", "password", "authorization", "apikey", "api_key", "credential", "private"}
+
+var secretPatterns = []struct {
+	pattern     *regexp.Regexp
+	replacement string
+}{
+	// JWTs, like the assertion for the channel access token
+	{regexp.MustCompile(`eyJ[\w-]+\.[\w-]+\.[\w-]*`), "[REDACTED]"},
+	{regexp.MustCompile(`(?i)bearer\s+[\w.~+/=-]+`), "Bearer [REDACTED]"},
+	// the signature and the credentials in presigned URLs
+	{regexp.MustCompile(`(X-Amz-(?:Signature|Credential|Security-Token))=[^&\s"]+`), "$1=[REDACTED]"},
+	{regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`), "[REDACTED]"},
+	// openai keys
+	{regexp.MustCompile(`\bsk-[\w-]{20,}`), "[REDACTED]"},
+	{regexp.MustCompile(`(?i)(access_token|client_assertion)=[^&\s"]+`), "$1=[REDACTED]"},
+}
+
+func redactSecrets(s string) string {
+	for _, p := range secretPatterns {
+		s = p.pattern.ReplaceAllString(s, p.replacement)
+	}
+	return s
+}
+
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	key := strings.ToLower(a.Key)
+	for _, secret := range secretKeys {
+		if strings.Contains(key, secret) {
+			return slog.String(a.Key, "[REDACTED]")
+		}
+	}
+	switch a.Value.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, redactSecrets(a.Value.String()))
+	case slog.KindAny:
+		if err, isError := a.Value.Any().(error); isError {
+			return slog.String(a.Key, redactSecrets(err.Error()))
+		}
+	}
+	return a
+}
+
+// Users are told apart in the logs without their IDs.
+func UserHash(userId string) string {
+	if userId == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(userId))
+	return hex.EncodeToString(sum[:6])
+}
+
+func NewRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// The logger of a message, with what ties its lines together.
+func (msg *IncomingMessage) Logger() *slog.Logger {
+	return slog.With("request_id", msg.RequestID, "user", UserHash(msg.UserID), "platform", msg.Platform)
+}
@@ -0,0 +1,125 @@
+package lib
+
+import (
+	"context"
+	"strings"
+)
+
+// The learning logic only sees IncomingMessage and answers with OutgoingReply
+// through a Messenger, so a chat platform is added by writing its adapter.
+// LINE is the first one, the console is for trying the bot locally.
+
+type IncomingMessage struct {
+	Platform string
+	// The sender. Adapters other than LINE prefix it with the platform so
+	// that users of different platforms never share a notebook.
+	UserID string
+	// Where the replies go: the user, or the group the message was sent in
+	ChatID string
+	Group  bool
+	// In a group, whether the message was for the bot. Text has the mention
+	// or the prefix taken off.
+	Addressed bool
+	Text      string
+	// What the platform needs to answer this message, e.g. LINE's reply token
+	ReplyToken string
+	// Ties the log lines of this message together, see Logger
+	RequestID string
+	// Carries the trace of the event, see Context
+	ctx context.Context
+}
+
+// The context of the message, for the calls made to answer it.
+func (msg *IncomingMessage) Context() context.Context {
+	if msg.ctx == nil {
+		return context.Background()
+	}
+	return msg.ctx
+}
+
+type QuickReply struct {
+	Label string
+	Text  string
+}
+
+// LINE takes quick reply labels of up to this many characters.
+const quickReplyLabelLimit = 20
+
+// Shorten the label to fit a quick reply, ending it with "…".
+func quickReplyLabel(label string) string {
+	runes := []rune(label)
+	if len(runes) <= quickReplyLabelLimit {
+		return label
+	}
+	return strings.TrimRight(string(runes[:quickReplyLabelLimit-1]), " ") + "…"
+}
+
+// A card of a word, a report and the like. Each platform lays it out its
+// own way, LINE as a Flex bubble. Every field but the title is optional.
+type Card struct {
+	// Small text above the title, e.g. what the card is
+	Label    string
+	Title    string
+	Subtitle string
+	ImageURL string
+	// Small lines under the title, e.g. when the word was first seen
+	Details []string
+	Text    string
+	// Figures shown as a label and a value on a row
+	Fields []CardField
+	Tags   []string
+	// Texts the user can send by tapping, as with QuickReply
+	Buttons []CardButton
+}
+
+type CardField struct {
+	Label string
+	Value string
+}
+
+type CardButton struct {
+	Label string
+	Text  string
+	// The main action of the card
+	Primary bool
+}
+
+// One message to send. Set one of Text, ImageURL or Cards.
+type OutgoingReply struct {
+	Text     string
+	ImageURL string
+	// One card, or a list to scroll through. AltText says what they are
+	// where they can't be shown, e.g. in notifications.
+	Cards   []Card
+	AltText string
+	// Suggested answers the user can tap
+	QuickReplies []QuickReply
+}
+
+func TextReply(text string) OutgoingReply {
+	return OutgoingReply{Text: text}
+}
+
+func ImageReply(url string) OutgoingReply {
+	return OutgoingReply{ImageURL: url}
+}
+
+func CardReply(altText string, cards ...Card) OutgoingReply {
+	return OutgoingReply{AltText: altText, Cards: cards}
+}
+
+func (r OutgoingReply) WithQuickReplies(quickReplies ...QuickReply) OutgoingReply {
+	r.QuickReplies = quickReplies
+	return r
+}
+
+// Messenger sends replies on one chat platform.
+type Messenger interface {
+	Platform() string
+	// Answer the message. Replies may only be allowed once per message.
+	Reply(msg *IncomingMessage, replies ...OutgoingReply) error
+	// Send to a user or a group without a message to answer.
+	Push(chatID string, replies ...OutgoingReply) error
+	// The name of the sender as the chat shows it.
+	SenderName(msg *IncomingMessage) (string, error)
+}
@@ -0,0 +1,236 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Prometheus metrics of the bot, served on /metrics. Calls to the services
+// the bot depends on are labelled with the dependency (openai, s3, line,
+// pexels or scraper), so that an alert on one doesn't fire for another.
+const metricsNamespace = "aienglish"
+
+var (
+	webhookRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "webhook_requests_total",
+		Help:      "Webhook requests from LINE by response status.",
+	}, []string{"status"})
+
+	queueWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "queue_wait_seconds",
+		Help:      "Time requests waited in the queue before a worker took them.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"kind"})
+
+	busyWorkers = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "workers_busy",
+		Help:      "Workers handling a request right now.",
+	})
+
+	dependencyDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "dependency_request_duration_seconds",
+		Help:      "Latency of calls to the services the bot depends on.",
+		// openai can take tens of seconds
+		Buckets: []float64{0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 40},
+	}, []string{"dependency", "operation"})
+
+	dependencyErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "dependency_errors_total",
+		Help:      "Failed calls to the services the bot depends on, by reason (network, 4xx or 5xx).",
+	}, []string{"dependency", "operation", "reason"})
+
+	explanationCache = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "explanation_cache_lookups_total",
+		Help:      "Lookups answered with a saved explanation (hit) or by asking openai (miss).",
+	}, []string{"result"})
+
+	quotaRejections = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "quota_rejections_total",
+		Help:      "Lookups refused because the user reached the daily limit.",
+	})
+
+	openaiTokens = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "openai_tokens_total",
+		Help:      "Tokens used by openai, by type (prompt or completion).",
+	}, []string{"type"})
+
+	unknownChannelTokens = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "unknown_channel_tokens",
+		Help:      "Valid channel access tokens the bot didn't issue, which may have leaked.",
+	})
+)
+
+func init() {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "queue_depth",
+		Help:      "Requests waiting in the queue for a worker.",
+	}, func() float64 {
+		return float64(len(requestQueue))
+	})
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "queue_capacity",
+		Help:      "Requests the queue holds before the webhook blocks.",
+	}, func() float64 {
+		return float64(cap(requestQueue))
+	})
+}
+
+// Record a call to a dependency that started at start. It failed when err
+// isn't nil or the status is 400 or over; status is 0 when there's none.
+func observeDependency(dependency string, operation string, start time.Time, status int, err error) {
+	dependencyDuration.WithLabelValues(dependency, operation).Observe(time.Since(start).Seconds())
+	switch {
+	case err != nil:
+		dependencyErrors.WithLabelValues(dependency, operation, "network").Inc()
+	case status >= 500:
+		dependencyErrors.WithLabelValues(dependency, operation, "5xx").Inc()
+	case status >= 400:
+		dependencyErrors.WithLabelValues(dependency, operation, "4xx").Inc()
+	}
+}
+
+// An http.Client that records its calls as the dependency, in the metrics
+// and as spans. The operation is named from the path when operation is nil.
+func dependencyClient(dependency string, operation func(*http.Request) string) *http.Client {
+	if operation == nil {
+		operation = pathOperation
+	}
+	traced := otelhttp.NewTransport(restoreQuery{http.DefaultTransport},
+		otelhttp.WithTracerProvider(libTracerProvider{}),
+		otelhttp.WithSpanNameFormatter(func(_ string, req *http.Request) string {
+			return dependency + " " + operation(req)
+		}))
+	return &http.Client{Transport: &metricsTransport{
+		dependency: dependency,
+		operation:  operation,
+		next:       stripQuery{traced},
+	}}
+}
+
+// otelhttp puts the URL of a request on its span, and queries hold access
+// tokens and assertions. The query is taken off before otelhttp sees the
+// request and put back after.
+type queryContextKey struct{}
+
+type stripQuery struct {
+	next http.RoundTripper
+}
+
+func (t stripQuery) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.RawQuery == "" {
+		return t.next.RoundTrip(req)
+	}
+	stripped := req.Clone(context.WithValue(req.Context(), queryContextKey{}, req.URL.RawQuery))
+	stripped.URL.RawQuery = ""
+	res, err := t.next.RoundTrip(stripped)
+	if res != nil {
+		res.Request = req
+	}
+	return res, err
+}
+
+type restoreQuery struct {
+	next http.RoundTripper
+}
+
+func (t restoreQuery) RoundTrip(req *http.Request) (*http.Response, error) {
+	if query, ok := req.Context().Value(queryContextKey{}).(string); ok {
+		req = req.Clone(req.Context())
+		req.URL.RawQuery = query
+	}
+	return t.next.RoundTrip(req)
+}
+
+type metricsTransport struct {
+	dependency string
+	operation  func(*http.Request) string
+	next       http.RoundTripper
+}
+
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	res, err := t.next.RoundTrip(req)
+	status := 0
+	if res != nil {
+		status = res.StatusCode
+	}
+	observeDependency(t.dependency, t.operation(req), start, status, err)
+	return res, err
+}
+
+// Path segments in lower case are names, anything else (user, group, message
+// and rich menu IDs) is replaced, so the operations stay few.
+var pathName = regexp.MustCompile(`^[a-z][a-z0-9.]*$`)
+
+func pathOperation(req *http.Request) string {
+	segments := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	for i, segment := range segments {
+		if !pathName.MatchString(segment) {
+			segments[i] = ":id"
+		}
+	}
+	return strings.TrimPrefix(strings.Join(segments, "/"), "v2/bot/")
+}
+
+// Every call to the same dependency as one operation, e.g. images from anywhere on the web.
+func fixedOperation(name string) func(*http.Request) string {
+	return func(*http.Request) string {
+		return name
+	}
+}
+
+// Record the calls of an S3 client, in the metrics and as spans.
+// A missing object is an answer, not a failure.
+func instrumentS3(client *s3.S3) {
+	client.Handlers.Complete.PushBack(func(r *request.Request) {
+		status := 0
+		if r.HTTPResponse != nil {
+			status = r.HTTPResponse.StatusCode
+		}
+		err := r.Error
+		if status == http.StatusNotFound {
+			status, err = http.StatusOK, nil
+		} else if status != 0 {
+			// the status tells the reason
+			err = nil
+		}
+		observeDependency("s3", r.Operation.Name, r.Time, status, err)
+
+		_, span := tracer.Start(r.Context(), "s3 "+r.Operation.Name,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithTimestamp(r.Time),
+			trace.WithAttributes(attribute.Int("http.status_code", status)))
+		if status >= 400 {
+			err = fmt.Errorf("s3 returned %d", status)
+		}
+		endSpan(span, err)
+	})
+}
+
+func observeWebhook(status int) {
+	webhookRequests.WithLabelValues(strconv.Itoa(status)).Inc()
+}
@@ -0,0 +1,162 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Until the keys were encoded, the notebook entries, explanations and pictures
+// were stored under the text of the word, and before the notebook a lookup was
+// only recorded under users/<userId>/messages/. MigrateStorageKeys moves them
+// all to their textKeys; cmd/migratekeys runs it once against the bucket.
+
+type KeyMigration struct {
+	Moved int
+	// Already under a textKey
+	Skipped int
+	Failed  int
+}
+
+// Where the objects of a user that are named after words live, and where they go.
+var wordKeyedObjects = []struct {
+	prefix      func(userId string) string
+	suffix      string
+	key         func(userId string, word string) string
+	read        func(object *s3.Object, word string) ([]byte, error)
+	contentType func(data []byte) string
+}{
+	// first, so the entries of the words looked up again are merged into
+	{legacyVocabularyPrefix, "", vocabularyKey, readLegacyVocabEntry, jsonContentType},
+	{vocabularyPrefix, ".json", vocabularyKey, readObject, jsonContentType},
+	{explanationPrefix, "", explanationKey, readObject, func([]byte) string { return "text/plain" }},
+	{imagePrefix, "", imageKey, readObject, http.DetectContentType},
+}
+
+func readObject(object *s3.Object, word string) ([]byte, error) {
+	return store.Get(aws.StringValue(object.Key))
+}
+
+// The lookup recorded under the word as an entry of the notebook.
+func readLegacyVocabEntry(object *s3.Object, word string) ([]byte, error) {
+	return json.Marshal(legacyVocabEntry(word, aws.TimeValue(object.LastModified)))
+}
+
+func jsonContentType([]byte) string {
+	return "application/json"
+}
+
+// Move every object still named after its word. With dryRun nothing changes
+// and report only tells what would move. Objects under a textKey are skipped,
+// so it can run again after a failure or while the bot writes the new layout.
+func MigrateStorageKeys(ctx context.Context, dryRun bool, report func(from string, to string)) (KeyMigration, error) {
+	var result KeyMigration
+	users, err := ListUserIDs()
+	if err != nil {
+		return result, err
+	}
+	// explanations may be left for users without a notebook
+	botUsers, err := store.ListPrefixes("bots/users/")
+	if err != nil {
+		return result, err
+	}
+	for _, userId := range botUsers {
+		if !containsString(users, userId) {
+			users = append(users, userId)
+		}
+	}
+
+	for _, userId := range users {
+		for _, objects := range wordKeyedObjects {
+			if ctx.Err() != nil {
+				return result, ctx.Err()
+			}
+			prefix := objects.prefix(userId)
+			listed, err := ListObjects(prefix)
+			if err != nil {
+				return result, err
+			}
+			// oldest first, so the new LastModified keep the order of the notebook
+			sort.SliceStable(listed, func(i, j int) bool {
+				return aws.TimeValue(listed[i].LastModified).Before(aws.TimeValue(listed[j].LastModified))
+			})
+			for _, object := range listed {
+				from := aws.StringValue(object.Key)
+				word := strings.TrimSuffix(strings.TrimPrefix(from, prefix), objects.suffix)
+				if isTextKey(word) {
+					result.Skipped++
+					continue
+				}
+				to := objects.key(userId, word)
+				report(from, to)
+				if dryRun {
+					result.Moved++
+					continue
+				}
+				data, err := objects.read(object, word)
+				if err == nil {
+					err = moveObject(from, to, data, objects.contentType(data))
+				}
+				if err != nil {
+					slog.Error("Failed to move an object to its new key", "key", from, "err", err)
+					result.Failed++
+					continue
+				}
+				result.Moved++
+			}
+		}
+	}
+	return result, nil
+}
+
+// Write the object under the new key and delete the old one. A notebook entry
+// written under the new key in the meantime is merged with the old one;
+// anything else already there is newer and kept.
+func moveObject(from string, to string, data []byte, contentType string) error {
+	var err error
+	if store.Exists(to) {
+		if !strings.HasSuffix(to, ".json") {
+			return store.Delete(from)
+		}
+		if data, err = mergeVocabEntries(data, to); err != nil {
+			return err
+		}
+	}
+	if err = store.Put(to, data, contentType); err != nil {
+		return err
+	}
+	return store.Delete(from)
+}
+
+func mergeVocabEntries(data []byte, key string) ([]byte, error) {
+	var old VocabEntry
+	if err := json.Unmarshal(data, &old); err != nil {
+		return nil, err
+	}
+	entry, exists := getVocabEntry(key)
+	if !exists {
+		return data, nil
+	}
+	if !old.FirstSeen.IsZero() && (entry.FirstSeen.IsZero() || old.FirstSeen.Before(entry.FirstSeen)) {
+		entry.FirstSeen = old.FirstSeen
+	}
+	if old.LastSeen.After(entry.LastSeen) {
+		entry.LastSeen = old.LastSeen
+	}
+	entry.LookupCount += old.LookupCount
+	for _, tag := range old.Tags {
+		if !containsString(entry.Tags, tag) {
+			entry.Tags = append(entry.Tags, tag)
+		}
+	}
+	if old.Mastery > entry.Mastery {
+		entry.Mastery = old.Mastery
+	}
+	return json.Marshal(entry)
+}
@@ -0,0 +1,123 @@
+package lib
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A carousel holds up to 12 bubbles, one is kept for the "next page" bubble.
+const notebookPageSize = 10
+
+// Handle the chat commands for the vocabulary notebook:
+//
+//	notebook [page]
+//	notebook search <word> [page]
+//	forget <word>
+//
+// It reports whether the text was a command, so that it is not looked up as a word.
+func handleNotebookCommand(m Messenger, msg *IncomingMessage) bool {
+	fields := strings.Fields(strings.ToLower(msg.Text))
+	if len(fields) == 0 {
+		return false
+	}
+
+	switch fields[0] {
+	case "notebook":
+		args := fields[1:]
+		page := 1
+		if len(args) > 0 {
+			if n, err := strconv.Atoi(args[len(args)-1]); err == nil {
+				page = n
+				args = args[:len(args)-1]
+			}
+		}
+		query := ""
+		if len(args) > 0 {
+			if args[0] != "search" || len(args) == 1 {
+				return false
+			}
+			query = strings.Join(args[1:], " ")
+		}
+		replyNotebook(m, msg, query, page)
+		return true
+
+	case "forget":
+		if len(fields) == 1 {
+			return false
+		}
+		word := strings.Join(fields[1:], " ")
+		reply := fmt.Sprintf("Removed \"%s\" from your notebook.", word)
+		if err := DeleteVocabEntry(msg.UserID, word); err != nil {
+			msg.Logger().Error("failed to forget a word", "err", err)
+			reply = fmt.Sprintf("\"%s\" isn't in your notebook.", word)
+		}
+		if err := m.Reply(msg, TextReply(reply)); err != nil {
+			msg.Logger().Error("Failed to reply to forget", "err", err)
+		}
+		return true
+	}
+	return false
+}
+
+func replyNotebook(m Messenger, msg *IncomingMessage, query string, page int) {
+	result, err := ListVocabulary(msg.UserID, query, page, notebookPageSize)
+	if err != nil {
+		msg.Logger().Error("failed to list the notebook", "err", err)
+		if err = m.Reply(msg, TextReply("Sorry, we're under maintenance. Try it later.")); err != nil {
+			msg.Logger().Error("Failed to reply about a notebook error", "err", err)
+		}
+		return
+	}
+
+	var message OutgoingReply
+	if len(result.Entries) == 0 {
+		switch {
+		case query != "":
+			message = TextReply(fmt.Sprintf("No words matching \"%s\" in your notebook.", query))
+		case result.Page > 1:
+			message = TextReply("There are no more words in your notebook.")
+		default:
+			message = TextReply("Your notebook is empty. Send me a word to look it up!")
+		}
+	} else {
+		message = CardReply("Your vocabulary notebook", notebookCards(result, query)...)
+	}
+
+	if err = m.Reply(msg, message); err != nil {
+		msg.Logger().Error("Failed to reply the notebook", "err", err)
+	}
+}
+
+func notebookCards(result *VocabPage, query string) []Card {
+	cards := make([]Card, 0, len(result.Entries)+1)
+	for _, entry := range result.Entries {
+		cards = append(cards, vocabCard(entry))
+	}
+
+	if result.HasNext {
+		command := "notebook"
+		if query != "" {
+			command += " search " + query
+		}
+		command += " " + strconv.Itoa(result.Page+1)
+		cards = append(cards, Card{Buttons: []CardButton{{Label: "Next page", Text: command}}})
+	}
+	return cards
+}
+
+func vocabCard(entry *VocabEntry) Card {
+	return Card{
+		Title: entry.Word,
+		Details: []string{
+			fmt.Sprintf("Looked up %d times", entry.LookupCount),
+			"First seen " + entry.FirstSeen.Format("2006-01-02"),
+		},
+		Fields: []CardField{{Label: "Mastery", Value: strings.Repeat("★", entry.Mastery) + strings.Repeat("☆", MasteryMax-entry.Mastery)}},
+		Tags:   entry.Tags,
+		Buttons: []CardButton{
+			{Label: "Review", Text: entry.Word, Primary: true},
+			{Label: "Forget", Text: "forget " + entry.Word},
+		},
+	}
+}
@@ -0,0 +1,262 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// ObjectStore keeps everything the bot stores: notebooks, explanations,
+// images, profiles. It is the S3 bucket unless SetObjectStore changes it,
+// e.g. to a directory for the console.
+type ObjectStore interface {
+	Get(key string) ([]byte, error)
+	Put(key string, data []byte, contentType string) error
+	Delete(key string) error
+	DeleteKeys(keys []string) error
+	Exists(key string) bool
+	// Every object under the prefix, with its key, size and last modified time
+	List(prefix string) ([]*s3.Object, error)
+	// The names of the "directories" right under the prefix
+	ListPrefixes(prefix string) ([]string, error)
+	// A URL the chat platform can fetch the object from
+	URL(key string) (string, error)
+}
+
+var store ObjectStore = s3Store{}
+
+func SetObjectStore(s ObjectStore) {
+	store = s
+}
+
+var errNoSuchKey = errors.New("no such key")
+
+// Objects kept in memory, for tests.
+type memoryStore struct {
+	mu      sync.Mutex
+	objects map[string]memoryObject
+}
+
+type memoryObject struct {
+	data     []byte
+	modified time.Time
+}
+
+func NewMemoryStore() ObjectStore {
+	return &memoryStore{objects: make(map[string]memoryObject)}
+}
+
+func (m *memoryStore) Get(key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	object, exists := m.objects[key]
+	if !exists {
+		return nil, errNoSuchKey
+	}
+	return append([]byte(nil), object.data...), nil
+}
+
+func (m *memoryStore) Put(key string, data []byte, contentType string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[key] = memoryObject{data: append([]byte(nil), data...), modified: time.Now()}
+	return nil
+}
+
+func (m *memoryStore) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.objects, key)
+	return nil
+}
+
+func (m *memoryStore) DeleteKeys(keys []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, key := range keys {
+		delete(m.objects, key)
+	}
+	return nil
+}
+
+func (m *memoryStore) Exists(key string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, exists := m.objects[key]
+	return exists
+}
+
+func (m *memoryStore) List(prefix string) ([]*s3.Object, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var objects []*s3.Object
+	for key, object := range m.objects {
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, storedObject(key, int64(len(object.data)), object.modified))
+		}
+	}
+	sortObjects(objects)
+	return objects, nil
+}
+
+func (m *memoryStore) ListPrefixes(prefix string) ([]string, error) {
+	objects, _ := m.List(prefix)
+	return commonPrefixes(objects, prefix), nil
+}
+
+func (m *memoryStore) URL(key string) (string, error) {
+	return "memory://" + key, nil
+}
+
+// Objects kept as files under a directory, for running the bot locally.
+type dirStore struct {
+	root string
+}
+
+func NewDirStore(root string) (ObjectStore, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(root, 0o755); err != nil {
+		return nil, err
+	}
+	return dirStore{root: root}, nil
+}
+
+// The file of the key. Keys are names in S3, so one like "a/../b" must not
+// reach outside the directory.
+func (d dirStore) path(key string) (string, error) {
+	path := filepath.Join(d.root, filepath.FromSlash(key))
+	if !strings.HasPrefix(path, d.root+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+	return path, nil
+}
+
+func (d dirStore) Get(key string) ([]byte, error) {
+	path, err := d.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(path)
+}
+
+func (d dirStore) Put(key string, data []byte, contentType string) error {
+	path, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+func (d dirStore) Delete(key string) error {
+	path, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (d dirStore) DeleteKeys(keys []string) error {
+	for _, key := range keys {
+		if err := d.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d dirStore) Exists(key string) bool {
+	path, err := d.path(key)
+	if err != nil {
+		return false
+	}
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir()
+}
+
+func (d dirStore) List(prefix string) ([]*s3.Object, error) {
+	var objects []*s3.Object
+	err := filepath.WalkDir(d.root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(d.root, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, storedObject(key, info.Size(), info.ModTime()))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortObjects(objects)
+	return objects, nil
+}
+
+func (d dirStore) ListPrefixes(prefix string) ([]string, error) {
+	objects, err := d.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	return commonPrefixes(objects, prefix), nil
+}
+
+func (d dirStore) URL(key string) (string, error) {
+	path, err := d.path(key)
+	if err != nil {
+		return "", err
+	}
+	return "file://" + filepath.ToSlash(path), nil
+}
+
+func storedObject(key string, size int64, modified time.Time) *s3.Object {
+	return &s3.Object{Key: aws.String(key), Size: aws.Int64(size), LastModified: aws.Time(modified)}
+}
+
+// In key order, as S3 lists them
+func sortObjects(objects []*s3.Object) {
+	sort.Slice(objects, func(i, j int) bool {
+		return aws.StringValue(objects[i].Key) < aws.StringValue(objects[j].Key)
+	})
+}
+
+func commonPrefixes(objects []*s3.Object, prefix string) []string {
+	var names []string
+	for _, object := range objects {
+		rest := strings.TrimPrefix(aws.StringValue(object.Key), prefix)
+		i := strings.Index(rest, "/")
+		if i < 0 {
+			continue
+		}
+		if name := rest[:i]; len(names) == 0 || names[len(names)-1] != name {
+			names = append(names, name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,154 @@
+package lib
+
+import (
+	"strings"
+	"time"
+)
+
+// One question of the onboarding conversation.
+type onboardingStep struct {
+	name     string
+	question string
+	choices  []string
+	// Store the answer, reporting whether it was acceptable
+	apply func(profile *UserProfile, answer string) bool
+}
+
+var (
+	cefrLevels      = []string{"A1", "A2", "B1", "B2", "C1", "C2"}
+	learningGoals   = []string{"Travel", "Business", "Exams", "Daily conversation"}
+	nativeLanguages = []string{"ja", "ko", "th", "zh", "es", "other"}
+)
+
+// The choice the answer is, ignoring case, so "business" is stored as "Business".
+func matchChoice(choices []string, answer string) (string, bool) {
+	for _, choice := range choices {
+		if strings.EqualFold(choice, answer) {
+			return choice, true
+		}
+	}
+	return "", false
+}
+
+var onboardingSteps = []onboardingStep{
+	{
+		name:     "level",
+		question: "What's your English level?",
+		choices:  cefrLevels,
+		apply: func(profile *UserProfile, answer string) bool {
+			level := strings.ToUpper(answer)
+			if !containsString(cefrLevels, level) {
+				return false
+			}
+			profile.Level = level
+			return true
+		},
+	},
+	{
+		name:     "goals",
+		question: "What do you want English for?",
+		choices:  learningGoals,
+		apply: func(profile *UserProfile, answer string) bool {
+			goal, ok := matchChoice(learningGoals, answer)
+			if !ok {
+				return false
+			}
+			profile.Goals = goal
+			return true
+		},
+	},
+	{
+		name:     "timezone",
+		question: "Which timezone are you in? Pick one or type it like Europe/London.",
+		choices:  []string{"Asia/Tokyo", "Asia/Seoul", "Asia/Bangkok", "Europe/London", "America/New_York"},
+		apply: func(profile *UserProfile, answer string) bool {
+			if _, err := time.LoadLocation(answer); err != nil || answer == "" {
+				return false
+			}
+			profile.Timezone = answer
+			return true
+		},
+	},
+	{
+		name:     "language",
+		question: "What's your native language?",
+		choices:  nativeLanguages,
+		apply: func(profile *UserProfile, answer string) bool {
+			language, ok := matchChoice(nativeLanguages, answer)
+			if !ok {
+				return false
+			}
+			profile.NativeLanguage = language
+			return true
+		},
+	},
+}
+
+func onboardingStepIndex(name string) int {
+	for i, step := range onboardingSteps {
+		if step.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Ask the question with its choices as quick replies. The prefix lets the
+// settings command reuse the questions, e.g. "settings level B1".
+func onboardingQuestion(step onboardingStep, prefix string) OutgoingReply {
+	quickReplies := make([]QuickReply, 0, len(step.choices)+1)
+	for _, choice := range step.choices {
+		quickReplies = append(quickReplies, QuickReply{Label: choice, Text: prefix + choice})
+	}
+	if prefix == "" {
+		quickReplies = append(quickReplies, QuickReply{Label: "Skip", Text: "skip"})
+	}
+	return TextReply(step.question).WithQuickReplies(quickReplies...)
+}
+
+// Take the answer to the pending onboarding question and ask the next one.
+// It reports whether the user was onboarding, so the answer isn't looked up as a word.
+func handleOnboardingAnswer(m Messenger, msg *IncomingMessage) bool {
+	var reply OutgoingReply
+	onboarding := false
+	profile, err := UpdateProfile(msg.UserID, func(profile *UserProfile, exists bool) bool {
+		if !exists || profile.OnboardingStep == "" {
+			return false
+		}
+		i := onboardingStepIndex(profile.OnboardingStep)
+		if i < 0 {
+			return false
+		}
+		onboarding = true
+
+		answer := strings.TrimSpace(msg.Text)
+		switch {
+		case strings.EqualFold(answer, "skip"):
+			profile.OnboardingStep = ""
+			reply = TextReply("No problem. Send \"settings\" any time to fill it in later.")
+		case !onboardingSteps[i].apply(profile, answer):
+			reply = onboardingQuestion(onboardingSteps[i], "")
+		case i+1 < len(onboardingSteps):
+			profile.OnboardingStep = onboardingSteps[i+1].name
+			reply = onboardingQuestion(onboardingSteps[i+1], "")
+		default:
+			profile.OnboardingStep = ""
+			reply = TextReply("You're all set! Send me a word to look it up, " +
+				"\"notebook\" to see your words or \"wotd\" to get a word every morning.")
+		}
+		return true
+	})
+	if !onboarding {
+		return false
+	}
+	if err != nil {
+		msg.Logger().Error("failed to save a profile", "err", err)
+	}
+	if profile.OnboardingStep == "" {
+		linkRichMenu(profile)
+	}
+	if err := m.Reply(msg, reply); err != nil {
+		msg.Logger().Error("Failed to reply an onboarding question", "err", err)
+	}
+	return true
+}
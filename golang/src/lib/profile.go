@@ -0,0 +1,164 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	PlanFree    = "free"
+	PlanPremium = "premium"
+)
+
+type NotificationPrefs struct {
+	WeeklyReport bool `json:"weeklyReport"`
+}
+
+// Who the user is and how they want the bot to behave.
+type UserProfile struct {
+	UserID         string            `json:"userId"`
+	DisplayName    string            `json:"displayName"`
+	NativeLanguage string            `json:"nativeLanguage"`
+	Timezone       string            `json:"timezone"`
+	Level          string            `json:"level"` // CEFR level
+	Goals          string            `json:"goals"`
+	Plan           string            `json:"plan"`
+	Notifications  NotificationPrefs `json:"notifications"`
+	Active         bool              `json:"active"`
+	OnboardingStep string            `json:"onboardingStep,omitempty"`
+	CreatedAt      time.Time         `json:"createdAt"`
+	LastSeenAt     time.Time         `json:"lastSeenAt"`
+	FollowedAt     time.Time         `json:"followedAt"`
+	UnfollowedAt   time.Time         `json:"unfollowedAt,omitempty"`
+	// The user's data is deleted after this time unless they follow again
+	PurgeAfter time.Time `json:"purgeAfter,omitempty"`
+}
+
+// A profile with the defaults. Records saved before a field existed get its default too.
+func NewUserProfile(userId string) *UserProfile {
+	return &UserProfile{
+		UserID:        userId,
+		Timezone:      defaultTimezone,
+		Plan:          PlanFree,
+		Notifications: NotificationPrefs{WeeklyReport: true},
+		Active:        true,
+		CreatedAt:     time.Now(),
+	}
+}
+
+// ProfileRepository stores the profiles. Profiles is the one the bot uses.
+type ProfileRepository interface {
+	Get(userId string) (*UserProfile, bool)
+	Save(profile *UserProfile) error
+	Delete(userId string) error
+}
+
+var Profiles ProfileRepository = s3ProfileRepository{}
+
+// Profiles in the bucket at users/<userId>/profile.json
+type s3ProfileRepository struct{}
+
+func profileKey(userId string) string {
+	return fmt.Sprintf("users/%s/profile.json", userId)
+}
+
+func (s3ProfileRepository) Get(userId string) (*UserProfile, bool) {
+	content, exists := GetMessage(profileKey(userId))
+	if !exists {
+		return nil, false
+	}
+	profile := NewUserProfile(userId)
+	if err := json.Unmarshal(content, profile); err != nil {
+		return nil, false
+	}
+	return profile, true
+}
+
+func (s3ProfileRepository) Save(profile *UserProfile) error {
+	data, err := json.Marshal(profile)
+	if err != nil {
+		return err
+	}
+	return SaveObject(profileKey(profile.UserID), data, "application/json")
+}
+
+func (s3ProfileRepository) Delete(userId string) error {
+	return DeleteObject(profileKey(userId))
+}
+
+// Profiles kept in memory, for tests and local runs.
+type memoryProfileRepository struct {
+	mu       sync.Mutex
+	profiles map[string]UserProfile
+}
+
+func NewMemoryProfileRepository() ProfileRepository {
+	return &memoryProfileRepository{profiles: make(map[string]UserProfile)}
+}
+
+func (r *memoryProfileRepository) Get(userId string) (*UserProfile, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	profile, exists := r.profiles[userId]
+	if !exists {
+		return nil, false
+	}
+	return &profile, true
+}
+
+func (r *memoryProfileRepository) Save(profile *UserProfile) error {
+	if profile.UserID == "" {
+		return errors.New("a profile needs a user ID")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.profiles[profile.UserID] = *profile
+	return nil
+}
+
+func (r *memoryProfileRepository) Delete(userId string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.profiles, userId)
+	return nil
+}
+
+// Several workers may change the profile of the same user at once.
+var profileLocks userLocks
+
+// Change the profile of the user, one with the defaults if they have none,
+// saving it unless update returns false. Update is told whether the profile existed.
+func UpdateProfile(userId string, update func(profile *UserProfile, exists bool) bool) (*UserProfile, error) {
+	defer profileLocks.lock(userId)()
+	profile, exists := Profiles.Get(userId)
+	if !exists {
+		profile = NewUserProfile(userId)
+	}
+	if !update(profile, exists) {
+		return profile, nil
+	}
+	return profile, Profiles.Save(profile)
+}
+
+// Saving on every message would double the writes, so last seen is coarse.
+const lastSeenResolution = 10 * time.Minute
+
+// Note that the user is around, creating the profile of users who followed
+// before profiles existed.
+func TouchLastSeen(userId string) *UserProfile {
+	profile, err := UpdateProfile(userId, func(profile *UserProfile, exists bool) bool {
+		if exists && time.Since(profile.LastSeenAt) < lastSeenResolution {
+			return false
+		}
+		profile.LastSeenAt = time.Now()
+		return true
+	})
+	if err != nil {
+		slog.Error("failed to save a profile", "err", err)
+	}
+	return profile
+}
@@ -0,0 +1,354 @@
+package lib
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/gin-gonic/gin"
+)
+
+// What a user did on one day of their own calendar, stored at
+// users/<userId>/activity/<yyyy-mm-dd>.json
+type DailyActivity struct {
+	Date         string `json:"date"`
+	Lookups      int    `json:"lookups"`
+	NewWords     int    `json:"newWords"`
+	QuizAnswered int    `json:"quizAnswered"`
+	QuizCorrect  int    `json:"quizCorrect"`
+}
+
+// A summary of the last seven days ending today.
+type WeeklyReport struct {
+	Days         []*DailyActivity
+	DaysActive   int
+	Lookups      int
+	NewWords     int
+	QuizAnswered int
+	QuizCorrect  int
+	Streak       int
+}
+
+const defaultTimezone = "Asia/Tokyo"
+
+// A mutex per user, for updates that read and then write the user's objects.
+type userLocks struct {
+	locks sync.Map
+}
+
+// Lock the user and return the unlock.
+func (l *userLocks) lock(userId string) func() {
+	mu, _ := l.locks.LoadOrStore(userId, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
+
+// Several workers may record activity of the same user at once.
+var activityLocks userLocks
+
+func activityPrefix(userId string) string {
+	return fmt.Sprintf("users/%s/activity/", userId)
+}
+
+func activityKey(userId string, date string) string {
+	return activityPrefix(userId) + date + ".json"
+}
+
+// The timezone the user's days are counted in.
+func userLocation(userId string) *time.Location {
+	timezone := defaultTimezone
+	if profile, exists := Profiles.Get(userId); exists && profile.Timezone != "" {
+		timezone = profile.Timezone
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+func getDailyActivity(userId string, date string) *DailyActivity {
+	activity := &DailyActivity{Date: date}
+	if content, exists := GetMessage(activityKey(userId, date)); exists {
+		if err := json.Unmarshal(content, activity); err != nil {
+			slog.Error("broken activity record", "err", err)
+		}
+	}
+	return activity
+}
+
+// Update today's activity of the user.
+func RecordActivity(userId string, update func(activity *DailyActivity)) {
+	date := time.Now().In(userLocation(userId)).Format("2006-01-02")
+	defer activityLocks.lock(userId)()
+
+	activity := getDailyActivity(userId, date)
+	update(activity)
+
+	data, err := json.Marshal(activity)
+	if err != nil {
+		slog.Error("failed to encode activity", "err", err)
+		return
+	}
+	if err = SaveObject(activityKey(userId, date), data, "application/json"); err != nil {
+		slog.Error("failed to record activity", "err", err)
+	}
+}
+
+// Count the days in a row the user was active, up to today.
+// A streak isn't broken until the user misses a whole day, so it may end yesterday.
+func CurrentStreak(userId string) (int, error) {
+	prefix := activityPrefix(userId)
+	objects, err := ListObjects(prefix)
+	if err != nil {
+		return 0, err
+	}
+	active := make(map[string]bool, len(objects))
+	for _, object := range objects {
+		active[strings.TrimSuffix(strings.TrimPrefix(aws.StringValue(object.Key), prefix), ".json")] = true
+	}
+
+	day := time.Now().In(userLocation(userId))
+	if !active[day.Format("2006-01-02")] {
+		day = day.AddDate(0, 0, -1)
+	}
+	streak := 0
+	for active[day.Format("2006-01-02")] {
+		streak++
+		day = day.AddDate(0, 0, -1)
+	}
+	return streak, nil
+}
+
+func BuildWeeklyReport(userId string) (*WeeklyReport, error) {
+	streak, err := CurrentStreak(userId)
+	if err != nil {
+		return nil, err
+	}
+	report := &WeeklyReport{Streak: streak}
+
+	today := time.Now().In(userLocation(userId))
+	for i := 6; i >= 0; i-- {
+		activity := getDailyActivity(userId, today.AddDate(0, 0, -i).Format("2006-01-02"))
+		report.Days = append(report.Days, activity)
+		if activity.Lookups > 0 || activity.QuizAnswered > 0 {
+			report.DaysActive++
+		}
+		report.Lookups += activity.Lookups
+		report.NewWords += activity.NewWords
+		report.QuizAnswered += activity.QuizAnswered
+		report.QuizCorrect += activity.QuizCorrect
+	}
+	return report, nil
+}
+
+// Where users reach the bot, e.g. https://bot.example.com
+var publicURL string
+
+// Serve the charts of the reports from the bot at the URL. A pushed report
+// is read hours later, after a presigned link has expired; without a URL
+// they get one anyway.
+func SetPublicURL(url string) {
+	publicURL = strings.TrimSuffix(url, "/")
+}
+
+func reportChartPrefix(userId string) string {
+	return fmt.Sprintf("users/%s/reports/", userId)
+}
+
+// The chart of a day is named <date>-<random>.png, so its link can't be guessed.
+var (
+	reportChartName   = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}-[0-9a-f]{32}\.png$`)
+	reportChartUserID = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+)
+
+// The name of the chart of the day, the same one each time it is rendered.
+func reportChartFile(userId string, date string) (string, error) {
+	objects, err := ListObjects(reportChartPrefix(userId) + date + "-")
+	if err != nil {
+		return "", err
+	}
+	for _, object := range objects {
+		if name := strings.TrimPrefix(aws.StringValue(object.Key), reportChartPrefix(userId)); reportChartName.MatchString(name) {
+			return name, nil
+		}
+	}
+	random := make([]byte, 16)
+	if _, err = rand.Read(random); err != nil {
+		return "", err
+	}
+	return date + "-" + hex.EncodeToString(random) + ".png", nil
+}
+
+// Render the lookups of the week and upload the chart for the report message.
+func uploadWeeklyChart(userId string, report *WeeklyReport) (string, error) {
+	values := make([]int, len(report.Days))
+	for i, day := range report.Days {
+		values[i] = day.Lookups + day.QuizAnswered
+	}
+	chart, err := RenderBarChart(values, len(values)-1, 1040, 520)
+	if err != nil {
+		return "", err
+	}
+	name, err := reportChartFile(userId, report.Days[len(report.Days)-1].Date)
+	if err != nil {
+		return "", err
+	}
+	key := reportChartPrefix(userId) + name
+	if err = SaveObject(key, chart, "image/png"); err != nil {
+		return "", err
+	}
+	if publicURL == "" {
+		return GeneratePresignedUrl(key), nil
+	}
+	return publicURL + "/reports/" + userId + "/" + name, nil
+}
+
+// GET /reports/:userId/:chart serves the chart of a report to LINE and the
+// user. Anyone with the link can see it, like the presigned ones.
+func ReportChartHandler(c *gin.Context) {
+	userId, name := c.Param("userId"), c.Param("chart")
+	if !reportChartUserID.MatchString(userId) || !reportChartName.MatchString(name) {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	key := reportChartPrefix(userId) + name
+	if !ObjectExists(key) {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	chart, exists := GetMessage(key)
+	if !exists {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+	// a chart never changes once the day is over
+	c.Header("Cache-Control", "public, max-age=86400")
+	c.Data(http.StatusOK, "image/png", chart)
+}
+
+// The local date of the last Sunday the user got the report, so that a
+// rerun of the job in the same hour doesn't push it twice.
+func weeklyReportSentKey(userId string) string {
+	return reportChartPrefix(userId) + "last-sent"
+}
+
+func weeklyReportMessage(userId string, report *WeeklyReport) OutgoingReply {
+	accuracy := "-"
+	if report.QuizAnswered > 0 {
+		accuracy = fmt.Sprintf("%d%%", report.QuizCorrect*100/report.QuizAnswered)
+	}
+	days := make([]string, len(report.Days))
+	for i, day := range report.Days {
+		date, _ := time.Parse("2006-01-02", day.Date)
+		days[i] = date.Format("Mon")[:2]
+	}
+
+	card := Card{
+		Title:    "Your week",
+		Subtitle: strings.Join(days, "  "),
+		Fields: []CardField{
+			{Label: "Streak", Value: fmt.Sprintf("%d days", report.Streak)},
+			{Label: "Days active", Value: fmt.Sprintf("%d / 7", report.DaysActive)},
+			{Label: "Words learned", Value: fmt.Sprintf("%d", report.NewWords)},
+			{Label: "Lookups", Value: fmt.Sprintf("%d", report.Lookups)},
+			{Label: "Quiz accuracy", Value: accuracy},
+		},
+	}
+	if url, err := uploadWeeklyChart(userId, report); err != nil {
+		slog.Error("failed to render the weekly chart", "err", err)
+	} else {
+		card.ImageURL = url
+	}
+	return CardReply(fmt.Sprintf("Your week: %d words learned, %d day streak", report.NewWords, report.Streak), card)
+}
+
+// The report goes out on Sunday at weeklyReportHour in the timezone of each user.
+const weeklyReportHour = 19
+
+// Push the weekly report to the users whose Sunday evening it is. It runs
+// on the scheduler every hour.
+func WeeklyReportJob(ctx context.Context) error {
+	return SendWeeklyReports(ctx, time.Now())
+}
+
+// Push the weekly report to everyone who was active during the week and
+// wants it, when it is weeklyReportHour on Sunday for them.
+func SendWeeklyReports(ctx context.Context, now time.Time) error {
+	userIds, err := ListUserIDs()
+	if err != nil {
+		return err
+	}
+	sent := 0
+	for _, userId := range userIds {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// console users have notebooks and profiles too
+		if !isLineUser(userId) {
+			continue
+		}
+		local := now.In(userLocation(userId))
+		if local.Weekday() != time.Sunday || local.Hour() != weeklyReportHour {
+			continue
+		}
+		date := local.Format("2006-01-02")
+		if ObjectExists(weeklyReportSentKey(userId)) {
+			if lastSent, _ := GetMessage(weeklyReportSentKey(userId)); string(lastSent) == date {
+				continue
+			}
+		}
+		if profile, exists := Profiles.Get(userId); exists && (!profile.Active || !profile.Notifications.WeeklyReport) {
+			continue
+		}
+		report, err := BuildWeeklyReport(userId)
+		if err != nil {
+			slog.Error("failed to build a weekly report", "err", err)
+			continue
+		}
+		if report.DaysActive == 0 {
+			continue
+		}
+		if err = LineMessenger().Push(userId, weeklyReportMessage(userId, report)); err != nil {
+			slog.Error("Failed to push a weekly report", "err", err)
+			continue
+		}
+		if err = SaveObject(weeklyReportSentKey(userId), []byte(date), "text/plain"); err != nil {
+			slog.Error("failed to mark a weekly report as sent", "err", err)
+		}
+		sent++
+	}
+	slog.Info("Sent weekly reports", "count", sent)
+	return nil
+}
+
+// Show the report of the last seven days on demand:
+//
+//	progress
+func handleProgressCommand(m Messenger, msg *IncomingMessage) bool {
+	if strings.ToLower(strings.TrimSpace(msg.Text)) != "progress" {
+		return false
+	}
+	userId := msg.UserID
+	var message OutgoingReply
+	report, err := BuildWeeklyReport(userId)
+	if err != nil {
+		msg.Logger().Error("failed to build a weekly report", "err", err)
+		message = TextReply("Sorry, we're under maintenance. Try it later.")
+	} else {
+		message = weeklyReportMessage(userId, report)
+	}
+	if err = m.Reply(msg, message); err != nil {
+		msg.Logger().Error("Failed to reply the progress", "err", err)
+	}
+	return true
+}
@@ -0,0 +1,429 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/line/line-bot-sdk-go/linebot"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// RichMenuButton is one tappable area of a menu. It sends Text as the user,
+// or opens URI when it is set.
+type RichMenuButton struct {
+	Label string
+	Text  string
+	URI   string
+	Color color.RGBA
+}
+
+// RichMenuDef declares a menu. Buttons are laid out left to right and top to
+// bottom in a grid of Columns. The image is drawn from the labels unless Image
+// points to a PNG or JPEG of the menu's size.
+type RichMenuDef struct {
+	Name        string
+	ChatBarText string
+	Columns     int
+	Buttons     []RichMenuButton
+	Image       string
+}
+
+const (
+	RichMenuOnboarding = "onboarding"
+	RichMenuFree       = "free"
+	RichMenuPremium    = "premium"
+)
+
+var (
+	menuGreen  = color.RGBA{0x06, 0xc7, 0x55, 0xff}
+	menuBlue   = color.RGBA{0x3b, 0x82, 0xf6, 0xff}
+	menuOrange = color.RGBA{0xf5, 0x9e, 0x0b, 0xff}
+	menuGray   = color.RGBA{0x6b, 0x72, 0x80, 0xff}
+)
+
+var richMenuDefs = []RichMenuDef{
+	{
+		Name:        RichMenuOnboarding,
+		ChatBarText: "Get started",
+		Columns:     2,
+		Buttons: []RichMenuButton{
+			{Label: "Set up", Text: "settings", Color: menuGreen},
+			{Label: "Try a word", Text: "hello", Color: menuBlue},
+		},
+	},
+	{
+		Name:        RichMenuFree,
+		ChatBarText: "Menu",
+		Columns:     3,
+		Buttons: []RichMenuButton{
+			{Label: "Notebook", Text: "notebook", Color: menuGreen},
+			{Label: "Progress", Text: "progress", Color: menuBlue},
+			{Label: "Word of day", Text: "wotd", Color: menuOrange},
+			{Label: "Export", Text: "export", Color: menuBlue},
+			{Label: "Settings", Text: "settings", Color: menuGray},
+			{Label: "Help", Text: "help", Color: menuOrange},
+		},
+	},
+	{
+		Name:        RichMenuPremium,
+		ChatBarText: "Menu",
+		Columns:     3,
+		Buttons: []RichMenuButton{
+			{Label: "Notebook", Text: "notebook", Color: menuGreen},
+			{Label: "Progress", Text: "progress", Color: menuBlue},
+			{Label: "Word of day", Text: "wotd", Color: menuOrange},
+			{Label: "Anki", Text: "export anki", Color: menuBlue},
+			{Label: "CSV", Text: "export csv", Color: menuBlue},
+			{Label: "Settings", Text: "settings", Color: menuGray},
+		},
+	},
+}
+
+// RichMenuAPI is the part of the Messaging API the menus need,
+// so that tests can run against linetest.RichMenuAPI.
+type RichMenuAPI interface {
+	ListRichMenus() ([]*linebot.RichMenuResponse, error)
+	CreateRichMenu(menu linebot.RichMenu) (string, error)
+	UploadRichMenuImage(richMenuID string, png []byte) error
+	DeleteRichMenu(richMenuID string) error
+	SetDefaultRichMenu(richMenuID string) error
+	LinkUserRichMenu(userID string, richMenuID string) error
+}
+
+// RichMenuManager keeps the menus on LINE in sync with the definitions.
+type RichMenuManager struct {
+	api  RichMenuAPI
+	defs []RichMenuDef
+	mu   sync.RWMutex
+	ids  map[string]string
+}
+
+func NewRichMenuManager(api RichMenuAPI, defs []RichMenuDef) *RichMenuManager {
+	return &RichMenuManager{api: api, defs: defs, ids: make(map[string]string)}
+}
+
+// The manager the bot links menus with, set up by StartRichMenus.
+var richMenus *RichMenuManager
+
+// Menus are named "aienglish:<name>@<hash of the definition>", so a restart
+// finds the menus it created before and only a changed definition makes a new one.
+const richMenuPrefix = "aienglish:"
+
+func richMenuName(def RichMenuDef, img []byte) string {
+	spec, _ := json.Marshal(def)
+	sum := sha256.Sum256(append(spec, img...))
+	return richMenuPrefix + def.Name + "@" + hex.EncodeToString(sum[:])[:12]
+}
+
+// Sync creates the missing menus, deletes the outdated ones and sets the free menu as default.
+// Users linked to an outdated menu get its new version before it is deleted.
+func (m *RichMenuManager) Sync(ctx context.Context) error {
+	existing, err := m.api.ListRichMenus()
+	if err != nil {
+		return err
+	}
+	byName := make(map[string]string, len(existing))
+	for _, menu := range existing {
+		byName[menu.Name] = menu.RichMenuID
+	}
+
+	ids := make(map[string]string, len(m.defs))
+	wanted := make(map[string]bool, len(m.defs))
+	defNames := make(map[string]string, len(m.defs))
+	for _, def := range m.defs {
+		img, err := richMenuImage(def)
+		if err != nil {
+			return fmt.Errorf("rich menu %s: %v", def.Name, err)
+		}
+		name := richMenuName(def, img)
+		wanted[name] = true
+		defNames[richMenuPrefix+def.Name+"@"] = def.Name
+
+		if id, exists := byName[name]; exists {
+			ids[def.Name] = id
+			continue
+		}
+		id, err := m.api.CreateRichMenu(richMenuSpec(def, name))
+		if err != nil {
+			return fmt.Errorf("failed to create rich menu %s: %v", def.Name, err)
+		}
+		if err = m.api.UploadRichMenuImage(id, img); err != nil {
+			// a menu without an image can't be used, don't leave it around
+			m.api.DeleteRichMenu(id)
+			return fmt.Errorf("failed to upload the image of rich menu %s: %v", def.Name, err)
+		}
+		slog.Info("Created rich menu", "name", name)
+		ids[def.Name] = id
+	}
+
+	m.mu.Lock()
+	m.ids = ids
+	m.mu.Unlock()
+
+	if id, exists := ids[RichMenuFree]; exists {
+		if err := m.api.SetDefaultRichMenu(id); err != nil {
+			return fmt.Errorf("failed to set the default rich menu: %v", err)
+		}
+	}
+
+	var outdated []*linebot.RichMenuResponse
+	replaced := make(map[string]bool)
+	for _, menu := range existing {
+		if strings.HasPrefix(menu.Name, richMenuPrefix) && !wanted[menu.Name] {
+			outdated = append(outdated, menu)
+			if at := strings.LastIndex(menu.Name, "@"); at >= 0 && defNames[menu.Name[:at+1]] != "" {
+				replaced[defNames[menu.Name[:at+1]]] = true
+			}
+		}
+	}
+	// users of the free menu fall back to the default when theirs is deleted
+	delete(replaced, RichMenuFree)
+	if len(replaced) > 0 && !m.relink(ctx, replaced) {
+		// the next sync links the rest and deletes them
+		slog.Warn("Kept the outdated rich menus, some users weren't linked to the new ones")
+		return nil
+	}
+
+	for _, menu := range outdated {
+		if err := m.api.DeleteRichMenu(menu.RichMenuID); err != nil {
+			slog.Error("Failed to delete an outdated rich menu", "err", err)
+		}
+	}
+	return nil
+}
+
+// Link the users whose menu is one of the replaced ones to its new version.
+// It reports whether all of them were linked.
+func (m *RichMenuManager) relink(ctx context.Context, replaced map[string]bool) bool {
+	userIds, err := ListUserIDs()
+	if err != nil {
+		slog.Error("Failed to list the users to link the new rich menus", "err", err)
+		return false
+	}
+	linked := true
+	for _, userId := range userIds {
+		if ctx.Err() != nil {
+			return false
+		}
+		if !isLineUser(userId) {
+			continue
+		}
+		profile, exists := Profiles.Get(userId)
+		if !exists || !replaced[richMenuFor(profile)] {
+			continue
+		}
+		if err := m.LinkFor(profile); err != nil {
+			slog.Error("Failed to link a new rich menu", "err", err)
+			linked = false
+		}
+	}
+	return linked
+}
+
+// The menu for where the user is: onboarding first, then by plan.
+func richMenuFor(profile *UserProfile) string {
+	if profile.OnboardingStep != "" {
+		return RichMenuOnboarding
+	}
+	if profile.Plan == PlanPremium {
+		return RichMenuPremium
+	}
+	return RichMenuFree
+}
+
+func (m *RichMenuManager) LinkFor(profile *UserProfile) error {
+	m.mu.RLock()
+	id, exists := m.ids[richMenuFor(profile)]
+	m.mu.RUnlock()
+	if !exists {
+		return fmt.Errorf("rich menu %s isn't ready", richMenuFor(profile))
+	}
+	return m.api.LinkUserRichMenu(profile.UserID, id)
+}
+
+// Link the menu that fits the user, if the menus are set up.
+func linkRichMenu(profile *UserProfile) {
+	if richMenus == nil {
+		return
+	}
+	if err := richMenus.LinkFor(profile); err != nil {
+		slog.Error("Failed to link a rich menu", "err", err)
+	}
+}
+
+// Set up the menus of the bot. The returned job syncs them on the scheduler.
+func StartRichMenus(api RichMenuAPI) func(ctx context.Context) error {
+	richMenus = NewRichMenuManager(api, richMenuDefs)
+	return richMenus.Sync
+}
+
+func richMenuRows(def RichMenuDef) int {
+	return (len(def.Buttons) + def.Columns - 1) / def.Columns
+}
+
+// One row fits the compact size, more rows take the large one.
+func richMenuSize(def RichMenuDef) linebot.RichMenuSize {
+	if richMenuRows(def) <= 1 {
+		return linebot.RichMenuSize{Width: 2500, Height: 843}
+	}
+	return linebot.RichMenuSize{Width: 2500, Height: 1686}
+}
+
+func richMenuSpec(def RichMenuDef, name string) linebot.RichMenu {
+	size := richMenuSize(def)
+	rows := richMenuRows(def)
+	cellWidth := size.Width / def.Columns
+	cellHeight := size.Height / rows
+
+	menu := linebot.RichMenu{
+		Size:        size,
+		Selected:    true,
+		Name:        name,
+		ChatBarText: def.ChatBarText,
+	}
+	for i, button := range def.Buttons {
+		action := linebot.RichMenuAction{Type: linebot.RichMenuActionTypeMessage, Text: button.Text}
+		if button.URI != "" {
+			action = linebot.RichMenuAction{Type: linebot.RichMenuActionTypeURI, URI: button.URI}
+		}
+		menu.Areas = append(menu.Areas, linebot.AreaDetail{
+			Bounds: linebot.RichMenuBounds{
+				X:      (i % def.Columns) * cellWidth,
+				Y:      (i / def.Columns) * cellHeight,
+				Width:  cellWidth,
+				Height: cellHeight,
+			},
+			Action: action,
+		})
+	}
+	return menu
+}
+
+func richMenuImage(def RichMenuDef) ([]byte, error) {
+	if def.Image != "" {
+		return os.ReadFile(def.Image)
+	}
+
+	size := richMenuSize(def)
+	rows := richMenuRows(def)
+	cellWidth := size.Width / def.Columns
+	cellHeight := size.Height / rows
+	img := image.NewRGBA(image.Rect(0, 0, size.Width, size.Height))
+	draw.Draw(img, img.Bounds(), &image.Uniform{color.White}, image.Point{}, draw.Src)
+
+	for i, button := range def.Buttons {
+		x := (i % def.Columns) * cellWidth
+		y := (i / def.Columns) * cellHeight
+		// leave a white border between the buttons
+		cell := image.Rect(x+8, y+8, x+cellWidth-8, y+cellHeight-8)
+		draw.Draw(img, cell, &image.Uniform{button.Color}, image.Point{}, draw.Src)
+		drawLabel(img, cell, button.Label)
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Draw the label centered in the cell with the built-in bitmap font blown up
+// to a readable size, so no font files are needed.
+func drawLabel(img *image.RGBA, cell image.Rectangle, label string) {
+	face := basicfont.Face7x13
+	textWidth := font.MeasureString(face, label).Ceil()
+	small := image.NewAlpha(image.Rect(0, 0, textWidth, face.Height))
+	d := &font.Drawer{
+		Dst:  small,
+		Src:  image.Opaque,
+		Face: face,
+		Dot:  fixed.P(0, face.Ascent),
+	}
+	d.DrawString(label)
+
+	scale := cell.Dx() * 3 / 4 / textWidth
+	if max := cell.Dy() / 3 / face.Height; scale > max {
+		scale = max
+	}
+	if scale < 1 {
+		scale = 1
+	}
+	x0 := cell.Min.X + (cell.Dx()-textWidth*scale)/2
+	y0 := cell.Min.Y + (cell.Dy()-face.Height*scale)/2
+	for y := 0; y < face.Height; y++ {
+		for x := 0; x < textWidth; x++ {
+			if small.AlphaAt(x, y).A < 0x80 {
+				continue
+			}
+			dot := image.Rect(x0+x*scale, y0+y*scale, x0+(x+1)*scale, y0+(y+1)*scale)
+			draw.Draw(img, dot, &image.Uniform{color.White}, image.Point{}, draw.Src)
+		}
+	}
+}
+
+// The Messaging API behind RichMenuAPI.
+type lineRichMenuAPI struct{}
+
+// LineRichMenuAPI talks to LINE with the current bot client.
+func LineRichMenuAPI() RichMenuAPI {
+	return lineRichMenuAPI{}
+}
+
+func (lineRichMenuAPI) ListRichMenus() ([]*linebot.RichMenuResponse, error) {
+	return GetBot().Client.GetRichMenuList().Do()
+}
+
+func (lineRichMenuAPI) CreateRichMenu(menu linebot.RichMenu) (string, error) {
+	res, err := GetBot().Client.CreateRichMenu(menu).Do()
+	if err != nil {
+		return "", err
+	}
+	return res.RichMenuID, nil
+}
+
+// The SDK uploads from a file, so the image goes through a temporary one.
+func (lineRichMenuAPI) UploadRichMenuImage(richMenuID string, img []byte) error {
+	file, err := os.CreateTemp("", "richmenu-*.png")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err = file.Write(img); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	_, err = GetBot().Client.UploadRichMenuImage(richMenuID, file.Name()).Do()
+	return err
+}
+
+func (lineRichMenuAPI) DeleteRichMenu(richMenuID string) error {
+	_, err := GetBot().Client.DeleteRichMenu(richMenuID).Do()
+	return err
+}
+
+func (lineRichMenuAPI) SetDefaultRichMenu(richMenuID string) error {
+	_, err := GetBot().Client.SetDefaultRichMenu(richMenuID).Do()
+	return err
+}
+
+func (lineRichMenuAPI) LinkUserRichMenu(userID string, richMenuID string) error {
+	_, err := GetBot().Client.LinkUserRichMenu(userID, richMenuID).Do()
+	return err
+}
@@ -0,0 +1,132 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/line/line-bot-sdk-go/linebot"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The HTTP routes of the bot: the LINE webhook, the metrics, the health
+// checks and the admin API.
+// Events are queued for the workers, see SetRequestQueue.
+func NewRouter() *gin.Engine {
+	router := gin.New()
+	// gin believes forwarded headers from anyone unless told otherwise
+	if err := router.SetTrustedProxies(trustedProxies); err != nil {
+		slog.Error("Invalid trusted proxies, trusting none", "err", err)
+		router.SetTrustedProxies(nil)
+	}
+	router.Use(gin.Recovery(), otelgin.Middleware("ai-english", otelgin.WithTracerProvider(libTracerProvider{})), requestLogger())
+
+	router.POST("/callback", func(c *gin.Context) {
+		// validation to limit the scope where http requests are accepted
+		WebhookHandler(c, GetBot().Client)
+
+		// keep the body for the capture, parsing consumes it
+		body, err := io.ReadAll(c.Request.Body)
+		c.Request.Body.Close()
+		if err != nil {
+			c.Writer.WriteHeader(400)
+			LogWebhookInfo(c, 400, 0)
+			observeWebhook(400)
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		events, err := GetBot().Client.ParseRequest(c.Request)
+		if err != nil {
+			if err == linebot.ErrInvalidSignature {
+				c.Writer.WriteHeader(400)
+				LogWebhookInfo(c, 400, 0)
+				observeWebhook(400)
+			} else {
+				c.Writer.WriteHeader(500)
+				LogWebhookInfo(c, 500, 0)
+				observeWebhook(500)
+			}
+			return
+		}
+		// only what LINE signed is captured
+		captureWebhook(c.Request.Header, body, http.StatusOK)
+		requestID := RequestID(c)
+		for _, event := range events {
+			// add requests to the buffer (channel)
+			enqueueEvent(c.Request.Context(), event, requestID)
+		}
+
+		c.Status(http.StatusOK)
+		LogWebhookInfo(c, http.StatusOK, len(events))
+		observeWebhook(http.StatusOK)
+	})
+
+	router.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	router.GET("/healthz", HealthzHandler)
+	router.GET("/reports/:userId/:chart", ReportChartHandler)
+	router.GET("/readyz", ReadyzHandler)
+	router.GET("/debug/status", AdminAuth(), DebugStatusHandler)
+
+	// admin API for teachers
+	admin := router.Group("/admin", AdminAuth())
+	admin.POST("/import", AdminImportHandler)
+	admin.GET("/import/:id", AdminImportStatusHandler)
+
+	return router
+}
+
+// Queue an event for the workers under a span of its own, which the worker
+// continues from. It waits while the queue is full.
+func enqueueEvent(ctx context.Context, event *linebot.Event, requestID string) {
+	_, span := tracer.Start(ctx, "enqueue "+string(event.Type),
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attribute.String("request_id", requestID)))
+	defer span.End()
+	requestQueue <- &LineRequest{
+		UserId:    event.Source.UserID,
+		Payload:   event,
+		RequestID: requestID,
+		Received:  time.Now(),
+		Trace:     span.SpanContext(),
+	}
+}
+
+const (
+	requestIDKey    = "requestID"
+	requestStartKey = "requestStart"
+)
+
+// Give every request an ID, sent back in X-Request-ID, and log it once served.
+// Events of a webhook carry its ID to the workers.
+func requestLogger() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		requestID := NewRequestID()
+		c.Set(requestIDKey, requestID)
+		c.Set(requestStartKey, start)
+		c.Header("X-Request-ID", requestID)
+
+		c.Next()
+
+		slog.Info("Served a request",
+			"request_id", requestID,
+			"trace_id", trace.SpanContextFromContext(c.Request.Context()).TraceID().String(),
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"status", c.Writer.Status(),
+			"latency", time.Since(start))
+	}
+}
+
+// The ID requestLogger gave the request.
+func RequestID(c *gin.Context) string {
+	return c.GetString(requestIDKey)
+}
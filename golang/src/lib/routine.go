@@ -1,164 +1,178 @@
 package lib
 
 import (
-	"errors"
+	"context"
 	"fmt"
-	"log"
-	"strconv"
+	"log/slog"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/line/line-bot-sdk-go/linebot"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type LineRequest struct {
 	UserId  string
 	Payload *linebot.Event
+	// The webhook the event came in, and when, for the logs
+	RequestID string
+	Received  time.Time
+	// The span that queued the event, the parent of the one handling it
+	Trace trace.SpanContext
+}
+
+var requestQueue chan<- *LineRequest
+
+// Share the queue the workers consume with the webhook.
+func SetRequestQueue(requests chan<- *LineRequest) {
+	requestQueue = requests
+}
+
+// Lookups a user gets a day before the bot asks them to wait
+var dailyLookupLimit = DefaultConfig().DailyLookupLimit
+
+func SetDailyLookupLimit(limit int) {
+	dailyLookupLimit = limit
 }
 
 func Worker(requests <-chan *LineRequest, wg *sync.WaitGroup) {
 	defer wg.Done()
+	status := startWorkerStatus()
+	defer status.stop()
 
 	for req := range requests {
-		log.Println("Processing request from user: " + req.UserId)
+		status.busy(req)
 		processRequest(req)
+		status.idle()
+	}
+}
+
+// What a worker is doing, for /debug/status.
+type WorkerStatus struct {
+	ID    int       `json:"id"`
+	Busy  bool      `json:"busy"`
+	Since time.Time `json:"since"`
+	// the event type
+	Handling  string `json:"handling,omitempty"`
+	RequestID string `json:"requestId,omitempty"`
+	Handled   int    `json:"handled"`
+}
+
+var (
+	workersMu    sync.Mutex
+	workers      = make(map[int]*WorkerStatus)
+	nextWorkerID = 1
+)
+
+func startWorkerStatus() *WorkerStatus {
+	workersMu.Lock()
+	defer workersMu.Unlock()
+	status := &WorkerStatus{ID: nextWorkerID, Since: time.Now()}
+	workers[status.ID] = status
+	nextWorkerID++
+	return status
+}
+
+func (status *WorkerStatus) busy(req *LineRequest) {
+	workersMu.Lock()
+	defer workersMu.Unlock()
+	status.Busy = true
+	status.Since = time.Now()
+	status.RequestID = req.RequestID
+	status.Handling = string(req.Payload.Type)
+}
+
+func (status *WorkerStatus) idle() {
+	workersMu.Lock()
+	defer workersMu.Unlock()
+	status.Busy = false
+	status.Since = time.Now()
+	status.Handling = ""
+	status.RequestID = ""
+	status.Handled++
+}
+
+func (status *WorkerStatus) stop() {
+	workersMu.Lock()
+	defer workersMu.Unlock()
+	delete(workers, status.ID)
+}
+
+// The running workers, by ID.
+func WorkerStatuses() []WorkerStatus {
+	workersMu.Lock()
+	defer workersMu.Unlock()
+	statuses := make([]WorkerStatus, 0, len(workers))
+	for _, status := range workers {
+		statuses = append(statuses, *status)
 	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].ID < statuses[j].ID })
+	return statuses
 }
 
 func processRequest(req *LineRequest) {
-	// Simulate a big process
-	time.Sleep(2 * time.Second)
-	handleEvent(req.Payload)
-	log.Printf("Finished processing request from user: %s\n", req.UserId)
+	busyWorkers.Inc()
+	defer busyWorkers.Dec()
+	start := time.Now()
+	queueWait.WithLabelValues("event").Observe(start.Sub(req.Received).Seconds())
+
+	// the channel doesn't carry a context, so the trace continues from the span that queued the event
+	ctx := trace.ContextWithRemoteSpanContext(context.Background(), req.Trace)
+	ctx, span := tracer.Start(ctx, "dequeue "+string(req.Payload.Type),
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("request_id", req.RequestID),
+			attribute.String("event.type", string(req.Payload.Type)),
+			attribute.Int64("queue.wait_ms", start.Sub(req.Received).Milliseconds())))
+	defer span.End()
+
+	logger := slog.With("request_id", req.RequestID, "user", UserHash(req.UserId), "event_type", req.Payload.Type)
+	handleEvent(ctx, req.Payload, req.RequestID)
+	logger.Info("Handled an event",
+		"latency", time.Since(start), "queued", start.Sub(req.Received))
 }
 
-func handleEvent(event *linebot.Event) {
+func handleEvent(ctx context.Context, event *linebot.Event, requestID string) {
 	switch event.Type {
 	case linebot.EventTypeMessage:
-		handleMessageEvent(event)
+		handleMessageEvent(ctx, event, requestID)
+	case linebot.EventTypeFollow:
+		handleFollowEvent(event)
+	case linebot.EventTypeUnfollow:
+		handleUnfollowEvent(event)
+	case linebot.EventTypeJoin:
+		handleJoinEvent(event)
+	case linebot.EventTypeLeave:
+		handleLeaveEvent(event)
 	default:
-		log.Printf("Unhandled event type: %s\n", event.Type)
+		slog.Warn("Unhandled event type", "request_id", requestID, "event_type", event.Type)
 	}
 }
 
-func handleMessageEvent(event *linebot.Event) {
+func handleMessageEvent(ctx context.Context, event *linebot.Event, requestID string) {
+	ctx, span := tracer.Start(ctx, "handleMessageEvent")
+	defer span.End()
+	inGroup := isGroupChat(event.Source)
+
 	switch message := event.Message.(type) {
 	case *linebot.TextMessage:
-		log.Println("-----------------")
-		log.Println(message.Text)
-
-		// clean up the input
-		sanitizedText, isSanitized := IsEnglishSentence(RemoveExtraSpace(message.Text))
-		if !isSanitized {
-			if _, err := bot.Client.ReplyMessage(event.ReplyToken,
-				linebot.NewTextMessage("Don't use invalid characters. You can only use english, '.', ',' or space")).Do(); err != nil {
-				if _, err = bot.Client.ReplyMessage(event.ReplyToken,
-					linebot.NewTextMessage("Sorry, we're under maintenance. Try it later.")).Do(); err != nil {
-				}
-			}
-			return
-		}
-		log.Println("sanitized")
-		log.Println(sanitizedText)
-
-		key := fmt.Sprintf("users/%s/messages/%s", event.Source.UserID, sanitizedText)
-
-		// key := fmt.Sprintf("messages/%s/%s", event.Source.UserID, message.ID)
-		// check if this message is duplicated and repeatedly sent.
-		if _, isRepeated := GetMessage(key); isRepeated {
-			log.Println("repeated")
-			botKey := fmt.Sprintf("bots/users/%s/messages/%s", event.Source.UserID, sanitizedText)
-			// get past data from s3 to reply
-			if content, exists := GetMessage(botKey); exists {
-
-				// send the image retrived from s3 to run efficiently
-				imageKey := fmt.Sprintf("bots/users/%s/images/%s", event.Source.UserID, sanitizedText)
-				urls := make([]string, 0)
-				urls = append(urls, GeneratePresignedUrl(imageKey))
-				// reply images
-				err := replyPresignedUrl(bot, event, urls)
-				// send the past data retrived from s3 to save the cost of gpt
-				// To avoid sending messages without user's input due to repeated same requests from LINE server
-				if err == nil {
-					if _, err = bot.Client.PushMessage(event.Source.UserID,
-						linebot.NewTextMessage(string(content))).Do(); err != nil {
-						log.Println("Failed to reply a past post: ", err.Error())
-					}
-					recordUserMessage(event, key, message.ID)
-				}
+		msg := lineIncomingMessage(event, message)
+		msg.RequestID = requestID
+		msg.ctx = ctx
+		HandleMessage(LineMessenger(), msg)
 
-			} else if _, err := bot.Client.ReplyMessage(event.ReplyToken,
-				linebot.NewTextMessage("Sorry, we're in trouble. Wait a moment to recover.")).Do(); err != nil {
-				log.Println("Internal server error while replying against repeated request.")
-			}
-			return
+	case *linebot.FileMessage:
+		// files shared in a group are for the members, not for the bot
+		if !inGroup {
+			handleFileMessage(event, message)
 		}
 
-		// save userId and messageId into s3
-		recordUserMessage(event, key, message.ID)
-		// Check that this user already used three times
-		prefix := fmt.Sprintf("users/%s/messages/", event.Source.UserID)
-		todaysCnt, err := CheckThreeTimes(prefix)
-		if err != nil {
-			log.Println("failed to check for this reason: ", err.Error())
-
-			// emergency reply
-			if _, err = bot.Client.ReplyMessage(event.ReplyToken,
-				linebot.NewTextMessage("Sorry, we're under maintenance. Try it later.")).Do(); err != nil {
-				log.Println("Failed to reply about a maximum limit warning: ", err.Error())
-			}
-			return
-		}
-		log.Println(todaysCnt)
-		if todaysCnt >= 15 {
-			if _, err = bot.Client.ReplyMessage(event.ReplyToken,
-				linebot.NewTextMessage("Free users are limited to up to 3 requests per day! Please pay to extend the limit or wait until tomorrow or b")).Do(); err != nil {
-				log.Println("Failed to reply about a maximum limit warning: ", err.Error())
-			}
+	case *linebot.ImageMessage:
+		if inGroup {
 			return
 		}
-		log.Println("cnt: " + strconv.Itoa(todaysCnt))
-
-		// ask openai of something
-		res, err := GetOpenaiChatResponse(sanitizedText)
-		// var resStr string // Actual respoonse
-		if err != nil || len(res.Choices) == 0 {
-			log.Println("an error during gpt api: " + err.Error())
-			// delete message data the user sent from s3 because it has no reply
-			DeleteObject(key)
-			// Reply an error message to the user
-			if _, err := bot.Client.ReplyMessage(event.ReplyToken,
-				linebot.NewTextMessage("Sorry, we're in trouble. Wait for recovery.")).Do(); err != nil {
-				log.Println("an error while replying an error message from LINE bot" + err.Error())
-			}
-
-		} else if len(res.Choices) > 0 {
-
-			// Todo - send multiply for paid users
-			// get presigned urls for LINE server to get an access to s3
-			// presignedUrls := lib.ScrapeImages(sanitizedText, 1, event.Source.UserID)
-			// if len(presignedUrls) > 0 {
-			// 	if _, err := bot.Client.ReplyMessage(event.ReplyToken,
-			// 		linebot.NewImageMessage(presignedUrls[0], presignedUrls[0])).Do(); err != nil {
-			// 		log.Println("an error while replying images from LINE bot" + err.Error())
-			// 	}
-			// }
-			presignedUrls := ScrapeImages(sanitizedText, 1, event.Source.UserID)
-			replyPresignedUrl(bot, event, presignedUrls)
-
-			// Send crash course
-			if _, err = bot.Client.PushMessage(event.Source.UserID,
-				linebot.NewTextMessage(res.Choices[0].Messages.Content)).Do(); err != nil {
-				log.Println("an error while replying texts from LINE bot" + err.Error())
-			}
-			// save this replying data into s3
-			key = fmt.Sprintf("bots/users/%s/messages/%s", event.Source.UserID, sanitizedText)
-			SaveMessageIdsIntoS3(key, res.Choices[0].Messages.Content)
-		}
-
-		// }
-
-	case *linebot.ImageMessage:
 		// for both types of users
 		key := fmt.Sprintf("users/%s/imageMessages/%s", event.Source.UserID, message.ID)
 		data := fmt.Sprintf(`{userId: %s, messageId: %s}`, event.Source.UserID, message.ID)
@@ -175,27 +189,144 @@ func handleMessageEvent(event *linebot.Event) {
 	}
 }
 
-func replyPresignedUrl(bot *LineBot, event *linebot.Event, presignedUrls []string) error {
-	if len(presignedUrls) > 0 {
-		log.Println(event.ReplyToken)
-		log.Println(presignedUrls)
-		log.Println(bot.Client)
-		if presignedUrls[0] == "" {
-			presignedUrls[0] = "https://noimage.com"
-			if _, err := bot.Client.ReplyMessage(event.ReplyToken,
-				linebot.NewImageMessage(presignedUrls[0], presignedUrls[0])).Do(); err != nil {
-				return errors.New("an error while replying images from LINE bot" + err.Error())
+// Handle a text from any platform: commands first, then look it up as a word.
+func HandleMessage(m Messenger, msg *IncomingMessage) {
+	logger := msg.Logger()
+	logger.Debug("Received a message", "group", msg.Group)
+
+	if msg.Group {
+		if !msg.Addressed {
+			return
+		}
+		// quota and notebooks belong to the sender
+		if msg.UserID == "" {
+			if err := m.Reply(msg, TextReply("Add me as a friend to look up words here.")); err != nil {
+				logger.Error("Failed to reply to an unknown sender", "err", err)
+			}
+			return
+		}
+		TouchLastSeen(msg.UserID)
+		if handleGroupCommand(m, msg) {
+			return
+		}
+	} else {
+		TouchLastSeen(msg.UserID)
+		if handleOnboardingAnswer(m, msg) || handleCommand(m, msg) {
+			return
+		}
+	}
+
+	// clean up the input
+	sanitizedText, isSanitized := IsEnglishSentence(RemoveExtraSpace(msg.Text))
+	if !isSanitized {
+		if err := m.Reply(msg,
+			TextReply("Don't use invalid characters. You can only use english, '.', ',' or space")); err != nil {
+			if err = m.Reply(msg,
+				TextReply("Sorry, we're under maintenance. Try it later.")); err != nil {
 			}
-		} else if _, err := bot.Client.ReplyMessage(event.ReplyToken,
-			linebot.NewImageMessage(presignedUrls[0], presignedUrls[0])).Do(); err != nil {
-			return errors.New("an error while replying images from LINE bot" + err.Error())
 		}
+		return
 	}
-	return nil
-}
 
-func recordUserMessage(event *linebot.Event, key string, id string) {
-	// save userId and messageId into s3
-	data := fmt.Sprintf(`{userId: %s, messageId: %s}`, event.Source.UserID, id)
-	SaveMessageIdsIntoS3(key, data)
+	// check if this word is already in the user's notebook.
+	entry, isRepeated := GetVocabEntry(msg.UserID, sanitizedText)
+	// an imported word may be waiting for its explanation
+	if isRepeated && entry.LookupCount == 0 && !ObjectExists(explanationKey(msg.UserID, sanitizedText)) {
+		isRepeated = false
+	}
+	if isRepeated {
+		logger.Debug("Looked up a repeated word")
+		explanationCache.WithLabelValues("hit").Inc()
+		// get past data from s3 to reply
+		if content, exists := GetMessage(explanationKey(msg.UserID, sanitizedText)); exists {
+
+			// send the image retrived from s3 to run efficiently
+			// and the past data retrived from s3 to save the cost of gpt.
+			// A reply can't be sent twice, so repeated same requests from LINE server get nothing
+			err := m.Reply(msg,
+				ImageReply(GeneratePresignedUrl(imageKey(msg.UserID, sanitizedText))),
+				TextReply(string(content)))
+			if err != nil {
+				logger.Error("Failed to reply a past post", "err", err)
+			} else {
+				if _, _, err = RecordLookup(msg.UserID, sanitizedText); err != nil {
+					logger.Error("Failed to update the notebook", "err", err)
+				}
+				RecordActivity(msg.UserID, func(activity *DailyActivity) {
+					activity.Lookups++
+				})
+				if msg.Group {
+					rememberGroupWord(msg, sanitizedText)
+				}
+			}
+
+		} else if err := m.Reply(msg,
+			TextReply("Sorry, we're in trouble. Wait a moment to recover.")); err != nil {
+			logger.Error("Internal server error while replying against repeated request", "err", err)
+		}
+		return
+	}
+
+	// add the word to the user's notebook
+	if _, _, err := RecordLookup(msg.UserID, sanitizedText); err != nil {
+		logger.Error("Failed to add a word to the notebook", "err", err)
+	}
+	// Check that this user already used three times
+	todaysCnt, err := CountTodaysLookups(msg.UserID)
+	if err != nil {
+		logger.Error("failed to check for this reason", "err", err)
+
+		// emergency reply
+		if err = m.Reply(msg,
+			TextReply("Sorry, we're under maintenance. Try it later.")); err != nil {
+			logger.Error("Failed to reply about a maximum limit warning", "err", err)
+		}
+		return
+	}
+	if todaysCnt >= dailyLookupLimit {
+		quotaRejections.Inc()
+		if err = m.Reply(msg,
+			TextReply(fmt.Sprintf("Free users are limited to up to %d requests per day! Please pay to extend the limit or wait until tomorrow or b", dailyLookupLimit))); err != nil {
+			logger.Error("Failed to reply about a maximum limit warning", "err", err)
+		}
+		return
+	}
+	logger.Debug("Counted today's lookups", "count", todaysCnt)
+
+	// ask openai of something
+	explanationCache.WithLabelValues("miss").Inc()
+	res, err := explain(msg.Context(), sanitizedText)
+	if err != nil || len(res.Choices) == 0 {
+		logger.Error("an error during gpt api", "err", err)
+		// delete the notebook entry because it has no reply
+		DeleteObject(vocabularyKey(msg.UserID, sanitizedText))
+		// Reply an error message to the user
+		if err := m.Reply(msg,
+			TextReply("Sorry, we're in trouble. Wait for recovery.")); err != nil {
+			logger.Error("an error while replying an error message from LINE bot", "err", err)
+		}
+		return
+	}
+
+	// Todo - send multiply for paid users
+	// get presigned urls for the platform to get an access to s3
+	imageUrl := "https://noimage.com"
+	if presignedUrls := findImages(msg.Context(), sanitizedText, 1, msg.UserID); len(presignedUrls) > 0 && presignedUrls[0] != "" {
+		imageUrl = presignedUrls[0]
+	}
+	// Send the picture and the crash course
+	if err = m.Reply(msg, ImageReply(imageUrl), TextReply(res.Choices[0].Messages.Content)); err != nil {
+		logger.Error("an error while replying texts from LINE bot", "err", err)
+	}
+	// save this replying data into s3
+	SaveMessageIdsIntoS3(explanationKey(msg.UserID, sanitizedText), res.Choices[0].Messages.Content)
+	// for the export, made after the reply
+	queuePronunciation(sanitizedText)
+	RecordActivity(msg.UserID, func(activity *DailyActivity) {
+		activity.Lookups++
+		activity.NewWords++
+	})
+	if msg.Group {
+		rememberGroupWord(msg, sanitizedText)
+	}
 }
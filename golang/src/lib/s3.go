@@ -6,7 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"strings"
@@ -17,102 +17,238 @@ import (
 	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/line/line-bot-sdk-go/linebot"
 )
 
-var bucket = "linenglish"
-
-// s3 region
-var awsRegion = "ap-northeast-1"
+// The bucket, region and credentials, from CreateSession
+var awsConfig = DefaultConfig().AWS
 
 var s3Client *s3.S3
 
-// take or begin to have power for role
-func assumeRole(roleArn, externalId string) (*sts.Credentials, error) {
-	sess := session.Must(session.NewSession())
-	stsClient := sts.New(sess)
+// Signs the URLs of objects; s3Client unless there is a public endpoint
+var s3Presigner *s3.S3
+
+// The session of s3Client, for the other AWS services like Secrets Manager
+var awsSession *session.Session
+
+// Create the session of the bucket. Its credentials are the static keys when
+// they're set, as in development, and otherwise the default chain of the SDK:
+// the environment, the shared config, web identity, the container or the
+// instance role. With IAM_ROLE_NAME the role is assumed with them, and the
+// SDK assumes it again before the credentials run out.
+func CreateSession(config AWSConfig) {
+	awsConfig = config
+	base := aws.Config{Region: aws.String(config.Region)}
+	if config.AccessKeyID != "" {
+		base.Credentials = credentials.NewStaticCredentials(config.AccessKeyID, config.SecretAccessKey, "")
+	}
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            base,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		slog.Error("Failed to create a new session", "err", err)
+		os.Exit(1)
+	}
+
+	awsRoleARN = ""
+	if config.RoleName != "" {
+		awsRoleARN = fmt.Sprintf("arn:aws:iam::%s:role/%s", config.RoleAccountID, config.RoleName)
+		creds := stscreds.NewCredentials(sess, awsRoleARN, func(p *stscreds.AssumeRoleProvider) {
+			p.RoleSessionName = config.RoleSessionName
+			if config.ExternalID != "" {
+				p.ExternalID = aws.String(config.ExternalID)
+			}
+			p.Duration = time.Hour
+			// renewed this long before they expire, so no request goes out with stale ones
+			p.ExpiryWindow = 5 * time.Minute
+		})
+		sess = sess.Copy(&aws.Config{Credentials: creds})
+	}
+	awsSession = sess
+	s3Client = s3.New(sess, s3EndpointConfig(config, config.Endpoint))
+	instrumentS3(s3Client)
+	s3Presigner = s3Client
+	if config.PublicEndpoint != "" {
+		s3Presigner = s3.New(sess, s3EndpointConfig(config, config.PublicEndpoint))
+	}
+
+	// tell about bad credentials now rather than on the first message; /readyz fails until they work
+	status := AWSCredentialStatus(context.Background())
+	if status.Error != "" {
+		slog.Error("Failed to get AWS credentials", "role", awsRoleARN, "err", status.Error)
+		return
+	}
+	slog.Info("Created the AWS session", "region", config.Region, "provider", status.Provider, "role", awsRoleARN)
+}
 
-	params := &sts.AssumeRoleInput{
-		RoleArn:         aws.String(roleArn),
-		RoleSessionName: aws.String("linenglish"),
-		ExternalId:      aws.String(externalId),
-		DurationSeconds: aws.Int64(3600),
+// The S3 client config for the endpoint. STS and Secrets Manager stay on AWS.
+func s3EndpointConfig(config AWSConfig, endpoint string) *aws.Config {
+	s3Config := &aws.Config{S3ForcePathStyle: aws.Bool(config.ForcePathStyle)}
+	if endpoint != "" {
+		s3Config.Endpoint = aws.String(endpoint)
 	}
+	return s3Config
+}
 
-	res, err := stsClient.AssumeRole(params)
+// The role the credentials are assumed for, if any
+var awsRoleARN string
+
+// Where the AWS credentials come from and when they expire, for /debug/status.
+type CredentialStatus struct {
+	Provider string `json:"provider,omitempty"`
+	Role     string `json:"role,omitempty"`
+	// Null for credentials that don't expire, like static keys
+	ExpiresAt *time.Time `json:"expiresAt"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// Get the credentials, assuming the role if they're due, and report on them.
+func AWSCredentialStatus(ctx context.Context) CredentialStatus {
+	status := CredentialStatus{Role: awsRoleARN}
+	if awsSession == nil {
+		status.Error = "no AWS session"
+		return status
+	}
+	creds := awsSession.Config.Credentials
+	value, err := creds.GetWithContext(ctx)
 	if err != nil {
-		return nil, err
+		status.Error = err.Error()
+		return status
+	}
+	status.Provider = value.ProviderName
+	if expiresAt, err := creds.ExpiresAt(); err == nil {
+		status.ExpiresAt = &expiresAt
 	}
+	return status
+}
 
-	return res.Credentials, nil
+// The S3 bucket behind ObjectStore, used in production.
+type s3Store struct{}
+
+// The bucket of CreateSession, e.g. to go back to it after SetObjectStore.
+func NewS3Store() ObjectStore {
+	return s3Store{}
 }
-func CreateSessionWithRole() {
-	roleName := os.Getenv("IAM_ROLE_NAME")
-	roleId := os.Getenv("IAM_ROLE_ID")
-	log.Println(roleName)
-	log.Println(roleId)
-	roleArn := fmt.Sprintf("arn:aws:iam::%s:role/%s", roleId, roleName)
-	externalID := "1234"
-
-	// Initially take a power for role.
-	creds, err := assumeRole(roleArn, externalID)
+
+func (s3Store) Get(key string) ([]byte, error) {
+	res, err := s3Client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(awsConfig.Bucket),
+		Key:    aws.String(key),
+	})
 	if err != nil {
-		log.Printf("Failed to assume role: %v\n", err)
-		return
+		return nil, err
 	}
+	defer res.Body.Close()
+	return io.ReadAll(res.Body)
+}
 
-	// create a temporary session
-	sess := session.Must(session.NewSession(&aws.Config{
-		Credentials: credentials.NewStaticCredentials(
-			*creds.AccessKeyId,
-			*creds.SecretAccessKey,
-			*creds.SessionToken,
-		),
-	}))
-	s3Client = s3.New(sess)
+func (s3Store) Put(key string, data []byte, contentType string) error {
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(awsConfig.Bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(data),
+	}
+	if contentType != "" {
+		input.ContentType = aws.String(contentType)
+	}
+	_, err := s3Client.PutObject(input)
+	return err
+}
 
-	// start a goroutine to refresh credentials periodically
-	go refreshCredentialsPeriodically(roleArn, externalID, sess)
+func (s3Store) Delete(key string) error {
+	// Delete the object
+	_, err := s3Client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(awsConfig.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return errors.New("failed to delete object: " + err.Error())
+	}
+
+	// Confirm if the object was deleted
+	err = s3Client.WaitUntilObjectNotExists(&s3.HeadObjectInput{
+		Bucket: aws.String(awsConfig.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return errors.New("failed to confirm object deletion: " + err.Error())
+	}
+	return nil
 }
 
-func refreshCredentialsPeriodically(roleArn, externalId string, sess *session.Session) {
-	for {
-		creds, err := assumeRole(roleArn, externalId)
+// Delete the objects a thousand at a time.
+func (s3Store) DeleteKeys(keys []string) error {
+	for start := 0; start < len(keys); start += 1000 {
+		end := start + 1000
+		if end > len(keys) {
+			end = len(keys)
+		}
+		var objKeys []*s3.ObjectIdentifier
+		for _, key := range keys[start:end] {
+			objKeys = append(objKeys, &s3.ObjectIdentifier{Key: aws.String(key)})
+		}
+		_, err := s3Client.DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket: aws.String(awsConfig.Bucket),
+			Delete: &s3.Delete{Objects: objKeys},
+		})
 		if err != nil {
-			log.Printf("Failed to assume role: %v\n", err)
-		} else {
-			exp := aws.TimeValue(creds.Expiration)
-			log.Printf("Assumed role successfully. Credentials expire at %v\n", exp)
-
-			// update session with new credentials
-			sess.Config.Credentials = stscreds.NewCredentials(sess, roleArn,
-				func(arp *stscreds.AssumeRoleProvider) {
-					arp.ExternalID = aws.String(externalId)
-				})
-			// leave s3client as it is
-
-			// Sleep for a duration before refreshing credentials again
-			sleepDuration := time.Until(exp.Add(-10 * time.Minute))
-			time.Sleep(sleepDuration)
+			return errors.New("failed to delete objects: " + err.Error())
 		}
 	}
+	return nil
 }
 
-func CreateSession() {
+// Check the object exists without downloading it.
+func (s3Store) Exists(key string) bool {
+	_, err := s3Client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(awsConfig.Bucket),
+		Key:    aws.String(key),
+	})
+	return err == nil
+}
 
-	creds := credentials.NewStaticCredentials(os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"), "")
+// List every object under the prefix, following continuation tokens.
+func (s3Store) List(prefix string) ([]*s3.Object, error) {
+	var objects []*s3.Object
+	err := s3Client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(awsConfig.Bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		objects = append(objects, page.Contents...)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
 
-	sess, err := session.NewSession(&aws.Config{
-		Credentials: creds,
-		Region:      aws.String("ap-northeast-1")},
-	)
+func (s3Store) ListPrefixes(prefix string) ([]string, error) {
+	var names []string
+	err := s3Client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket:    aws.String(awsConfig.Bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, p := range page.CommonPrefixes {
+			names = append(names, strings.TrimSuffix(strings.TrimPrefix(aws.StringValue(p.Prefix), prefix), "/"))
+		}
+		return true
+	})
 	if err != nil {
-		log.Fatal("Fail to create a new session")
+		return nil, err
 	}
-	s3Client = s3.New(sess)
-	log.Println("S3's connection works")
+	return names, nil
+}
 
+// A presigned URL for LINE server to get an access to the object
+func (s3Store) URL(key string) (string, error) {
+	req, _ := s3Presigner.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(awsConfig.Bucket),
+		Key:    aws.String(key),
+	})
+	return req.Presign(5 * time.Minute)
 }
 
 /*
@@ -122,34 +258,17 @@ func CreateSession() {
 	from LINE API.
 */
 func SaveMessageIdsIntoS3(key string, data string) {
-	// body := []byte(data)
-	body := strings.NewReader(data)
 	// Upload the text data to S3
-	_, err := s3Client.PutObject(&s3.PutObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
-		Body:   aws.ReadSeekCloser(body),
-	})
-	if err != nil {
-		log.Println("Failed to upload text data to S3", err)
+	if err := store.Put(key, []byte(data), ""); err != nil {
+		slog.Error("Failed to upload text data to S3", "err", err)
 	}
 }
 
 // To check if the data is already on s3.
 func GetMessage(key string) ([]byte, bool) {
-	res, err := s3Client.GetObject(&s3.GetObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
-	})
-
+	content, err := store.Get(key)
 	if err != nil {
-		log.Println("failed to read object content: " + err.Error())
-		return nil, false
-	}
-	// Read object content
-	content, err := io.ReadAll(res.Body)
-	if err != nil {
-		log.Println("failed to parse data from s3: " + err.Error())
+		slog.Error("failed to read object content", "err", err)
 		return nil, false
 	}
 	return content, true
@@ -169,103 +288,55 @@ func UploadImageFromMessageToS3(bot *linebot.Client, key string, message *linebo
 	}
 
 	// Upload image to S3
-	_, err = s3Client.PutObject(&s3.PutObjectInput{
-		Bucket:        aws.String(bucket),
-		Key:           aws.String(key),
-		Body:          bytes.NewReader(imageBytes),
-		ContentType:   aws.String(http.DetectContentType(imageBytes)),
-		ContentLength: aws.Int64(int64(len(imageBytes))),
-		// ACL:           aws.String("public-read"),
-	})
+	return store.Put(key, imageBytes, http.DetectContentType(imageBytes))
+}
+
+func UploadImage(ctx context.Context, url string, key string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return err
 	}
-
-	return nil
-}
-
-func UploadImage(url string, key string) error {
-	resp, err := http.Get(url)
+	resp, err := scraperDownload.Do(req)
 	if err != nil {
-		log.Println("Error downloading image:", err)
+		slog.Error("Error downloading image", "err", err)
 		return err
 	}
 	defer resp.Body.Close()
 
 	imageData, err := io.ReadAll(resp.Body)
 	if err != nil {
-		log.Println("Error reading image data:", err)
+		slog.Error("Error reading image data", "err", err)
 		return err
 	}
 
 	// filename := strings.Split(url, "/")
 	// key := keyword + "/" + filename[len(filename)-1]
 
-	log.Println("upload image")
-	_, err = s3Client.PutObject(&s3.PutObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
-		Body:   bytes.NewReader(imageData),
-	})
-	if err != nil {
-		log.Println("an error uploading image picked up to S3")
+	if err = store.Put(key, imageData, ""); err != nil {
+		slog.Error("an error uploading image picked up to S3", "err", err)
 	}
 
-	log.Println("after uploading")
 	return nil
 }
 
 func DeleteAll() {
-
-	// Call the ListObjectsV2 API to get a list of all objects in the bucket
-	res, err := s3Client.ListObjectsV2(&s3.ListObjectsV2Input{
-		Bucket: aws.String(bucket),
-	})
-
-	// Create a slice to store object keys
-	var objKeys []*s3.ObjectIdentifier
-
-	for _, obj := range res.Contents {
-		objKeys = append(objKeys, &s3.ObjectIdentifier{
-			Key: obj.Key,
-		})
+	// Get a list of all objects in the bucket
+	objects, err := store.List("")
+	if err != nil {
+		slog.Error("failed to list objects")
+		return
 	}
-
-	if len(objKeys) == 0 {
-		log.Println("no objects found in bucket")
+	if len(objects) == 0 {
+		slog.Info("no objects found in bucket")
 	}
-	_, err = s3Client.DeleteObjects(&s3.DeleteObjectsInput{
-		Bucket: aws.String(bucket),
-		Delete: &s3.Delete{
-			Objects: objKeys,
-		},
-	})
-	if err != nil {
-		log.Println("failed to delete obs")
+	if err = DeletePrefix(""); err != nil {
+		slog.Error("failed to delete obs")
 	}
 
 }
 
 func DeleteObject(key string) error {
-	// Delete the object
-	_, err := s3Client.DeleteObject(&s3.DeleteObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
-	})
-	if err != nil {
-		return errors.New("failed to delete object: " + err.Error())
-	}
-
-	// Confirm if the object was deleted
-	err = s3Client.WaitUntilObjectNotExists(&s3.HeadObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
-	})
-	if err != nil {
-		return errors.New("failed to confirm object deletion: " + err.Error())
-	}
-
-	return nil
+	return store.Delete(key)
 }
 
 // check if this user already used this system three times
@@ -274,20 +345,14 @@ func CheckThreeTimes(prefix string) (int, error) {
 	today := time.Now().Truncate(24 * time.Hour)
 	// endTime := startTime.Add(24 * time.Hour)
 
-	res, err := s3Client.ListObjectsV2(&s3.ListObjectsV2Input{
-		Bucket: aws.String(bucket),
-		Prefix: aws.String(prefix),
-	})
+	objects, err := store.List(prefix)
 	if err != nil {
 		return 0, err
 	}
-	// todaysObjects := make([]*s3.Object, 0)
 	todaysCnt := 0
-	for _, object := range res.Contents {
+	for _, object := range objects {
 		if object.LastModified.After(today) {
-			// todaysObjects = append(todaysObjects, object)
 			todaysCnt++
-			// log.Println(aws.StringValue(object.Key))
 		}
 	}
 
@@ -296,17 +361,56 @@ func CheckThreeTimes(prefix string) (int, error) {
 
 func GeneratePresignedUrl(key string) string {
 	// Generate a presigned URL for the image
-	req, _ := s3Client.GetObjectRequest(&s3.GetObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
-	})
-
-	url, err := req.Presign(5 * time.Minute)
+	url, err := store.URL(key)
 	if err != nil {
-		log.Println("Failed to generate presigned URL", err)
+		slog.Error("Failed to generate presigned URL", "err", err)
 		return ""
 	}
 
-	log.Println("presigned url: " + url)
 	return url
 }
+
+// List every object under the prefix.
+func ListObjects(prefix string) ([]*s3.Object, error) {
+	return store.List(prefix)
+}
+
+// Save arbitrary bytes with a content type, reporting failures to the caller.
+func SaveObject(key string, data []byte, contentType string) error {
+	if err := store.Put(key, data, contentType); err != nil {
+		return errors.New("failed to save object: " + err.Error())
+	}
+	return nil
+}
+
+// Copy the object to another key, with the content type guessed from the data.
+func copyObject(from string, to string) error {
+	data, err := store.Get(from)
+	if err != nil {
+		return err
+	}
+	return store.Put(to, data, http.DetectContentType(data))
+}
+
+// Check the object exists without downloading it.
+func ObjectExists(key string) bool {
+	return store.Exists(key)
+}
+
+// List the IDs of the users who have any data under users/.
+func ListUserIDs() ([]string, error) {
+	return store.ListPrefixes("users/")
+}
+
+// Delete every object under the prefix.
+func DeletePrefix(prefix string) error {
+	objects, err := ListObjects(prefix)
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(objects))
+	for _, object := range objects {
+		keys = append(keys, aws.StringValue(object.Key))
+	}
+	return store.DeleteKeys(keys)
+}
@@ -0,0 +1,322 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Schedule tells when a job runs next.
+type Schedule interface {
+	Next(after time.Time) time.Time
+}
+
+type interval time.Duration
+
+// Every runs a job at a fixed interval counted from the previous run.
+func Every(d time.Duration) Schedule {
+	return interval(d)
+}
+
+func (i interval) Next(after time.Time) time.Time {
+	return after.Add(time.Duration(i))
+}
+
+// A standard five field cron spec: minute hour day-of-month month day-of-week.
+// Fields take "*", numbers, ranges "1-5", lists "1,3" and steps "*/15".
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	domAny, dowAny                bool
+	loc                           *time.Location
+}
+
+var cronBounds = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6}}
+
+// Cron parses a spec evaluated in the given location, or in local time when loc is nil.
+func Cron(spec string, loc *time.Location) (Schedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron spec %q must have 5 fields", spec)
+	}
+	if loc == nil {
+		loc = time.Local
+	}
+
+	var bits [5]uint64
+	for i, field := range fields {
+		b, err := parseCronField(field, cronBounds[i][0], cronBounds[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("cron spec %q: %v", spec, err)
+		}
+		bits[i] = b
+	}
+	return &cronSchedule{
+		minute: bits[0], hour: bits[1], dom: bits[2], month: bits[3], dow: bits[4],
+		domAny: fields[2] == "*", dowAny: fields[4] == "*",
+		loc: loc,
+	}, nil
+}
+
+// MustCron is Cron for specs written in the code.
+func MustCron(spec string, loc *time.Location) Schedule {
+	s, err := Cron(spec, loc)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("bad step in %q", part)
+			}
+			step = n
+			part = part[:i]
+		}
+
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("bad value %q", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("bad range %q", part)
+				}
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (s *cronSchedule) Next(after time.Time) time.Time {
+	t := after.In(s.loc).Truncate(time.Minute).Add(time.Minute)
+	// give up after a few years, the spec can't match (e.g. Feb 30th)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, s.loc)
+		case !s.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, s.loc)
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, s.loc)
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// Like cron, when both day fields are restricted either of them may match.
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domAny || s.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Job is a named piece of periodic work.
+type Job struct {
+	Name     string
+	Schedule Schedule
+	// Each run is delayed by a random duration up to Jitter.
+	Jitter time.Duration
+	// Run the job once as soon as the scheduler starts.
+	RunOnStart bool
+	Run        func(ctx context.Context) error
+}
+
+// JobStatus is what the scheduler knows about a job.
+type JobStatus struct {
+	Name      string    `json:"name"`
+	Running   bool      `json:"running"`
+	Runs      int       `json:"runs"`
+	Failures  int       `json:"failures"`
+	Skipped   int       `json:"skipped"`
+	LastStart time.Time `json:"lastStart"`
+	LastEnd   time.Time `json:"lastEnd"`
+	LastError string    `json:"lastError,omitempty"`
+	Next      time.Time `json:"next"`
+}
+
+type scheduledJob struct {
+	Job
+	mu     sync.Mutex
+	status JobStatus
+}
+
+// Scheduler runs jobs on their schedules until it is stopped.
+// A run is skipped while the previous run of the same job is still going.
+type Scheduler struct {
+	clock   Clock
+	mu      sync.Mutex
+	jobs    []*scheduledJob
+	started bool
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+// NewScheduler uses the real clock when clock is nil.
+func NewScheduler(clock Clock) *Scheduler {
+	if clock == nil {
+		clock = realClock{}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Scheduler{clock: clock, ctx: ctx, cancel: cancel}
+}
+
+func (s *Scheduler) Add(job Job) error {
+	if job.Name == "" || job.Schedule == nil || job.Run == nil {
+		return errors.New("a job needs a name, a schedule and a function to run")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, j := range s.jobs {
+		if j.Name == job.Name {
+			return fmt.Errorf("job %q is already scheduled", job.Name)
+		}
+	}
+	j := &scheduledJob{Job: job, status: JobStatus{Name: job.Name}}
+	s.jobs = append(s.jobs, j)
+	if s.started {
+		s.wg.Add(1)
+		go s.loop(j)
+	}
+	return nil
+}
+
+func (s *Scheduler) Start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started {
+		return
+	}
+	s.started = true
+	for _, j := range s.jobs {
+		s.wg.Add(1)
+		go s.loop(j)
+	}
+}
+
+// Stop cancels the jobs and waits for the running ones until ctx is done.
+func (s *Scheduler) Stop(ctx context.Context) error {
+	s.cancel()
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Scheduler) Status() []JobStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	statuses := make([]JobStatus, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		j.mu.Lock()
+		statuses = append(statuses, j.status)
+		j.mu.Unlock()
+	}
+	return statuses
+}
+
+func (s *Scheduler) loop(j *scheduledJob) {
+	defer s.wg.Done()
+	if j.RunOnStart {
+		s.trigger(j)
+	}
+	for {
+		now := s.clock.Now()
+		next := j.Schedule.Next(now)
+		if next.IsZero() {
+			slog.Warn("job has no next run", "job", j.Name)
+			return
+		}
+		if j.Jitter > 0 {
+			next = next.Add(time.Duration(rand.Int63n(int64(j.Jitter))))
+		}
+		j.mu.Lock()
+		j.status.Next = next
+		j.mu.Unlock()
+
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-s.clock.After(next.Sub(now)):
+			s.trigger(j)
+		}
+	}
+}
+
+func (s *Scheduler) trigger(j *scheduledJob) {
+	j.mu.Lock()
+	if j.status.Running {
+		j.status.Skipped++
+		j.mu.Unlock()
+		slog.Warn("job is still running, skipped this run", "job", j.Name)
+		return
+	}
+	j.status.Running = true
+	j.status.LastStart = s.clock.Now()
+	j.mu.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		err := runJob(s.ctx, j)
+
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		j.status.Running = false
+		j.status.LastEnd = s.clock.Now()
+		j.status.Runs++
+		j.status.LastError = ""
+		if err != nil {
+			j.status.Failures++
+			j.status.LastError = err.Error()
+			slog.Error("job failed", "job", j.Name, "err", err)
+		}
+	}()
+}
+
+// A panicking job is reported as a failure instead of taking the server down.
+func runJob(ctx context.Context, j *scheduledJob) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return j.Run(ctx)
+}
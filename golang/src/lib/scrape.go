@@ -1,8 +1,13 @@
 package lib
 
 import (
-	"fmt"
-	"log"
+	"bytes"
+	"context"
+	"image"
+	"image/draw"
+	"image/png"
+	"log/slog"
+	"net/http"
 	"strings"
 
 	// "github.com/aws/aws-sdk-go/aws"
@@ -10,9 +15,46 @@ import (
 	"github.com/gocolly/colly/v2"
 )
 
-func ScrapeImages(keyword string, desiredNumImages int, userId string) []string {
+// How the bot finds pictures. The console can swap it for PlaceholderImages.
+var findImages = ScrapeImages
+
+func SetImageFinder(f func(ctx context.Context, keyword string, desiredNumImages int, userId string) []string) {
+	findImages = f
+}
+
+// Draw a card with the keyword instead of searching the web, to try the bot offline.
+func PlaceholderImages(ctx context.Context, keyword string, desiredNumImages int, userId string) []string {
+	img := image.NewRGBA(image.Rect(0, 0, 600, 400))
+	draw.Draw(img, img.Bounds(), &image.Uniform{menuBlue}, image.Point{}, draw.Src)
+	drawLabel(img, img.Bounds(), keyword)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		slog.Error("an error while drawing a placeholder", "err", err)
+		return nil
+	}
+	key := imageKey(userId, keyword)
+	if err := SaveObject(key, buf.Bytes(), "image/png"); err != nil {
+		slog.Error("an error while uploading", "err", err)
+		return nil
+	}
+	return []string{GeneratePresignedUrl(key)}
+}
+
+var (
+	// colly can't pass a context on, so the search has metrics but no span of its own
+	scraperSearch = &metricsTransport{dependency: "scraper", operation: fixedOperation("search"), next: http.DefaultTransport}
+	// images are downloaded from anywhere on the web
+	scraperDownload = dependencyClient("scraper", fixedOperation("download"))
+)
+
+func ScrapeImages(ctx context.Context, keyword string, desiredNumImages int, userId string) []string {
+	ctx, span := tracer.Start(ctx, "ScrapeImages")
+	defer span.End()
+
 	// Create a collector
 	c := colly.NewCollector()
+	c.WithTransport(scraperSearch)
 
 	// Counter to keep track of the number of images
 	imgCounter := 0
@@ -31,12 +73,12 @@ func ScrapeImages(keyword string, desiredNumImages int, userId string) []string
 
 		imgURL := e.Attr("src")
 		if strings.HasPrefix(imgURL, "http") {
-			log.Println("Found image URL:", imgURL)
+			slog.Debug("Found an image", "keyword", keyword)
 			// the name of picture is used as the name of this object
-			key := fmt.Sprintf("bots/users/%s/images/%s", userId, keyword)
-			err := UploadImage(imgURL, key)
+			key := imageKey(userId, keyword)
+			err := UploadImage(ctx, imgURL, key)
 			if err != nil {
-				log.Println("an error while uploading: " + err.Error())
+				slog.Error("an error while uploading", "err", err)
 				// comprehesiveErr = err
 			}
 
@@ -54,7 +96,7 @@ func ScrapeImages(keyword string, desiredNumImages int, userId string) []string
 
 	// Set up error handling
 	c.OnError(func(r *colly.Response, err error) {
-		log.Println("Request URL:", r.Request.URL, "failed with response:", r, "\nError:", err)
+		slog.Error("Failed to scrape images", "status", r.StatusCode, "err", err)
 	})
 
 	// Send an HTTP request to Google Images
@@ -62,7 +104,7 @@ func ScrapeImages(keyword string, desiredNumImages int, userId string) []string
 	escapedKeyword += "+meaning"
 	err := c.Visit("https://www.google.com/search?q=" + escapedKeyword + "&tbm=isch")
 	if err != nil {
-		log.Println("Error visiting URL:", err)
+		slog.Error("Error visiting URL", "err", err)
 	}
 
 	return presignedUrls
@@ -0,0 +1,129 @@
+package lib
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// Show and change the preferences:
+//
+//	settings                        show the profile with quick replies
+//	settings <level|goals|timezone|language> [value]
+//	settings report <on|off>        the weekly progress report
+//	settings wotd <on|off>          the word of the day
+func handleSettingsCommand(m Messenger, msg *IncomingMessage) bool {
+	fields := strings.Fields(strings.TrimSpace(msg.Text))
+	if len(fields) == 0 || !strings.EqualFold(fields[0], "settings") {
+		return false
+	}
+
+	var reply OutgoingReply
+	_, err := UpdateProfile(msg.UserID, func(profile *UserProfile, exists bool) bool {
+		if len(fields) == 1 {
+			reply = settingsSummary(profile)
+			return true
+		}
+		name := strings.ToLower(fields[1])
+		value := strings.Join(fields[2:], " ")
+		switch {
+		case name == "report" || name == "wotd":
+			reply = TextReply(changeNotification(profile, name, strings.ToLower(value)))
+		case onboardingStepIndex(name) >= 0:
+			step := onboardingSteps[onboardingStepIndex(name)]
+			if value == "" || !step.apply(profile, value) {
+				reply = onboardingQuestion(step, "settings "+name+" ")
+				break
+			}
+			reply = TextReply(fmt.Sprintf("Updated your %s to %s.", name, value))
+		default:
+			reply = settingsSummary(profile)
+		}
+		return true
+	})
+	if err != nil {
+		msg.Logger().Error("failed to save a profile", "err", err)
+		reply = TextReply("Sorry, we're under maintenance. Try it later.")
+	}
+	if err := m.Reply(msg, reply); err != nil {
+		msg.Logger().Error("Failed to reply the settings", "err", err)
+	}
+	return true
+}
+
+func changeNotification(profile *UserProfile, name string, value string) string {
+	if value != "on" && value != "off" {
+		return fmt.Sprintf("Send \"settings %s on\" or \"settings %s off\".", name, name)
+	}
+	on := value == "on"
+
+	if name == "report" {
+		profile.Notifications.WeeklyReport = on
+		return "Weekly report: " + value
+	}
+
+	sub, exists := GetWotdSubscription(profile.UserID)
+	if !exists {
+		sub = &WotdSubscription{UserID: profile.UserID}
+	}
+	sub.OptOut = !on
+	if on && sub.Segment == "" {
+		// start with the words of the user's level when there is a segment for it
+		sub.Segment = "b1"
+		if findWotdSegment(strings.ToLower(profile.Level)) != nil {
+			sub.Segment = strings.ToLower(profile.Level)
+		}
+	}
+	if err := SaveWotdSubscription(sub); err != nil {
+		slog.Error("failed to save a word of the day subscription", "err", err)
+		return "Sorry, we're under maintenance. Try it later."
+	}
+	if on {
+		return fmt.Sprintf("Word of the day: on (%s). Send \"wotd\" to change the list.", sub.Segment)
+	}
+	return "Word of the day: off"
+}
+
+func settingsSummary(profile *UserProfile) OutgoingReply {
+	wotd := "off"
+	if sub, exists := GetWotdSubscription(profile.UserID); exists && !sub.OptOut {
+		wotd = "on (" + sub.Segment + ")"
+	}
+	report := "off"
+	if profile.Notifications.WeeklyReport {
+		report = "on"
+	}
+	orNone := func(s string) string {
+		if s == "" {
+			return "-"
+		}
+		return s
+	}
+
+	summary := strings.Join([]string{
+		"Your settings",
+		"Level: " + orNone(profile.Level),
+		"Goals: " + orNone(profile.Goals),
+		"Timezone: " + orNone(profile.Timezone),
+		"Native language: " + orNone(profile.NativeLanguage),
+		"Plan: " + profile.Plan,
+		"Weekly report: " + report,
+		"Word of the day: " + wotd,
+	}, "\n")
+
+	toggle := func(label string, name string, on bool) QuickReply {
+		value := "on"
+		if on {
+			value = "off"
+		}
+		return QuickReply{Label: label + " " + value, Text: "settings " + name + " " + value}
+	}
+	return TextReply(summary).WithQuickReplies(
+		QuickReply{Label: "Level", Text: "settings level"},
+		QuickReply{Label: "Goals", Text: "settings goals"},
+		QuickReply{Label: "Timezone", Text: "settings timezone"},
+		QuickReply{Label: "Language", Text: "settings language"},
+		toggle("Report", "report", profile.Notifications.WeeklyReport),
+		toggle("Word of the day", "wotd", wotd != "off"),
+	)
+}
@@ -0,0 +1,71 @@
+package lib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"strings"
+)
+
+// The words and sentences users send end up in keys. A key holds a readable
+// slug of the text and a hash of it as sent, so "Take off!" is stored as
+// take-off-<hash>: no spaces or punctuation, a bounded length, and texts
+// that slug alike still get keys of their own. The text itself is kept in
+// the notebook entry of the word, the keys are never read back as words.
+
+// Longer texts are cut; the hash tells them apart
+const maxSlugLength = 48
+
+// The hex digits of the hash in a key
+const textHashLength = 12
+
+func textKey(text string) string {
+	sum := sha256.Sum256([]byte(text))
+	hash := hex.EncodeToString(sum[:])[:textHashLength]
+	if slug := slugify(text); slug != "" {
+		return slug + "-" + hash
+	}
+	return hash
+}
+
+// Lowercase ASCII letters and digits, with a dash for every run of anything else.
+func slugify(text string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(text) {
+		if ('a' <= r && r <= 'z') || ('0' <= r && r <= '9') {
+			if dash && b.Len() > 0 {
+				if b.Len()+2 > maxSlugLength {
+					break
+				}
+				b.WriteByte('-')
+			}
+			dash = false
+			b.WriteRune(r)
+			if b.Len() == maxSlugLength {
+				break
+			}
+		} else {
+			dash = true
+		}
+	}
+	return b.String()
+}
+
+var textKeyPattern = regexp.MustCompile(`^([a-z0-9]+(-[a-z0-9]+)*-)?[0-9a-f]{12}$`)
+
+// Whether the name is a textKey rather than a raw text of the old layout.
+func isTextKey(name string) bool {
+	return textKeyPattern.MatchString(name)
+}
+
+// The slug part of a textKey, and whether a search can go by it: one of a
+// text without ASCII letters is empty and a cut one fills maxSlugLength, or
+// all but the dash before the next letter.
+func textKeySlug(name string) (string, bool) {
+	if len(name) <= textHashLength {
+		return "", false
+	}
+	slug := name[:len(name)-textHashLength-1]
+	return slug, len(slug) < maxSlugLength-1
+}
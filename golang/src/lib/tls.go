@@ -0,0 +1,174 @@
+package lib
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// How the bot takes HTTPS:
+//   - files: a certificate and key from files, reloaded when they change, e.g. after certbot renews them
+//   - autocert: certificates from Let's Encrypt for the domains, cached in a directory
+//   - proxy: plain HTTP behind a reverse proxy that ends TLS, see SetTrustedProxies
+//   - off: plain HTTP, for development
+const (
+	TLSFiles    = "files"
+	TLSAutocert = "autocert"
+	TLSProxy    = "proxy"
+	TLSOff      = "off"
+)
+
+type TLSOptions struct {
+	Mode string `json:"mode" env:"TLS_MODE"`
+
+	CertFile string `json:"certFile" env:"TLS_CERT_FILE"`
+	KeyFile  string `json:"keyFile" env:"TLS_KEY_FILE"`
+	// How often the files are checked for a change; 10 seconds when zero
+	ReloadInterval time.Duration `json:"-"`
+
+	Domains  []string `json:"domains" env:"TLS_DOMAINS"`
+	CacheDir string   `json:"cacheDir" env:"TLS_CACHE_DIR"`
+	// Let's Encrypt writes to it about expiring certificates
+	Email string `json:"email" env:"TLS_EMAIL"`
+
+	// With the proxy mode, see SetTrustedProxies
+	TrustedProxies []string `json:"trustedProxies" env:"TRUSTED_PROXIES"`
+}
+
+// The TLS config of the server for the options, nil when it serves plain HTTP.
+// With autocert the handler answers the HTTP-01 challenges on port 80 and
+// redirects the rest to HTTPS; it is nil otherwise.
+func ServerTLSConfig(options TLSOptions) (*tls.Config, http.Handler, error) {
+	switch options.Mode {
+	case "", TLSOff, TLSProxy:
+		return nil, nil, nil
+
+	case TLSFiles:
+		if options.CertFile == "" || options.KeyFile == "" {
+			return nil, nil, errors.New("TLS from files needs a certificate file and a key file")
+		}
+		interval := options.ReloadInterval
+		if interval == 0 {
+			interval = 10 * time.Second
+		}
+		reloader, err := newCertReloader(options.CertFile, options.KeyFile, interval)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: reloader.GetCertificate,
+		}, nil, nil
+
+	case TLSAutocert:
+		if len(options.Domains) == 0 {
+			return nil, nil, errors.New("autocert needs the domains to get certificates for")
+		}
+		cacheDir := options.CacheDir
+		if cacheDir == "" {
+			cacheDir = "autocert-cache"
+		}
+		if err := os.MkdirAll(cacheDir, 0o700); err != nil {
+			return nil, nil, err
+		}
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(options.Domains...),
+			Cache:      autocert.DirCache(cacheDir),
+			Email:      options.Email,
+		}
+		config := manager.TLSConfig()
+		config.MinVersion = tls.VersionTLS12
+		return config, manager.HTTPHandler(nil), nil
+	}
+	return nil, nil, fmt.Errorf("unknown TLS mode %q", options.Mode)
+}
+
+// Serves the certificate in the files, loading it again once they change.
+// A pair that fails to load, e.g. while it's being written, is tried again
+// on the next check and the previous certificate is kept until then.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	interval time.Duration
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func newCertReloader(certFile string, keyFile string, interval time.Duration) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile, interval: interval}
+	modTime, err := r.lastModified()
+	if err != nil {
+		return nil, err
+	}
+	if err = r.load(modTime); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) lastModified() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (r *certReloader) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert = &cert
+	r.modTime = modTime
+	r.checked = time.Now()
+	return nil
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.checked) < r.interval {
+		return r.cert, nil
+	}
+	r.checked = time.Now()
+	modTime, err := r.lastModified()
+	if err != nil {
+		slog.Error("Failed to check the certificate files", "err", err)
+		return r.cert, nil
+	}
+	if modTime.After(r.modTime) {
+		if err = r.load(modTime); err != nil {
+			slog.Error("Failed to reload the certificate", "err", err)
+		} else {
+			slog.Info("Reloaded the certificate", "file", r.certFile)
+		}
+	}
+	return r.cert, nil
+}
+
+// The reverse proxies whose X-Forwarded-For and X-Real-IP headers are
+// believed, as IPs or CIDRs. With none the client IP is the address of the
+// connection. Call it before NewRouter.
+var trustedProxies []string
+
+func SetTrustedProxies(proxies []string) {
+	trustedProxies = proxies
+}
@@ -0,0 +1,117 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync/atomic"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/embedded"
+)
+
+// Traces follow a webhook through the queue to the worker and the calls it
+// makes, so a slow reply shows where the time went. Until SetupTracing or
+// SetTracerProvider is called spans go to the global provider.
+const tracerName = "github.com/di-th-hm-ms/AI-English/lib"
+
+var tracer = libTracerProvider{}.Tracer(tracerName)
+
+type tracerProviderBox struct {
+	trace.TracerProvider
+}
+
+var tracerProvider atomic.Pointer[tracerProviderBox]
+
+// Send the spans of the bot to the provider; nil is the global one again.
+func SetTracerProvider(p trace.TracerProvider) {
+	if p == nil {
+		tracerProvider.Store(nil)
+		return
+	}
+	tracerProvider.Store(&tracerProviderBox{p})
+}
+
+func currentTracerProvider() trace.TracerProvider {
+	if box := tracerProvider.Load(); box != nil {
+		return box.TracerProvider
+	}
+	return otel.GetTracerProvider()
+}
+
+// Looks the provider up for every span, so the clients and the middleware
+// made when the package loads follow SetTracerProvider too.
+type libTracerProvider struct {
+	embedded.TracerProvider
+}
+
+func (libTracerProvider) Tracer(name string, options ...trace.TracerOption) trace.Tracer {
+	return libTracer{name: name, options: options}
+}
+
+type libTracer struct {
+	embedded.Tracer
+	name    string
+	options []trace.TracerOption
+}
+
+func (t libTracer) Start(ctx context.Context, spanName string, options ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return currentTracerProvider().Tracer(t.name, t.options...).Start(ctx, spanName, options...)
+}
+
+// Export spans with the exporter (OTEL_TRACES_EXPORTER): "otlp" sends them
+// over HTTP to a collector, localhost:4318 unless OTEL_EXPORTER_OTLP_ENDPOINT
+// says otherwise, "stdout" or "console" prints them and "none" turns tracing off.
+// The returned function flushes the spans left on shutdown.
+func SetupTracing(ctx context.Context, exporterName string) (func(context.Context) error, error) {
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch exporterName {
+	case "", "otlp":
+		exporter, err = otlptracehttp.New(ctx)
+	case "stdout", "console":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case "none":
+		return func(context.Context) error { return nil }, nil
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", exporterName)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the defaults
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", "ai-english")),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK())
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
+
+// End a span, marking it failed when err isn't nil.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,379 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+/*
+Vocabulary notebook schema.
+
+Every word a user looks up is stored as one JSON object:
+
+	users/<userId>/vocabulary/<key>.json
+
+	{
+	  "word":        "take off",
+	  "firstSeen":   "2023-05-01T09:00:00Z",
+	  "lastSeen":    "2023-05-03T21:14:00Z",
+	  "lookupCount": 3,
+	  "tags":        ["toeic"],
+	  "mastery":     0
+	}
+
+<key> is the textKey of the word, a slug and a hash like take-off-1f0c93c2d1a4,
+and the entry is the record of the word as the user sent it. The
+explanation generated for the word is kept separately under
+bots/users/<userId>/messages/<key> and its picture under
+bots/users/<userId>/images/<key>, so deleting a word removes all three.
+Data from before the keys were encoded is moved by cmd/migratekeys.
+The object's LastModified is the "last touched" time, used to order the
+notebook. Words imported from a word list have a zero lastSeen and
+lookupCount until the user looks them up, so they don't count towards the
+daily quota.
+
+Before the notebook, a lookup was only recorded as
+users/<userId>/messages/<word>, holding the ID of the message. Until
+cmd/migratekeys has turned them into entries, they are read as words looked
+up once, when the object was last written, and saving such an entry moves it.
+*/
+
+// Mastery ranges from MasteryNew to MasteryMax.
+const (
+	MasteryNew = 0
+	MasteryMax = 5
+)
+
+type VocabEntry struct {
+	Word        string    `json:"word"`
+	FirstSeen   time.Time `json:"firstSeen"`
+	LastSeen    time.Time `json:"lastSeen"`
+	LookupCount int       `json:"lookupCount"`
+	Tags        []string  `json:"tags"`
+	Mastery     int       `json:"mastery"`
+
+	// read from users/<userId>/messages/
+	legacy bool
+}
+
+// A page of a user's notebook, newest first.
+type VocabPage struct {
+	Entries []*VocabEntry
+	Page    int
+	HasNext bool
+}
+
+func vocabularyPrefix(userId string) string {
+	return fmt.Sprintf("users/%s/vocabulary/", userId)
+}
+
+func vocabularyKey(userId string, word string) string {
+	return vocabularyPrefix(userId) + textKey(word) + ".json"
+}
+
+func explanationPrefix(userId string) string {
+	return fmt.Sprintf("bots/users/%s/messages/", userId)
+}
+
+func explanationKey(userId string, word string) string {
+	return explanationPrefix(userId) + textKey(word)
+}
+
+func imagePrefix(userId string) string {
+	return fmt.Sprintf("bots/users/%s/images/", userId)
+}
+
+func imageKey(userId string, word string) string {
+	return imagePrefix(userId) + textKey(word)
+}
+
+func legacyVocabularyPrefix(userId string) string {
+	return fmt.Sprintf("users/%s/messages/", userId)
+}
+
+// Get the notebook entry of the word if the user has looked it up before.
+func GetVocabEntry(userId string, word string) (*VocabEntry, bool) {
+	if entry, exists := getVocabEntry(vocabularyKey(userId, word)); exists {
+		return entry, true
+	}
+	return getLegacyVocabEntry(userId, word)
+}
+
+func getVocabEntry(key string) (*VocabEntry, bool) {
+	content, exists := GetMessage(key)
+	if !exists {
+		return nil, false
+	}
+	var entry VocabEntry
+	if err := json.Unmarshal(content, &entry); err != nil {
+		return nil, false
+	}
+	return &entry, true
+}
+
+func SaveVocabEntry(userId string, entry *VocabEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err = SaveObject(vocabularyKey(userId, entry.Word), data, "application/json"); err != nil {
+		return err
+	}
+	if entry.legacy {
+		entry.legacy = false
+		return DeleteObject(legacyVocabularyPrefix(userId) + entry.Word)
+	}
+	return nil
+}
+
+// The lookup recorded under the word before the notebook.
+func getLegacyVocabEntry(userId string, word string) (*VocabEntry, bool) {
+	key := legacyVocabularyPrefix(userId) + word
+	// listed rather than read for the LastModified; words starting with this one are listed too
+	objects, err := ListObjects(key)
+	if err != nil {
+		return nil, false
+	}
+	for _, object := range objects {
+		if aws.StringValue(object.Key) == key {
+			return legacyVocabEntry(word, aws.TimeValue(object.LastModified)), true
+		}
+	}
+	return nil, false
+}
+
+func legacyVocabEntry(word string, modified time.Time) *VocabEntry {
+	return &VocabEntry{
+		Word:        word,
+		FirstSeen:   modified,
+		LastSeen:    modified,
+		LookupCount: 1,
+		Tags:        []string{},
+		Mastery:     MasteryNew,
+		legacy:      true,
+	}
+}
+
+// The lookups recorded before the notebook, except the words the notebook
+// objects hold already.
+func legacyVocabulary(userId string, notebook []*s3.Object) ([]*VocabEntry, error) {
+	prefix := legacyVocabularyPrefix(userId)
+	objects, err := ListObjects(prefix)
+	if err != nil || len(objects) == 0 {
+		return nil, err
+	}
+	known := make(map[string]bool, len(notebook))
+	for _, object := range notebook {
+		known[aws.StringValue(object.Key)] = true
+	}
+	var entries []*VocabEntry
+	for _, object := range objects {
+		word := strings.TrimPrefix(aws.StringValue(object.Key), prefix)
+		if !known[vocabularyKey(userId, word)] {
+			entries = append(entries, legacyVocabEntry(word, aws.TimeValue(object.LastModified)))
+		}
+	}
+	return entries, nil
+}
+
+// Create the entry on the first lookup or bump its counter afterwards.
+// It reports whether the word was new to the notebook.
+func RecordLookup(userId string, word string) (*VocabEntry, bool, error) {
+	now := time.Now()
+	entry, exists := GetVocabEntry(userId, word)
+	if !exists {
+		entry = &VocabEntry{
+			Word:      word,
+			FirstSeen: now,
+			Tags:      []string{},
+			Mastery:   MasteryNew,
+		}
+	}
+	entry.LastSeen = now
+	entry.LookupCount++
+
+	return entry, !exists, SaveVocabEntry(userId, entry)
+}
+
+// Remove the word with its cached explanation and image.
+func DeleteVocabEntry(userId string, word string) error {
+	entry, exists := GetVocabEntry(userId, word)
+	if !exists {
+		return fmt.Errorf("%q is not in the notebook", word)
+	}
+	key := vocabularyKey(userId, word)
+	if entry.legacy {
+		key = legacyVocabularyPrefix(userId) + word
+	}
+	if err := DeleteObject(key); err != nil {
+		return err
+	}
+	// the cache may never have been written if the lookup failed
+	DeleteObject(explanationKey(userId, word))
+	DeleteObject(imageKey(userId, word))
+	return nil
+}
+
+// List a page of the notebook, optionally narrowed to words containing query.
+// Pages start at 1.
+func ListVocabulary(userId string, query string, page int, pageSize int) (*VocabPage, error) {
+	prefix := vocabularyPrefix(userId)
+	objects, err := ListObjects(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	query = strings.ToLower(query)
+	querySlug := slugify(query)
+	type hit struct {
+		key      string
+		modified time.Time
+		// a legacy entry, made up without reading
+		entry *VocabEntry
+	}
+	hits := make([]hit, 0, len(objects))
+	for _, object := range objects {
+		key := aws.StringValue(object.Key)
+		// words whose slug doesn't contain the query's can't contain the query
+		slug, searchable := textKeySlug(strings.TrimSuffix(strings.TrimPrefix(key, prefix), ".json"))
+		if querySlug != "" && searchable && !strings.Contains(slug, querySlug) {
+			continue
+		}
+		hits = append(hits, hit{key: key, modified: aws.TimeValue(object.LastModified)})
+	}
+	legacy, err := legacyVocabulary(userId, objects)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range legacy {
+		hits = append(hits, hit{modified: entry.LastSeen, entry: entry})
+	}
+	// most recently used words first
+	sort.Slice(hits, func(i, j int) bool {
+		return hits[i].modified.After(hits[j].modified)
+	})
+
+	if page < 1 {
+		page = 1
+	}
+	start := (page - 1) * pageSize
+	end := start + pageSize
+
+	// the rest are checked against the words themselves, reading only as far as the page
+	result := &VocabPage{Page: page}
+	matched := 0
+	for _, h := range hits {
+		if result.HasNext {
+			break
+		}
+		if query == "" && matched < start {
+			matched++
+			continue
+		}
+		entry, exists := h.entry, h.entry != nil
+		if !exists {
+			entry, exists = getVocabEntry(h.key)
+		}
+		if !exists || !strings.Contains(strings.ToLower(entry.Word), query) {
+			continue
+		}
+		switch {
+		case matched >= end:
+			result.HasNext = true
+		case matched >= start:
+			result.Entries = append(result.Entries, entry)
+		}
+		matched++
+	}
+	return result, nil
+}
+
+// Get every entry of the notebook in the order the words were first seen.
+func AllVocabulary(userId string) ([]*VocabEntry, error) {
+	objects, err := ListObjects(vocabularyPrefix(userId))
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*VocabEntry, 0, len(objects))
+	for _, object := range objects {
+		if entry, exists := getVocabEntry(aws.StringValue(object.Key)); exists {
+			entries = append(entries, entry)
+		}
+	}
+	legacy, err := legacyVocabulary(userId, objects)
+	if err != nil {
+		return nil, err
+	}
+	entries = append(entries, legacy...)
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].FirstSeen.Before(entries[j].FirstSeen)
+	})
+	return entries, nil
+}
+
+// Put a word into the notebook without counting it as a lookup,
+// merging the tags when the word is already there.
+func AddToNotebook(userId string, word string, tags []string) (*VocabEntry, bool, error) {
+	entry, exists := GetVocabEntry(userId, word)
+	if !exists {
+		entry = &VocabEntry{
+			Word:      word,
+			FirstSeen: time.Now(),
+			Tags:      []string{},
+			Mastery:   MasteryNew,
+		}
+	}
+	for _, tag := range tags {
+		if !containsString(entry.Tags, tag) {
+			entry.Tags = append(entry.Tags, tag)
+		}
+	}
+	return entry, !exists, SaveVocabEntry(userId, entry)
+}
+
+// Count the words the user looked up today.
+// Words added by an import touch the notebook too, so the lookup time is checked.
+func CountTodaysLookups(userId string) (int, error) {
+	today := time.Now().Truncate(24 * time.Hour)
+	objects, err := ListObjects(vocabularyPrefix(userId))
+	if err != nil {
+		return 0, err
+	}
+
+	cnt := 0
+	for _, object := range objects {
+		if !aws.TimeValue(object.LastModified).After(today) {
+			continue
+		}
+		entry, exists := getVocabEntry(aws.StringValue(object.Key))
+		if exists && entry.LastSeen.After(today) {
+			cnt++
+		}
+	}
+	legacy, err := legacyVocabulary(userId, objects)
+	if err != nil {
+		return 0, err
+	}
+	for _, entry := range legacy {
+		if entry.LastSeen.After(today) {
+			cnt++
+		}
+	}
+	return cnt, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
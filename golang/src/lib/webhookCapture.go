@@ -0,0 +1,196 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Webhook requests can be captured to files, so a failing one can be
+// replayed with cmd/replay or kept as a test fixture. It is off unless
+// SetWebhookCaptureDir is given a directory (WEBHOOK_CAPTURE_DIR).
+var webhookCaptureDir string
+
+// Only requests with a valid signature are captured, so anyone can't write
+// to the disk, and a capture left on can't fill it: larger bodies are left
+// out and the oldest captures are removed past the limit.
+const (
+	webhookCaptureMaxBody = 64 << 10
+	webhookCaptureLimit   = 1000
+)
+
+var webhookCaptureMu sync.Mutex
+
+func SetWebhookCaptureDir(dir string) {
+	webhookCaptureDir = dir
+}
+
+type WebhookCapture struct {
+	CapturedAt time.Time         `json:"capturedAt"`
+	Status     int               `json:"status"`
+	Headers    map[string]string `json:"headers"`
+	// The body with personal data redacted. The signature no longer matches
+	// it, so it is signed again on replay.
+	Body json.RawMessage `json:"body"`
+}
+
+// Only headers that say nothing about the user are kept.
+var capturedHeaders = []string{"Content-Type", "User-Agent"}
+
+// Save the request if capturing is on. Bodies that aren't JSON are left out.
+func captureWebhook(header http.Header, body []byte, status int) {
+	if webhookCaptureDir == "" {
+		return
+	}
+	if len(body) > webhookCaptureMaxBody {
+		slog.Warn("Didn't capture a webhook over the size limit", "size", len(body))
+		return
+	}
+	redacted, err := RedactWebhook(body)
+	if err != nil {
+		slog.Warn("Didn't capture a webhook that isn't JSON", "err", err)
+		return
+	}
+	capture := WebhookCapture{
+		CapturedAt: time.Now(),
+		Status:     status,
+		Headers:    make(map[string]string),
+		Body:       redacted,
+	}
+	for _, name := range capturedHeaders {
+		if value := header.Get(name); value != "" {
+			capture.Headers[name] = value
+		}
+	}
+	data, err := json.MarshalIndent(capture, "", "  ")
+	if err != nil {
+		slog.Error("Failed to encode a webhook capture", "err", err)
+		return
+	}
+
+	webhookCaptureMu.Lock()
+	defer webhookCaptureMu.Unlock()
+	pruneWebhookCaptures()
+	dir := filepath.Join(webhookCaptureDir, capture.CapturedAt.Format("2006-01-02"))
+	if err = os.MkdirAll(dir, 0o700); err != nil {
+		slog.Error("Failed to create the capture directory", "err", err)
+		return
+	}
+	sum := sha256.Sum256(body)
+	name := fmt.Sprintf("%s-%d-%s.json", capture.CapturedAt.Format("150405.000"), status, hex.EncodeToString(sum[:4]))
+	if err = os.WriteFile(filepath.Join(dir, name), data, 0o600); err != nil {
+		slog.Error("Failed to save a webhook capture", "err", err)
+	}
+}
+
+// Remove the oldest captures, leaving room for one more under the limit.
+func pruneWebhookCaptures() {
+	paths, err := filepath.Glob(filepath.Join(webhookCaptureDir, "*", "*.json"))
+	if err != nil || len(paths) < webhookCaptureLimit {
+		return
+	}
+	// the day directories and the file names sort by time
+	sort.Strings(paths)
+	for _, path := range paths[:len(paths)-webhookCaptureLimit+1] {
+		if err := os.Remove(path); err != nil {
+			slog.Warn("Failed to remove an old webhook capture", "err", err)
+		}
+	}
+}
+
+var (
+	emailPattern = regexp.MustCompile(`[\w.+-]+@[\w-]+(\.[\w-]+)+`)
+	// phone, card and account numbers
+	numberPattern = regexp.MustCompile(`\+?\d[\d -]{5,}\d`)
+)
+
+// Take the personal data out of a webhook body. IDs are replaced by stable
+// pseudonyms, so the events of one user still belong together, reply and
+// quote tokens and profile fields are dropped, and emails and long numbers in texts are masked.
+func RedactWebhook(body []byte) ([]byte, error) {
+	var payload interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&payload); err != nil {
+		return nil, err
+	}
+	return json.Marshal(redactValue("", payload))
+}
+
+func redactValue(key string, value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, item := range v {
+			v[k] = redactValue(k, item)
+		}
+		return v
+	case []interface{}:
+		for i, item := range v {
+			v[i] = redactValue(key, item)
+		}
+		return v
+	case string:
+		switch key {
+		case "userId", "groupId", "roomId":
+			return pseudonymID(v)
+		case "replyToken", "quoteToken", "displayName", "pictureUrl", "statusMessage", "fileName":
+			return "redacted"
+		case "text", "altText":
+			return numberPattern.ReplaceAllString(emailPattern.ReplaceAllString(v, "<email>"), "<number>")
+		}
+	}
+	return value
+}
+
+// Keep LINE's leading U, C or R so the source type still reads right.
+func pseudonymID(id string) string {
+	if id == "" {
+		return id
+	}
+	sum := sha256.Sum256([]byte(id))
+	return id[:1] + hex.EncodeToString(sum[:16])
+}
+
+func LoadWebhookCapture(path string) (*WebhookCapture, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var capture WebhookCapture
+	if err = json.Unmarshal(data, &capture); err != nil {
+		return nil, fmt.Errorf("%s isn't a webhook capture: %v", path, err)
+	}
+	return &capture, nil
+}
+
+// Sign a webhook body the way LINE does, for the X-Line-Signature header.
+func SignWebhook(secret string, body []byte) string {
+	hash := hmac.New(sha256.New, []byte(secret))
+	hash.Write(body)
+	return base64.StdEncoding.EncodeToString(hash.Sum(nil))
+}
+
+// A request for the captured webhook, signed with the secret of the server it goes to.
+func (c *WebhookCapture) Request(url string, secret string) (*http.Request, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(c.Body))
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range c.Headers {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("X-Line-Signature", SignWebhook(secret, c.Body))
+	return req, nil
+}
@@ -1,9 +1,10 @@
 package lib
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -19,11 +20,23 @@ const (
 	LogFile = "webhook_logs"
 )
 
-func LogWebhookInfo(c *gin.Context, statusCode int) {
+// A line of the webhook log, written as JSON.
+type webhookLogLine struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	ClientIP  string    `json:"client_ip"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Status    int       `json:"status"`
+	Events    int       `json:"events"`
+	LatencyMs float64   `json:"latency_ms"`
+}
+
+func LogWebhookInfo(c *gin.Context, statusCode int, events int) {
 
 	// Ensure the log directory exists
 	if err := os.MkdirAll(LogDir, 0755); err != nil {
-		log.Println("Error creating log directory:", err)
+		slog.Error("Error creating log directory", "err", err)
 		return
 	}
 
@@ -35,18 +48,25 @@ func LogWebhookInfo(c *gin.Context, statusCode int) {
 	filePath := filepath.Join(LogDir, logFileName)
 	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
-		log.Println("Error opening log file:", err)
+		slog.Error("Error opening log file", "err", err)
 		return
 	}
 	defer file.Close()
 
 	// Format the log line and write it to the log file
-	logLine := fmt.Sprintf("%s\t%s\t%s\t%s\t%d\n",
-		c.ClientIP(), time.Now().Format(time.RFC1123),
-		c.Request.Method, c.Request.URL.Path, statusCode)
-
-	if _, err := file.WriteString(logLine); err != nil {
-		log.Println("Error writing to log file:", err)
+	now := time.Now()
+	logLine := webhookLogLine{
+		Time:      now,
+		RequestID: RequestID(c),
+		ClientIP:  c.ClientIP(),
+		Method:    c.Request.Method,
+		Path:      c.Request.URL.Path,
+		Status:    statusCode,
+		Events:    events,
+		LatencyMs: float64(now.Sub(c.GetTime(requestStartKey)).Microseconds()) / 1000,
+	}
+	if err := json.NewEncoder(file).Encode(logLine); err != nil {
+		slog.Error("Error writing to log file", "err", err)
 	}
 
 }
@@ -68,7 +88,7 @@ func DeleteOldLogs(logDir string, maxAgeDays int) error {
 				if err := os.Remove(filePath); err != nil {
 					return err
 				}
-				log.Printf("Deleted old log file: %s\n", filePath)
+				slog.Info("Deleted old log file", "path", filePath)
 			}
 		}
 	}
@@ -80,7 +100,7 @@ func WebhookHandler(c *gin.Context, bot *linebot.Client) {
 	// http && post req
 	if c.Request.Method != http.MethodPost {
 		c.Status(http.StatusMethodNotAllowed)
-		log.Println("couldn't read the request body")
+		slog.Error("couldn't read the request body")
 		return
 	}
 
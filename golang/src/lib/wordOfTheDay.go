@@ -0,0 +1,331 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// Users subscribe to one segment and get its word every morning.
+type WotdSegment struct {
+	Name  string
+	Level string // CEFR level
+	Topic string
+	Words []string
+}
+
+var wotdSegments = []*WotdSegment{
+	{Name: "a2", Level: "A2", Words: []string{"borrow", "journey", "invite", "hungry", "quiet", "remember", "weather", "expensive", "neighbour", "tired"}},
+	{Name: "b1", Level: "B1", Words: []string{"look forward to", "appointment", "convenient", "get along with", "afford", "reliable", "run out of", "opportunity", "complain", "put off"}},
+	{Name: "b2", Level: "B2", Words: []string{"come up with", "reluctant", "take for granted", "thorough", "outcome", "bring about", "feasible", "drawback", "carry out", "vivid"}},
+	{Name: "c1", Level: "C1", Words: []string{"ubiquitous", "get to the bottom of", "meticulous", "exacerbate", "by and large", "pragmatic", "scrutinize", "nuance", "fall through", "resilient"}},
+	{Name: "business", Topic: "business", Words: []string{"touch base", "deadline", "stakeholder", "follow up", "revenue", "negotiate", "agenda", "circle back", "invoice", "onboarding"}},
+	{Name: "travel", Topic: "travel", Words: []string{"itinerary", "check in", "layover", "souvenir", "get around", "boarding pass", "sightseeing", "hostel", "jet lag", "set off"}},
+}
+
+// Deliveries go out from wotdHour in the timezone of each subscriber. One
+// that couldn't be sent by the start of the quiet hours is left for the day.
+var (
+	wotdHour       = 8
+	wotdQuietStart = 22
+	wotdQuietEnd   = 7
+)
+
+// LINE accepts up to 500 recipients per multicast.
+const multicastLimit = 500
+
+type WotdSubscription struct {
+	UserID  string    `json:"userId"`
+	Segment string    `json:"segment"`
+	OptOut  bool      `json:"optOut"`
+	Updated time.Time `json:"updated"`
+	// The local date of the last word the user got
+	LastDelivered string `json:"lastDelivered,omitempty"`
+}
+
+// The card of a segment for a day, generated once and reused by every delivery.
+type WotdCard struct {
+	Date        string `json:"date"`
+	Segment     string `json:"segment"`
+	Word        string `json:"word"`
+	Explanation string `json:"explanation"`
+	// The last delivery and how many got the card in all
+	Delivered  time.Time `json:"delivered"`
+	Recipients int       `json:"recipients"`
+}
+
+const wotdSubscriberPrefix = "wordOfTheDay/subscribers/"
+
+func wotdSubscriptionKey(userId string) string {
+	return wotdSubscriberPrefix + userId + ".json"
+}
+
+func wotdCardKey(date string, segment string) string {
+	return fmt.Sprintf("wordOfTheDay/cards/%s/%s.json", date, segment)
+}
+
+func findWotdSegment(name string) *WotdSegment {
+	for _, segment := range wotdSegments {
+		if segment.Name == name {
+			return segment
+		}
+	}
+	return nil
+}
+
+func GetWotdSubscription(userId string) (*WotdSubscription, bool) {
+	content, exists := GetMessage(wotdSubscriptionKey(userId))
+	if !exists {
+		return nil, false
+	}
+	var sub WotdSubscription
+	if err := json.Unmarshal(content, &sub); err != nil {
+		return nil, false
+	}
+	return &sub, true
+}
+
+func SaveWotdSubscription(sub *WotdSubscription) error {
+	sub.Updated = time.Now()
+	data, err := json.Marshal(sub)
+	if err != nil {
+		return err
+	}
+	return SaveObject(wotdSubscriptionKey(sub.UserID), data, "application/json")
+}
+
+// Get the subscriptions of the users who want a word, leaving out those who opted out.
+func wotdSubscriptions() ([]*WotdSubscription, error) {
+	objects, err := ListObjects(wotdSubscriberPrefix)
+	if err != nil {
+		return nil, err
+	}
+	var subs []*WotdSubscription
+	for _, object := range objects {
+		userId := strings.TrimSuffix(strings.TrimPrefix(aws.StringValue(object.Key), wotdSubscriberPrefix), ".json")
+		// console users can subscribe, but only LINE users get the multicast
+		if !isLineUser(userId) {
+			continue
+		}
+		if sub, exists := GetWotdSubscription(userId); exists && !sub.OptOut && findWotdSegment(sub.Segment) != nil {
+			subs = append(subs, sub)
+		}
+	}
+	return subs, nil
+}
+
+// Pick the same word for everyone in the segment on a given day.
+func pickWotdWord(segment *WotdSegment, date string) string {
+	h := fnv.New32a()
+	h.Write([]byte(date + segment.Name))
+	return segment.Words[h.Sum32()%uint32(len(segment.Words))]
+}
+
+func isQuietHour(t time.Time) bool {
+	hour := t.Hour()
+	if wotdQuietStart > wotdQuietEnd {
+		return hour >= wotdQuietStart || hour < wotdQuietEnd
+	}
+	return hour >= wotdQuietStart && hour < wotdQuietEnd
+}
+
+// Get today's card of the segment, generating its explanation on the first call.
+func getWotdCard(segment *WotdSegment, date string) (*WotdCard, error) {
+	key := wotdCardKey(date, segment.Name)
+	if content, exists := GetMessage(key); exists {
+		var card WotdCard
+		if err := json.Unmarshal(content, &card); err == nil {
+			return &card, nil
+		}
+	}
+
+	card := &WotdCard{Date: date, Segment: segment.Name, Word: pickWotdWord(segment, date)}
+	res, err := explain(context.Background(), card.Word)
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Choices) == 0 {
+		return nil, fmt.Errorf("no explanation was generated for %s", card.Word)
+	}
+	card.Explanation = res.Choices[0].Messages.Content
+	return card, saveWotdCard(card)
+}
+
+func saveWotdCard(card *WotdCard) error {
+	data, err := json.Marshal(card)
+	if err != nil {
+		return err
+	}
+	return SaveObject(wotdCardKey(card.Date, card.Segment), data, "application/json")
+}
+
+// Deliver the words that are due in the timezone of each subscriber and not
+// sent yet. It is safe to call repeatedly, e.g. after a restart: a subscriber
+// is marked only once LINE took the multicast, so a failed one is retried by
+// the next run.
+func DeliverWordOfTheDay(now time.Time) {
+	subs, err := wotdSubscriptions()
+	if err != nil {
+		slog.Error("failed to list the word of the day subscribers", "err", err)
+		return
+	}
+
+	// subscribers whose morning it is, by the local date and the segment
+	type wotdDelivery struct{ date, segment string }
+	due := make(map[wotdDelivery][]*WotdSubscription)
+	for _, sub := range subs {
+		local := now.In(userLocation(sub.UserID))
+		date := local.Format("2006-01-02")
+		if local.Hour() < wotdHour || isQuietHour(local) || sub.LastDelivered == date {
+			continue
+		}
+		delivery := wotdDelivery{date, sub.Segment}
+		due[delivery] = append(due[delivery], sub)
+	}
+	deliveries := make([]wotdDelivery, 0, len(due))
+	for delivery := range due {
+		deliveries = append(deliveries, delivery)
+	}
+	sort.Slice(deliveries, func(i, j int) bool {
+		if deliveries[i].date != deliveries[j].date {
+			return deliveries[i].date < deliveries[j].date
+		}
+		return deliveries[i].segment < deliveries[j].segment
+	})
+
+	for _, delivery := range deliveries {
+		card, err := getWotdCard(findWotdSegment(delivery.segment), delivery.date)
+		if err != nil {
+			slog.Error("failed to prepare the word of the day", "err", err)
+			continue
+		}
+
+		// multicast rather than broadcast, since a broadcast can't leave out users who opted out
+		message := lineMessages([]OutgoingReply{wotdReply(card)})[0]
+		recipients := due[delivery]
+		delivered := 0
+		for start := 0; start < len(recipients); start += multicastLimit {
+			end := start + multicastLimit
+			if end > len(recipients) {
+				end = len(recipients)
+			}
+			userIds := make([]string, 0, end-start)
+			for _, sub := range recipients[start:end] {
+				userIds = append(userIds, sub.UserID)
+			}
+			if _, err := GetBot().Client.Multicast(userIds, message).Do(); err != nil {
+				slog.Error("Failed to multicast the word of the day", "segment", card.Segment, "recipients", len(userIds), "err", err)
+				continue
+			}
+			for _, sub := range recipients[start:end] {
+				markWotdDelivered(sub, delivery.date)
+			}
+			delivered += len(userIds)
+		}
+		if delivered == 0 {
+			continue
+		}
+
+		card.Delivered = now
+		card.Recipients += delivered
+		if err := saveWotdCard(card); err != nil {
+			slog.Error("failed to save the word of the day", "err", err)
+		}
+	}
+}
+
+// Mark the word of the day as delivered on the subscription as it is now, since
+// the user may have stopped or changed the segment during the multicast.
+func markWotdDelivered(delivered *WotdSubscription, date string) {
+	sub, exists := GetWotdSubscription(delivered.UserID)
+	if !exists || sub.OptOut || sub.Segment != delivered.Segment {
+		return
+	}
+	sub.LastDelivered = date
+	if err := SaveWotdSubscription(sub); err != nil {
+		slog.Error("failed to mark the word of the day as delivered", "user", UserHash(sub.UserID), "err", err)
+	}
+}
+
+// Check whether today's words are due. It runs on the scheduler.
+func WordOfTheDayJob(ctx context.Context) error {
+	DeliverWordOfTheDay(time.Now())
+	return nil
+}
+
+func wotdReply(card *WotdCard) OutgoingReply {
+	return CardReply("Word of the day: "+card.Word, Card{
+		Label:   "Word of the day",
+		Title:   card.Word,
+		Text:    card.Explanation,
+		Buttons: []CardButton{{Label: "Add to notebook", Text: card.Word, Primary: true}},
+	})
+}
+
+// Manage the subscription:
+//
+//	wotd             show the subscription and the segments
+//	wotd <segment>   get the word of the segment every morning
+//	wotd stop        stop getting words
+func handleWotdCommand(m Messenger, msg *IncomingMessage) bool {
+	fields := strings.Fields(strings.ToLower(msg.Text))
+	if len(fields) == 0 || fields[0] != "wotd" || len(fields) > 2 {
+		return false
+	}
+
+	userId := msg.UserID
+	sub, exists := GetWotdSubscription(userId)
+	if !exists {
+		sub = &WotdSubscription{UserID: userId, OptOut: true}
+	}
+
+	names := make([]string, 0, len(wotdSegments))
+	for _, segment := range wotdSegments {
+		names = append(names, segment.Name)
+	}
+	usage := "Choose with \"wotd <name>\": " + strings.Join(names, ", ")
+
+	var reply string
+	changed := false
+	switch {
+	case len(fields) == 1:
+		if sub.OptOut {
+			reply = "You don't get a word of the day."
+		} else {
+			reply = fmt.Sprintf("You get a %s word every morning. Send \"wotd stop\" to stop.", sub.Segment)
+		}
+		reply += "\n" + usage
+
+	case fields[1] == "stop":
+		sub.OptOut = true
+		changed = true
+		reply = "You won't get the word of the day anymore."
+
+	case findWotdSegment(fields[1]) != nil:
+		sub.Segment = fields[1]
+		sub.OptOut = false
+		changed = true
+		reply = fmt.Sprintf("You'll get a %s word every morning at %d:00 your time.", sub.Segment, wotdHour)
+
+	default:
+		reply = usage
+	}
+
+	if changed {
+		if err := SaveWotdSubscription(sub); err != nil {
+			msg.Logger().Error("failed to save a word of the day subscription", "err", err)
+			reply = "Sorry, we're under maintenance. Try it later."
+		}
+	}
+	if err := m.Reply(msg, TextReply(reply)); err != nil {
+		msg.Logger().Error("Failed to reply about the word of the day", "err", err)
+	}
+	return true
+}
@@ -1,25 +1,27 @@
 package main
 
 import (
-	"log"
+	"context"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	// "strconv"
 	// "time"
 
 	"github.com/di-th-hm-ms/AI-English/lib"
-	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
-	"github.com/line/line-bot-sdk-go/linebot"
 )
 
-var bot *lib.LineBot
-
 var requests chan *lib.LineRequest
 
+var scheduler *lib.Scheduler
+
 type Job struct {
 	ID     string
 	UserID string
@@ -29,52 +31,68 @@ type Job struct {
 func main() {
 
 	// Load .env file
-	err := godotenv.Load("../../.env")
-	if err != nil {
-		log.Println("Error loading .env file")
-	}
-	err = godotenv.Load("./.env")
+	envErr := godotenv.Load("../../.env")
+	prodEnvErr := godotenv.Load("./.env")
+
+	// the environment overrides the file in CONFIG_FILE, see lib.Config
+	config, err := lib.LoadConfig(os.Getenv("CONFIG_FILE"))
 	if err != nil {
-		log.Println("Error loading .env file for prod")
+		slog.Error("Failed to load the configuration", "err", err)
+		os.Exit(1)
 	}
 
-	// set up log retention
-	maxAgeDays := 1
-	go func() {
-		ticker := time.Tick(24 * time.Hour)
-		for range ticker {
-			if err := lib.DeleteOldLogs(lib.LogDir, maxAgeDays); err != nil {
-				log.Println("Error deleting old log files:", err)
-			}
+	lib.SetupLogging(os.Stdout, config.Log.Format, config.Log.Level)
+	if envErr != nil {
+		slog.Warn("Error loading .env file")
+	}
+	if prodEnvErr != nil {
+		slog.Warn("Error loading .env file for prod")
+	}
+	if err = config.Validate(); err != nil {
+		for _, problem := range strings.Split(err.Error(), "\n") {
+			slog.Error("Invalid configuration", "problem", problem)
 		}
-	}()
-
-	isProd := os.Getenv("PRODUCTION") != ""
-	// Create a new client for messaging API
-	// for deploy
-	if isProd {
-		log.Println("PRODUCTION")
-		lib.NewLineBotClient()
-	} else {
-		lib.InitializeLinebotDebug()
+		os.Exit(1)
 	}
-	bot = lib.GetBot()
 
-	log.Println("Success creating a new instance for line bot")
-	log.Println(bot)
+	shutdownTracing, err := lib.SetupTracing(context.Background(), config.Tracing.Exporter)
+	if err != nil {
+		slog.Error("Failed to set up tracing", "err", err)
+		os.Exit(1)
+	}
 
+	isProd := config.Production
 	// Initialize s3 client
+	lib.CreateSession(config.AWS)
+
+	// Create a new client for messaging API
+	// for deploy; the token it issues is kept in S3 for the next start
 	if isProd {
-		lib.CreateSessionWithRole()
+		slog.Info("PRODUCTION")
+		lib.NewLineBotClient(config.LINE)
 	} else {
-		lib.CreateSession()
+		lib.InitializeLinebotDebug(config.LINE)
 	}
 
+	slog.Info("Success creating a new instance for line bot")
+	lib.SetOpenAI(config.OpenAI)
+	lib.SetPexels(config.Pexels)
+	lib.SetAdminToken(config.AdminToken)
+	lib.SetDailyLookupLimit(config.DailyLookupLimit)
+	lib.SetPublicURL(config.PublicURL)
+
 	// Buffered channel for request queue
-	requests = make(chan *lib.LineRequest, 10)
+	requests = make(chan *lib.LineRequest, config.Queue.Size)
+	lib.SetRequestQueue(requests)
+	lib.SetImportWorkers(config.Queue.ImportWorkers)
+	pronunciations := make(chan string, config.Queue.Size)
+	lib.SetPronunciationQueue(pronunciations)
+	var pronunciationWg sync.WaitGroup
+	pronunciationWg.Add(1)
+	go lib.PronunciationWorker(pronunciations, &pronunciationWg)
 
 	// Create a worker pool
-	workerCnt := 5
+	workerCnt := config.Queue.Workers
 	var wg sync.WaitGroup
 	wg.Add(workerCnt)
 
@@ -82,57 +100,139 @@ func main() {
 		go lib.Worker(requests, &wg)
 	}
 
-	router := gin.Default()
+	// behind a reverse proxy, the client IPs come from its headers
+	if config.TLS.Mode == lib.TLSProxy {
+		lib.SetTrustedProxies(config.TLS.TrustedProxies)
+	}
+
+	// opt-in capture of the webhooks for cmd/replay
+	if dir := config.WebhookCaptureDir; dir != "" {
+		slog.Info("Capturing webhooks")
+		lib.SetWebhookCaptureDir(dir)
+	}
+	router := lib.NewRouter()
 
-	router.POST("/callback", func(c *gin.Context) {
+	// periodic jobs
+	scheduler = lib.NewScheduler(nil)
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		slog.Error("Failed to load the timezone", "err", err)
+		os.Exit(1)
+	}
+	// set up log retention
+	maxAgeDays := config.Log.RetentionDays
+	scheduler.Add(lib.Job{
+		Name:     "log-retention",
+		Schedule: lib.Every(24 * time.Hour),
+		Run: func(ctx context.Context) error {
+			return lib.DeleteOldLogs(lib.LogDir, maxAgeDays)
+		},
+	})
+	scheduler.Add(lib.Job{
+		Name:     "word-of-the-day",
+		Schedule: lib.MustCron("*/15 * * * *", nil),
+		Run:      lib.WordOfTheDayJob,
+	})
+	scheduler.Add(lib.Job{
+		Name: "weekly-report",
+		// Sunday evening comes at a different hour for each timezone
+		Schedule: lib.MustCron("0 * * * *", nil),
+		Run:      lib.WeeklyReportJob,
+	})
+	scheduler.Add(lib.Job{
+		Name:     "data-retention",
+		Schedule: lib.MustCron("30 3 * * *", tokyo),
+		Run:      lib.DataRetentionJob,
+	})
+	scheduler.Add(lib.Job{
+		Name:       "rich-menus",
+		Schedule:   lib.Every(24 * time.Hour),
+		RunOnStart: true,
+		Run:        lib.StartRichMenus(lib.LineRichMenuAPI()),
+	})
+	if isProd {
+		// a new token only shortly before the current one expires, and revokes the replaced ones
+		scheduler.Add(lib.Job{
+			Name:     "channel-access-token",
+			Schedule: lib.Every(time.Hour),
+			Jitter:   time.Minute,
+			Run:      lib.RefreshToken,
+		})
+	}
+	scheduler.Start()
 
-		log.Println("callback is called")
-		// validation to limit the scope where http requests are accepted
-		lib.WebhookHandler(c, bot.Client)
+	tlsConfig, acmeHandler, err := lib.ServerTLSConfig(config.TLS)
+	if err != nil {
+		slog.Error("Failed to set up TLS", "err", err)
+		os.Exit(1)
+	}
 
-		// return
-		events, err := bot.Client.ParseRequest(c.Request)
-		defer c.Request.Body.Close()
+	// 443 with TLS, 8080 for dev and behind a proxy, unless PORT is set
+	port := config.Port
 
-		if err != nil {
-			if err == linebot.ErrInvalidSignature {
-				c.Writer.WriteHeader(400)
-				lib.LogWebhookInfo(c, 400)
-			} else {
-				c.Writer.WriteHeader(500)
-				lib.LogWebhookInfo(c, 500)
+	server := &http.Server{
+		Addr:      ":" + port,
+		Handler:   router,
+		TLSConfig: tlsConfig,
+	}
+	slog.Info("Serving", "port", port, "tls", config.TLS.Mode)
+	if acmeHandler != nil {
+		// HTTP-01 challenges of Let's Encrypt, and a redirect to HTTPS
+		go func() {
+			if err := http.ListenAndServe(":80", acmeHandler); err != nil {
+				slog.Error("Failed to serve the ACME challenges", "err", err)
 			}
-			return
+		}()
+	}
+	go func() {
+		var err error
+		if tlsConfig != nil {
+			// the certificates come from the TLS config
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			// Dev
+			err = server.ListenAndServe()
 		}
-		for _, event := range events {
-			if event.Type == linebot.EventTypeMessage {
-				// add requests to the buffer (channel)
-				requests <- &lib.LineRequest{
-					UserId:  event.Source.UserID,
-					Payload: event,
-				}
-			}
+		if err != nil && err != http.ErrServerClosed {
+			slog.Error("Failed to serve", "err", err)
+			os.Exit(1)
 		}
+	}()
 
-		c.Status(http.StatusOK)
-		lib.LogWebhookInfo(c, http.StatusOK)
-	})
-
-	go lib.RefreshTokenPeriodically(time.Hour)
-
-	port := os.Getenv("PORT")
-	if port == "" {
-		if isProd {
-			port = "443" // Default port for HTTPS
-		} else {
-			port = "8080" // Default port for dev
+	// shut down gracefully on Ctrl+C or a stop from the container runtime
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+	slog.Info("Shutting down")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	serverErr := server.Shutdown(shutdownCtx)
+	if serverErr != nil {
+		slog.Error("Failed to stop the server", "err", serverErr)
+	}
+	if err := scheduler.Stop(shutdownCtx); err != nil {
+		slog.Error("Failed to stop the scheduled jobs", "err", err)
+	}
+	// LINE was told the queued events were received, so the workers finish them;
+	// a webhook still running after a failed shutdown would send on a closed queue
+	if serverErr == nil {
+		close(requests)
+		drained := make(chan struct{})
+		go func() {
+			wg.Wait()
+			// only the workers queue pronunciations
+			close(pronunciations)
+			pronunciationWg.Wait()
+			close(drained)
+		}()
+		select {
+		case <-drained:
+		case <-shutdownCtx.Done():
+			slog.Error("Stopped before the queue was drained", "left", len(requests))
 		}
 	}
-
-	if isProd {
-		router.RunTLS(":"+port, "", "")
-	} else {
-		// Dev
-		router.Run(":" + port)
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		slog.Error("Failed to flush the traces", "err", err)
 	}
 }
@@ -0,0 +1,128 @@
+package test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/di-th-hm-ms/AI-English/lib"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+type mapSecrets map[string][]byte
+
+func (m mapSecrets) GetSecret(ctx context.Context, name string) ([]byte, error) {
+	if data, ok := m[name]; ok {
+		return data, nil
+	}
+	return nil, errors.New("no such secret")
+}
+
+// Check the assertion with the public key and return the kid in its header.
+func verifyAssertion(t *testing.T, assertion string, key lib.AssertionKey) string {
+	privateKey, err := key.PrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwt.Parse(assertion, func(token *jwt.Token) (interface{}, error) {
+		return &privateKey.PublicKey, nil
+	}, jwt.WithValidMethods([]string{"RS256"}), jwt.WithAudience("https://api.line.me/"))
+	if err != nil {
+		t.Fatalf("the assertion doesn't verify: %v", err)
+	}
+	return token.Header["kid"].(string)
+}
+
+func TestAssertionKeyRotation(t *testing.T) {
+	dir := t.TempDir()
+	oldKey, _ := lib.GenerateAssertionKey(2048)
+	newKey, _ := lib.GenerateAssertionKey(2048)
+	oldKey.Kid, newKey.Kid = "old-kid", "new-kid"
+	set := lib.AssertionKeys{Active: "old-kid", Keys: []lib.AssertionKey{oldKey, newKey}}
+	data, _ := json.Marshal(set)
+	path := filepath.Join(dir, "keys.json")
+	os.WriteFile(path, data, 0o600)
+
+	config := lib.LineConfig{ChannelID: "1234567890", KeyFile: path}
+	keys, err := lib.LoadAssertionKeys(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertion, err := lib.GenerateJwtAssertion(config.ChannelID, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kid := verifyAssertion(t, assertion, oldKey); kid != "old-kid" {
+		t.Errorf("signed with %q, expected the active key", kid)
+	}
+
+	// the set wins over a PH_KID left from before the rotation
+	set.Active = "new-kid"
+	set.Keys = set.Keys[1:]
+	data, _ = json.Marshal(set)
+	os.WriteFile(path, data, 0o600)
+	config.KeyID = "old-kid"
+	if keys, err = lib.LoadAssertionKeys(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	assertion, _ = lib.GenerateJwtAssertion(config.ChannelID, keys)
+	if kid := verifyAssertion(t, assertion, newKey); kid != "new-kid" {
+		t.Errorf("signed with %q, expected the activated key", kid)
+	}
+
+	// in a set without an active key PH_KID picks one
+	set.Active = ""
+	set.Keys = []lib.AssertionKey{oldKey, newKey}
+	data, _ = json.Marshal(set)
+	os.WriteFile(path, data, 0o600)
+	config.KeyID = "new-kid"
+	keys, _ = lib.LoadAssertionKeys(context.Background(), config)
+	assertion, _ = lib.GenerateJwtAssertion(config.ChannelID, keys)
+	if kid := verifyAssertion(t, assertion, newKey); kid != "new-kid" {
+		t.Errorf("signed with %q, expected the key of PH_KID", kid)
+	}
+	config.KeyID = "unknown-kid"
+	if _, err = lib.LoadAssertionKeys(context.Background(), config); err == nil {
+		t.Error("expected an error for a kid that isn't in the set")
+	}
+
+	// the public JWK has nothing private
+	public, _ := json.Marshal(newKey.Public())
+	var fields map[string]interface{}
+	json.Unmarshal(public, &fields)
+	for _, private := range []string{"d", "p", "q", "dp", "dq", "qi"} {
+		if _, ok := fields[private]; ok {
+			t.Errorf("the public JWK has %s: %s", private, public)
+		}
+	}
+}
+
+func TestAssertionKeyFromPEMSecret(t *testing.T) {
+	privateKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	der, _ := x509.MarshalPKCS8PrivateKey(privateKey)
+	lib.SetSecretProvider(mapSecrets{
+		"line/assertion-key": pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}),
+	})
+	t.Cleanup(func() { lib.SetSecretProvider(nil) })
+
+	config := lib.LineConfig{ChannelID: "1234567890", KeySecret: "line/assertion-key"}
+	if _, err := lib.LoadAssertionKeys(context.Background(), config); err == nil {
+		t.Error("expected an error for a PEM key without a kid")
+	}
+	config.KeyID = "pem-kid"
+	keys, err := lib.LoadAssertionKeys(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertion, _ := lib.GenerateJwtAssertion(config.ChannelID, keys)
+	if kid := verifyAssertion(t, assertion, lib.NewAssertionKey(privateKey, "")); kid != "pem-kid" {
+		t.Errorf("signed with %q", kid)
+	}
+}
@@ -0,0 +1,23 @@
+package test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/di-th-hm-ms/AI-English/lib"
+)
+
+func TestStaticAWSCredentials(t *testing.T) {
+	config := lib.DefaultConfig().AWS
+	config.AccessKeyID = "AKIAEXAMPLEKEY00000"
+	config.SecretAccessKey = "example-secret"
+	lib.CreateSession(config)
+
+	status := lib.AWSCredentialStatus(context.Background())
+	if status.Error != "" || status.Provider != "StaticProvider" {
+		t.Errorf("unexpected credentials: %+v", status)
+	}
+	if status.ExpiresAt != nil || status.Role != "" {
+		t.Errorf("static keys don't expire and assume no role: %+v", status)
+	}
+}
@@ -0,0 +1,53 @@
+package test
+
+import (
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/di-th-hm-ms/AI-English/lib"
+	"github.com/di-th-hm-ms/AI-English/lib/linetest"
+	"github.com/gin-gonic/gin"
+)
+
+// Run the bot against the fake LINE API with the data in memory and offline
+// explanations. Everything is stopped when the test ends.
+func startBot(t *testing.T, secret string) (*linetest.Server, http.Handler) {
+	// the webhook log is written to the working directory
+	wd, _ := os.Getwd()
+	os.Chdir(t.TempDir())
+
+	fake := linetest.NewServer(secret)
+	if err := fake.Install(); err != nil {
+		t.Fatalf("failed to install the fake LINE server: %v", err)
+	}
+	lib.SetObjectStore(lib.NewMemoryStore())
+	lib.SetExplainer(lib.OfflineExplanation)
+	lib.SetImageFinder(lib.PlaceholderImages)
+	lib.SetPronouncer(lib.OfflinePronunciation)
+
+	requests := make(chan *lib.LineRequest, 10)
+	lib.SetRequestQueue(requests)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go lib.Worker(requests, &wg)
+	pronunciations := make(chan string, 10)
+	lib.SetPronunciationQueue(pronunciations)
+	var pronunciationWg sync.WaitGroup
+	pronunciationWg.Add(1)
+	go lib.PronunciationWorker(pronunciations, &pronunciationWg)
+
+	t.Cleanup(func() {
+		close(requests)
+		wg.Wait()
+		lib.SetPronunciationQueue(nil)
+		close(pronunciations)
+		pronunciationWg.Wait()
+		fake.Close()
+		os.Chdir(wd)
+	})
+
+	gin.SetMode(gin.TestMode)
+	return fake, lib.NewRouter()
+}
@@ -0,0 +1,144 @@
+package test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/di-th-hm-ms/AI-English/lib"
+)
+
+// A channel with a fresh assertion key in the P_* fields.
+func testLineConfig(t *testing.T, secret string) lib.LineConfig {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lib.LineConfig{
+		ChannelID:     "1234567890",
+		ChannelSecret: secret,
+		KeyID:         "assertion-key",
+		AssertionKey:  lib.NewAssertionKey(key, ""),
+	}
+}
+
+func TestChannelTokenLifecycle(t *testing.T) {
+	const secret = "test-channel-secret"
+	fake, _ := startBot(t, secret)
+	config := testLineConfig(t, secret)
+	clock := lib.NewFakeClock(time.Date(2024, 4, 1, 9, 0, 0, 0, time.UTC))
+	ctx := context.Background()
+
+	issued := func() int {
+		n := 0
+		for _, call := range fake.Calls() {
+			if call.Path == "/oauth2/v2.1/token" {
+				n++
+			}
+		}
+		return n
+	}
+
+	if err := lib.NewChannelTokens(config, clock).Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	first := lib.GetBot().AccessToken
+	if issued() != 1 || !fake.ValidToken(first) {
+		t.Fatalf("expected a new token, got %q after %d issues", first, issued())
+	}
+
+	// a restart reuses the stored token
+	tokens := lib.NewChannelTokens(config, clock)
+	if err := tokens.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if issued() != 1 || lib.GetBot().AccessToken != first {
+		t.Fatalf("expected to reuse %q, got %q after %d issues", first, lib.GetBot().AccessToken, issued())
+	}
+	if err := tokens.Refresh(ctx); err != nil || issued() != 1 {
+		t.Fatalf("refreshed a token that is far from expiring: %v", err)
+	}
+
+	// shortly before it expires, a new one replaces it
+	clock.Advance(29*24*time.Hour + time.Hour)
+	if err := tokens.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	second := lib.GetBot().AccessToken
+	if issued() != 2 || second == first {
+		t.Fatalf("expected a second token, got %q", second)
+	}
+	if !fake.ValidToken(first) {
+		t.Error("revoked the replaced token before requests with it could finish")
+	}
+	if expiresAt, ok := tokens.ExpiresAt(); !ok || !expiresAt.Equal(clock.Now().Add(30*24*time.Hour)) {
+		t.Errorf("unexpected expiry %v", expiresAt)
+	}
+
+	clock.Advance(time.Hour)
+	if err := tokens.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if fake.ValidToken(first) || !fake.ValidToken(second) {
+		t.Error("expected the replaced token to be revoked and the new one to stay")
+	}
+}
+
+func TestLeakedChannelTokensAreReported(t *testing.T) {
+	const secret = "test-channel-secret"
+	fake, _ := startBot(t, secret)
+	config := testLineConfig(t, secret)
+	clock := lib.NewFakeClock(time.Date(2024, 4, 1, 9, 0, 0, 0, time.UTC))
+	ctx := context.Background()
+
+	tokens := lib.NewChannelTokens(config, clock)
+	if err := tokens.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// the long-lived token of the fake stands for one of an earlier version
+	if unknown := tokens.UnknownKeyIDs(); len(unknown) != 1 || unknown[0] != "fake-key" {
+		t.Fatalf("unknown tokens %v, expected the long-lived one", unknown)
+	}
+
+	// someone else issues a token with the channel's key
+	res, err := http.PostForm(fake.URL+"/oauth2/v2.1/token", url.Values{"grant_type": {"client_credentials"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var leaked struct {
+		AccessToken string `json:"access_token"`
+		KeyID       string `json:"key_id"`
+	}
+	json.NewDecoder(res.Body).Decode(&leaked)
+	res.Body.Close()
+
+	if err := tokens.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	unknown := tokens.UnknownKeyIDs()
+	if len(unknown) != 2 || unknown[1] != leaked.KeyID {
+		t.Fatalf("unknown tokens %v, expected %s among them", unknown, leaked.KeyID)
+	}
+	// the bot can't revoke a token it never had
+	if !fake.ValidToken(leaked.AccessToken) {
+		t.Error("the leaked token was revoked")
+	}
+
+	// revoked in the console
+	res, err = http.PostForm(fake.URL+"/oauth2/v2.1/revoke", url.Values{"access_token": {leaked.AccessToken}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if err := tokens.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if unknown := tokens.UnknownKeyIDs(); len(unknown) != 1 {
+		t.Errorf("unknown tokens %v after the revoke", unknown)
+	}
+}
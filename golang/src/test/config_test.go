@@ -0,0 +1,77 @@
+package test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/di-th-hm-ms/AI-English/lib"
+)
+
+func TestConfigFromFileAndEnvironment(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(path, []byte(`{
+		"dailyLookupLimit": 20,
+		"queue": {"workers": 2},
+		"aws": {"bucket": "from-file"},
+		"openai": {"apiKey": "sk-file"}
+	}`), 0o600)
+	// the environment wins over the file
+	t.Setenv("S3_BUCKET", "from-env")
+	t.Setenv("TLS_DOMAINS", "bot.example.com, www.bot.example.com")
+	t.Setenv("PRODUCTION", "true")
+
+	config, err := lib.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.DailyLookupLimit != 20 || config.Queue.Workers != 2 || config.Queue.Size != 10 {
+		t.Errorf("unexpected limits: %+v %+v", config.DailyLookupLimit, config.Queue)
+	}
+	if config.AWS.Bucket != "from-env" || config.AWS.Region != "ap-northeast-1" || config.OpenAI.APIKey != "sk-file" {
+		t.Errorf("unexpected settings: %+v %+v", config.AWS, config.OpenAI)
+	}
+	if config.TLS.Mode != lib.TLSAutocert || len(config.TLS.Domains) != 2 || config.Port != "443" {
+		t.Errorf("expected autocert on 443, got %+v on %s", config.TLS, config.Port)
+	}
+
+	os.WriteFile(path, []byte(`{"queue": {"wokers": 2}}`), 0o600)
+	if _, err = lib.LoadConfig(path); err == nil {
+		t.Error("expected an error for an unknown field")
+	}
+	t.Setenv("WORKERS", "five")
+	if _, err = lib.LoadConfig(""); err == nil || !strings.Contains(err.Error(), "WORKERS") {
+		t.Errorf("expected an error about WORKERS, got %v", err)
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	config := lib.DefaultConfig()
+	config.Port = "8080"
+	config.TLS.Mode = lib.TLSOff
+	config.LINE.ChannelSecret = "secret"
+	config.LINE.LongTermAccessToken = "token"
+	config.AWS.AccessKeyID = "key"
+	config.AWS.SecretAccessKey = "secret"
+	config.OpenAI.APIKey = "sk-key"
+	if err := config.Validate(); err != nil {
+		t.Fatalf("expected a valid development config: %v", err)
+	}
+
+	config.Production = true
+	config.AWS.RoleName = "linenglish"
+	config.Queue.Workers = 0
+	config.Log.Level = "verbose"
+	config.Tracing.Exporter = "jaeger"
+	err := config.Validate()
+	if err == nil {
+		t.Fatal("expected the production config to be invalid")
+	}
+	// every problem is reported at once
+	for _, want := range []string{"CHANNEL_ID", "P_N", "IAM_ROLE_ID", "IAM_EXTERNAL_ID", "WORKERS", "LOG_LEVEL", "stdout, console or none", "production needs TLS"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected a problem about %s in:\n%v", want, err)
+		}
+	}
+}
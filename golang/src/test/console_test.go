@@ -0,0 +1,38 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/di-th-hm-ms/AI-English/lib"
+)
+
+func TestConsoleLookupIsCached(t *testing.T) {
+	lib.SetObjectStore(lib.NewMemoryStore())
+	calls := 0
+	lib.SetExplainer(func(ctx context.Context, input string) (*lib.OpenaiResponse, error) {
+		calls++
+		return lib.OfflineExplanation(ctx, input)
+	})
+	lib.SetImageFinder(lib.PlaceholderImages)
+
+	var out bytes.Buffer
+	console := lib.NewConsoleMessenger(&out)
+	for i := 0; i < 2; i++ {
+		lib.HandleMessage(console, lib.ConsoleMessage("tester", "take off"))
+	}
+	if calls != 1 {
+		t.Errorf("expected the second lookup to come from the cache, explained %d times", calls)
+	}
+	if strings.Count(out.String(), "[image] memory://") != 2 || strings.Count(out.String(), "take off: an offline explanation") != 2 {
+		t.Errorf("unexpected replies:\n%s", out.String())
+	}
+
+	out.Reset()
+	lib.HandleMessage(console, lib.ConsoleMessage("tester", "notebook"))
+	if !strings.Contains(out.String(), "[cards] Your vocabulary notebook") || !strings.Contains(out.String(), "Looked up 2 times") {
+		t.Errorf("unexpected notebook:\n%s", out.String())
+	}
+}
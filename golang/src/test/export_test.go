@@ -0,0 +1,150 @@
+package test
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/di-th-hm-ms/AI-English/lib"
+	"github.com/di-th-hm-ms/AI-English/lib/linetest"
+)
+
+func TestExportBundlesTheMedia(t *testing.T) {
+	startBot(t, "test-channel-secret")
+	var pronounced atomic.Int32
+	lib.SetPronouncer(func(ctx context.Context, input string) ([]byte, error) {
+		pronounced.Add(1)
+		return []byte("ID3 " + input), nil
+	})
+	t.Cleanup(func() { lib.SetPronouncer(lib.OfflinePronunciation) })
+
+	if _, _, err := lib.AddToNotebook("U1", "take off", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := lib.PregenerateExplanation("U1", "take off"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range []lib.ExportFormat{lib.ExportAnki, lib.ExportCSV} {
+		data, ext, _, err := lib.BuildExport("U1", format)
+		if err != nil {
+			t.Fatalf("failed to export as %s: %v", format, err)
+		}
+		if ext != "zip" {
+			t.Fatalf("the %s export is a %s", format, ext)
+		}
+		z, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatalf("the %s export isn't a ZIP: %v", format, err)
+		}
+		files := make(map[string]string)
+		for _, f := range z.File {
+			r, _ := f.Open()
+			content, _ := io.ReadAll(r)
+			r.Close()
+			files[f.Name] = string(content)
+		}
+
+		if files["media/take-off-9f2bc7108cc4.mp3"] != "ID3 take off" {
+			t.Errorf("the %s export has no pronunciation of take off", format)
+		}
+		if _, exists := files["media/take-off-9f2bc7108cc4.png"]; !exists {
+			t.Errorf("the %s export has no picture of take off", format)
+		}
+		var cards string
+		var image, audio string
+		if format == lib.ExportAnki {
+			cards = files["notebook.txt"]
+			// quotes in a field are doubled
+			image, audio = `<img src=""take-off-9f2bc7108cc4.png"">`, "[sound:take-off-9f2bc7108cc4.mp3]"
+		} else {
+			cards = files["notebook.csv"]
+			image, audio = "media/take-off-9f2bc7108cc4.png", "media/take-off-9f2bc7108cc4.mp3"
+		}
+		if !strings.Contains(cards, image) || !strings.Contains(cards, audio) {
+			t.Errorf("the %s cards don't refer to the media:\n%s", format, cards)
+		}
+		if strings.Contains(cards, "http") {
+			t.Errorf("the %s cards link to the bucket:\n%s", format, cards)
+		}
+	}
+
+	if n := pronounced.Load(); n != 1 {
+		t.Errorf("pronounced %d times, expected once per word", n)
+	}
+}
+
+func TestExportDoesNotWaitForPronunciations(t *testing.T) {
+	fake, router := startBot(t, "test-channel-secret")
+	pronounced := make(chan string, 1)
+	lib.SetPronouncer(func(ctx context.Context, input string) ([]byte, error) {
+		pronounced <- input
+		return []byte("ID3 " + input), nil
+	})
+	t.Cleanup(func() { lib.SetPronouncer(lib.OfflinePronunciation) })
+
+	// a word imported without a pronunciation yet
+	if _, _, err := lib.AddToNotebook("U1", "give up", nil); err != nil {
+		t.Fatal(err)
+	}
+	data, _, _, err := lib.BuildExport("U1", lib.ExportCSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range z.File {
+		if strings.HasSuffix(f.Name, ".mp3") {
+			t.Errorf("the export has %s without a cached pronunciation", f.Name)
+		}
+	}
+	select {
+	case word := <-pronounced:
+		t.Fatalf("the export pronounced %q", word)
+	default:
+	}
+
+	// a lookup makes it after the reply
+	req, _ := linetest.NewWebhookRequest("test-channel-secret", linetest.TextMessageEvent("U2", "reply-1", "take off"))
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	if _, err := fake.WaitForReplies(1, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case word := <-pronounced:
+		if word != "take off" {
+			t.Errorf("pronounced %q after looking up take off", word)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a lookup didn't make the pronunciation")
+	}
+}
+
+func TestOldExportsAreDeleted(t *testing.T) {
+	startBot(t, "test-channel-secret")
+	const key = "users/U1/exports/anki-20261019120000.zip"
+	if err := lib.SaveObject(key, []byte("PK"), "application/zip"); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if err := lib.PruneExports("U1", now); err != nil {
+		t.Fatal(err)
+	}
+	if !lib.ObjectExists(key) {
+		t.Fatal("a fresh export was deleted")
+	}
+	if err := lib.PruneExports("U1", now.Add(25*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if lib.ObjectExists(key) {
+		t.Error("an export older than a day was kept")
+	}
+}
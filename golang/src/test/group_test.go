@@ -0,0 +1,111 @@
+package test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/di-th-hm-ms/AI-English/lib/linetest"
+)
+
+// Send the event to the bot and get the text of its reply.
+func groupReply(t *testing.T, fake *linetest.Server, router http.Handler, event map[string]interface{}) map[string]interface{} {
+	t.Helper()
+	want := len(fake.Replies()) + 1
+	req, _ := linetest.NewWebhookRequest("test-channel-secret", event)
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	replies, err := fake.WaitForReplies(want, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := replies[want-1]
+	if reply.ReplyToken != event["replyToken"] {
+		t.Fatalf("replied to %s, expected %s", reply.ReplyToken, event["replyToken"])
+	}
+	return reply.Messages[len(reply.Messages)-1]
+}
+
+func TestGroupAnswersOnlyWhenAddressed(t *testing.T) {
+	fake, router := startBot(t, "test-channel-secret")
+
+	// members talking among themselves
+	req, _ := linetest.NewWebhookRequest("test-channel-secret",
+		linetest.GroupTextMessageEvent("C1", "U1", "chat-1", "see you at the station"))
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	reply := groupReply(t, fake, router, linetest.MentionEvent("C1", "U1", "mention-1", "help"))
+	if text, _ := reply["text"].(string); !strings.Contains(text, "!quiz") {
+		t.Errorf("a mention got %q instead of the group help", text)
+	}
+	reply = groupReply(t, fake, router, linetest.GroupTextMessageEvent("C1", "U1", "prefix-1", "!help"))
+	if text, _ := reply["text"].(string); !strings.Contains(text, "!quiz") {
+		t.Errorf("the prefix got %q instead of the group help", text)
+	}
+	for _, reply := range fake.Replies() {
+		if reply.ReplyToken == "chat-1" {
+			t.Error("the bot answered a message that wasn't for it")
+		}
+	}
+}
+
+func TestGroupQuizIsAnsweredAndScored(t *testing.T) {
+	fake, router := startBot(t, "test-channel-secret")
+	fake.SetDisplayName("U1", "Aki")
+	fake.SetDisplayName("U2", "Ben")
+	const word = "take something for granted"
+
+	groupReply(t, fake, router, linetest.GroupTextMessageEvent("C1", "U1", "lookup-1", "!"+word))
+
+	// the words looked up in one group don't make quizzes in another
+	reply := groupReply(t, fake, router, linetest.GroupTextMessageEvent("C2", "U2", "quiz-0", "!quiz"))
+	if text, _ := reply["text"].(string); !strings.Contains(text, "Look up some words here first") {
+		t.Errorf("another group got a quiz: %q", text)
+	}
+
+	reply = groupReply(t, fake, router, linetest.GroupTextMessageEvent("C1", "U2", "quiz-1", "!quiz"))
+	if text, _ := reply["text"].(string); strings.Contains(text, word) {
+		t.Errorf("the hint gives the word away: %q", text)
+	}
+	quickReply, _ := reply["quickReply"].(map[string]interface{})
+	items, _ := quickReply["items"].([]interface{})
+	if len(items) != 4 {
+		t.Fatalf("the quiz has %d choices", len(items))
+	}
+	found := false
+	for _, item := range items {
+		action := item.(map[string]interface{})["action"].(map[string]interface{})
+		label, text := action["label"].(string), action["text"].(string)
+		if n := len([]rune(label)); n > 20 {
+			t.Errorf("the label %q has %d characters", label, n)
+		}
+		if text == "!answer "+word {
+			found = true
+			if label != "take something for…" {
+				t.Errorf("the label of %q is %q", word, label)
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("the word isn't among the choices: %v", items)
+	}
+
+	reply = groupReply(t, fake, router, linetest.GroupTextMessageEvent("C1", "U2", "answer-1", "!answer borrow"))
+	if text, _ := reply["text"].(string); text != `Not "borrow", Ben.` {
+		t.Errorf("a wrong answer got %q", text)
+	}
+	reply = groupReply(t, fake, router, linetest.GroupTextMessageEvent("C1", "U2", "answer-2", "!answer "+word))
+	if text, _ := reply["text"].(string); !strings.Contains(text, "had your try") {
+		t.Errorf("a second try got %q", text)
+	}
+	reply = groupReply(t, fake, router, linetest.MentionEvent("C1", "U1", "answer-3", "answer "+word))
+	if text, _ := reply["text"].(string); !strings.Contains(text, "Aki got it!") || !strings.Contains(text, "1. Aki  1") {
+		t.Errorf("the right answer got %q", text)
+	}
+
+	reply = groupReply(t, fake, router, linetest.GroupTextMessageEvent("C2", "U2", "top-2", "!leaderboard"))
+	if text, _ := reply["text"].(string); !strings.HasPrefix(text, "No scores yet") {
+		t.Errorf("the other group has scores: %q", text)
+	}
+}
@@ -0,0 +1,97 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/di-th-hm-ms/AI-English/lib"
+)
+
+func TestHealthAndReadiness(t *testing.T) {
+	const secret = "test-channel-secret"
+	fake, router := startBot(t, secret)
+	// don't call openai from the tests
+	lib.SetReadinessCheck("llm", func(ctx context.Context) error { return nil })
+	t.Cleanup(func() { lib.SetReadinessCheck("llm", nil) })
+
+	get := func(path string, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		return res
+	}
+
+	if res := get("/healthz", ""); res.Code != http.StatusOK {
+		t.Errorf("/healthz returned %d", res.Code)
+	}
+
+	res := get("/readyz", "")
+	var readiness lib.Readiness
+	json.Unmarshal(res.Body.Bytes(), &readiness)
+	if res.Code != http.StatusOK || !readiness.Ready {
+		t.Fatalf("expected to be ready, got %d: %s", res.Code, res.Body)
+	}
+	for _, name := range []string{"line", "s3", "llm", "queue"} {
+		if !readiness.Checks[name].OK {
+			t.Errorf("check %s failed: %s", name, readiness.Checks[name].Error)
+		}
+	}
+
+	lib.SetReadinessCheck("llm", func(ctx context.Context) error { return errors.New("openai is down") })
+	res = get("/readyz", "")
+	readiness = lib.Readiness{}
+	json.Unmarshal(res.Body.Bytes(), &readiness)
+	if res.Code != http.StatusServiceUnavailable || readiness.Checks["llm"].Error != "openai is down" {
+		t.Errorf("expected the llm check to fail, got %d: %s", res.Code, res.Body)
+	}
+	if !readiness.Checks["line"].OK {
+		t.Errorf("a failing llm check failed the line check: %s", res.Body)
+	}
+
+	tokens := lib.NewChannelTokens(testLineConfig(t, secret), nil)
+	if err := tokens.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	lib.SetChannelTokens(tokens)
+	t.Cleanup(func() { lib.SetChannelTokens(nil) })
+	verifications := func() int {
+		n := 0
+		for _, call := range fake.Calls() {
+			if call.Path == "/oauth2/v2.1/verify" {
+				n++
+			}
+		}
+		return n
+	}
+	lib.SetAdminToken("admin-secret")
+	t.Cleanup(func() { lib.SetAdminToken("") })
+	if res := get("/debug/status", ""); res.Code != http.StatusUnauthorized {
+		t.Errorf("/debug/status without a token returned %d", res.Code)
+	}
+	before := verifications()
+	res = get("/debug/status", "admin-secret")
+	if res.Code != http.StatusOK {
+		t.Fatalf("/debug/status returned %d", res.Code)
+	}
+	var status lib.DebugStatus
+	if err := json.Unmarshal(res.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.TokenExpiresAt == nil || len(status.Workers) != 1 || status.QueueCapacity != 10 {
+		t.Errorf("unexpected status: %s", res.Body)
+	}
+	if expiresAt, _ := tokens.ExpiresAt(); status.TokenExpiresAt != nil && !status.TokenExpiresAt.Equal(expiresAt) {
+		t.Errorf("expected the expiry of the managed token, got %v", status.TokenExpiresAt)
+	}
+	// the readiness checked the token a moment ago and the status doesn't check it again
+	if n := verifications() - before; n != 0 {
+		t.Errorf("verified the token %d times", n)
+	}
+}
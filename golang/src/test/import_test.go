@@ -0,0 +1,111 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/di-th-hm-ms/AI-English/lib"
+)
+
+// Wait for the import to finish without failures.
+func waitForImport(t *testing.T, id string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		job, exists := lib.GetImportJob(id)
+		if !exists {
+			t.Fatalf("no import %s", id)
+		}
+		progress := job.Snapshot()
+		if progress.Finished {
+			if progress.Failed != 0 {
+				t.Errorf("%d words of %s failed", progress.Failed, id)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the import %s didn't finish: %+v", id, progress)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestImportExplainsEachWordOnce(t *testing.T) {
+	_, router := startBot(t, "test-channel-secret")
+	var explained atomic.Int32
+	lib.SetExplainer(func(ctx context.Context, input string) (*lib.OpenaiResponse, error) {
+		explained.Add(1)
+		return lib.OfflineExplanation(ctx, input)
+	})
+	lib.SetAdminToken("admin-secret")
+	t.Cleanup(func() { lib.SetAdminToken("") })
+
+	body := `{"userIds": ["U1", "U2", "U3"], "words": ["take off", "look up"]}`
+	req := httptest.NewRequest(http.MethodPost, "/admin/import", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	if res.Code != http.StatusAccepted {
+		t.Fatalf("the import returned %d: %s", res.Code, res.Body)
+	}
+	var accepted struct {
+		Jobs []string `json:"jobs"`
+	}
+	json.Unmarshal(res.Body.Bytes(), &accepted)
+
+	for _, id := range accepted.Jobs {
+		waitForImport(t, id)
+	}
+
+	if n := explained.Load(); n != 2 {
+		t.Errorf("explained %d times, expected once per word", n)
+	}
+	for _, userId := range []string{"U1", "U2", "U3"} {
+		if !lib.ObjectExists("bots/users/" + userId + "/messages/take-off-9f2bc7108cc4") {
+			t.Errorf("%s has no explanation of take off", userId)
+		}
+		if !lib.ObjectExists("bots/users/" + userId + "/images/take-off-9f2bc7108cc4") {
+			t.Errorf("%s has no picture of take off", userId)
+		}
+	}
+}
+
+func TestAdminImportTakesEachJSONWordWhole(t *testing.T) {
+	_, router := startBot(t, "test-channel-secret")
+	lib.SetAdminToken("admin-secret")
+	t.Cleanup(func() { lib.SetAdminToken("") })
+
+	// a comma or a quote would break the word up or the whole list if it were read as CSV
+	body := `{"userIds": ["U1"], "words": ["well, well", "word", "say \"cheese\"", "take off"], "text": "take off,travel\nlook up"}`
+	req := httptest.NewRequest(http.MethodPost, "/admin/import", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	if res.Code != http.StatusAccepted {
+		t.Fatalf("the import returned %d: %s", res.Code, res.Body)
+	}
+	var accepted struct {
+		Jobs     []string `json:"jobs"`
+		Words    int      `json:"words"`
+		Rejected []string `json:"rejected"`
+	}
+	json.Unmarshal(res.Body.Bytes(), &accepted)
+	for _, id := range accepted.Jobs {
+		waitForImport(t, id)
+	}
+	if _, exists := lib.GetVocabEntry("U1", "well, well"); !exists {
+		t.Error("well, well isn't in the notebook")
+	}
+	if accepted.Words != 4 {
+		t.Errorf("imported %d words, expected take off, look up, well, well and word", accepted.Words)
+	}
+	if len(accepted.Rejected) != 1 || accepted.Rejected[0] != `say "cheese"` {
+		t.Errorf("rejected %q", accepted.Rejected)
+	}
+}
@@ -0,0 +1,44 @@
+package test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/di-th-hm-ms/AI-English/lib/linetest"
+)
+
+func TestMetrics(t *testing.T) {
+	const secret = "test-channel-secret"
+	fake, router := startBot(t, secret)
+
+	req, _ := linetest.NewWebhookRequest(secret, linetest.TextMessageEvent("U1", "r1", "help"))
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	if _, err := fake.WaitForReplies(1, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	req, _ = linetest.NewWebhookRequest("wrong-secret", linetest.TextMessageEvent("U1", "r2", "help"))
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if res.Code != http.StatusOK {
+		t.Fatalf("/metrics returned %d", res.Code)
+	}
+	body, _ := io.ReadAll(res.Body)
+	for _, expected := range []string{
+		`aienglish_webhook_requests_total{status="200"}`,
+		`aienglish_webhook_requests_total{status="400"}`,
+		`aienglish_dependency_request_duration_seconds_count{dependency="line",operation="message/reply"}`,
+		`aienglish_queue_wait_seconds_count{kind="event"}`,
+		"aienglish_queue_depth",
+		"aienglish_workers_busy",
+	} {
+		if !strings.Contains(string(body), expected) {
+			t.Errorf("%s is missing from the metrics", expected)
+		}
+	}
+}
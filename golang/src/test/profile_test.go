@@ -0,0 +1,86 @@
+package test
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/di-th-hm-ms/AI-English/lib"
+)
+
+func TestProfileRepositories(t *testing.T) {
+	for name, repo := range map[string]lib.ProfileRepository{
+		"bucket": lib.Profiles,
+		"memory": lib.NewMemoryProfileRepository(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			lib.SetObjectStore(lib.NewMemoryStore())
+			if _, exists := repo.Get("U1"); exists {
+				t.Fatal("got a profile that was never saved")
+			}
+
+			profile := lib.NewUserProfile("U1")
+			profile.Level = "B2"
+			if err := repo.Save(profile); err != nil {
+				t.Fatal(err)
+			}
+			saved, exists := repo.Get("U1")
+			if !exists || saved.Level != "B2" || saved.Plan != lib.PlanFree || !saved.Notifications.WeeklyReport {
+				t.Fatalf("got %+v", saved)
+			}
+			// a profile changed by the caller isn't saved until Save
+			saved.Level = "C1"
+			if again, _ := repo.Get("U1"); again.Level != "B2" {
+				t.Errorf("the level changed to %s without a save", again.Level)
+			}
+
+			if err := repo.Delete("U1"); err != nil {
+				t.Fatal(err)
+			}
+			if _, exists := repo.Get("U1"); exists {
+				t.Error("got a deleted profile")
+			}
+		})
+	}
+}
+
+func TestProfileSavedBeforeAFieldExistedGetsItsDefault(t *testing.T) {
+	lib.SetObjectStore(lib.NewMemoryStore())
+	if err := lib.SaveObject("users/U1/profile.json", []byte(`{"userId":"U1","level":"A2"}`), "application/json"); err != nil {
+		t.Fatal(err)
+	}
+	profile, exists := lib.Profiles.Get("U1")
+	if !exists || profile.Level != "A2" || profile.Timezone != "Asia/Tokyo" || !profile.Notifications.WeeklyReport {
+		t.Errorf("got %+v", profile)
+	}
+}
+
+func TestConcurrentProfileUpdatesAreKept(t *testing.T) {
+	lib.SetObjectStore(lib.NewMemoryStore())
+	const updates = 20
+	var wg sync.WaitGroup
+	for i := 0; i < updates; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := lib.UpdateProfile("U1", func(profile *lib.UserProfile, exists bool) bool {
+				profile.Goals += "x"
+				return true
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	profile, _ := lib.Profiles.Get("U1")
+	if profile.Goals != strings.Repeat("x", updates) {
+		t.Errorf("kept %d of %d updates", len(profile.Goals), updates)
+	}
+
+	// an update that changes nothing isn't saved
+	lib.UpdateProfile("U2", func(profile *lib.UserProfile, exists bool) bool { return false })
+	if _, exists := lib.Profiles.Get("U2"); exists {
+		t.Error("saved a profile that wasn't changed")
+	}
+}
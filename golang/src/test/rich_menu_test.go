@@ -0,0 +1,72 @@
+package test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/di-th-hm-ms/AI-English/lib"
+	"github.com/di-th-hm-ms/AI-English/lib/linetest"
+)
+
+func TestRichMenuSync(t *testing.T) {
+	api := linetest.NewRichMenuAPI()
+	defs := []lib.RichMenuDef{
+		{Name: lib.RichMenuOnboarding, ChatBarText: "Get started", Columns: 2, Buttons: []lib.RichMenuButton{
+			{Label: "Set up", Text: "settings"},
+			{Label: "Try", Text: "hello"},
+		}},
+		{Name: lib.RichMenuFree, ChatBarText: "Menu", Columns: 1, Buttons: []lib.RichMenuButton{
+			{Label: "Notebook", Text: "notebook"},
+		}},
+	}
+
+	lib.SetObjectStore(lib.NewMemoryStore())
+	manager := lib.NewRichMenuManager(api, defs)
+	for i := 0; i < 2; i++ {
+		if err := manager.Sync(context.Background()); err != nil {
+			t.Fatalf("Sync failed: %v", err)
+		}
+	}
+	if api.Created != 2 || len(api.Menus) != 2 {
+		t.Fatalf("expected 2 menus created once, created %d, have %d", api.Created, len(api.Menus))
+	}
+	if api.Default == "" || api.Menus[api.Default].ChatBarText != "Menu" {
+		t.Errorf("expected the free menu to be the default")
+	}
+
+	// a changed definition replaces its menu
+	defs[1].Buttons[0].Label = "Words"
+	manager = lib.NewRichMenuManager(api, defs)
+	if err := manager.Sync(context.Background()); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	if api.Created != 3 || len(api.Menus) != 2 {
+		t.Errorf("expected the outdated menu to be replaced, created %d, have %d", api.Created, len(api.Menus))
+	}
+
+	profile := lib.NewUserProfile("U1")
+	profile.OnboardingStep = "level"
+	if err := manager.LinkFor(profile); err != nil {
+		t.Fatalf("LinkFor failed: %v", err)
+	}
+	if api.Menus[api.Links["U1"]].ChatBarText != "Get started" {
+		t.Errorf("expected the onboarding menu while onboarding")
+	}
+
+	// users linked to a replaced menu get the new one
+	if err := lib.Profiles.Save(profile); err != nil {
+		t.Fatal(err)
+	}
+	outdated := api.Links["U1"]
+	defs[0].ChatBarText = "Start here"
+	manager = lib.NewRichMenuManager(api, defs)
+	if err := manager.Sync(context.Background()); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	if _, exists := api.Menus[outdated]; exists {
+		t.Errorf("expected the outdated onboarding menu to be deleted")
+	}
+	if menu, linked := api.Menus[api.Links["U1"]]; !linked || menu.ChatBarText != "Start here" {
+		t.Errorf("expected U1 to be linked to the new onboarding menu, got %q", api.Links["U1"])
+	}
+}
@@ -0,0 +1,84 @@
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/di-th-hm-ms/AI-English/lib"
+)
+
+func TestCronNext(t *testing.T) {
+	testCases := []struct {
+		spec     string
+		after    string
+		expected string
+	}{
+		{"*/15 * * * *", "2023-05-01T10:07:30Z", "2023-05-01T10:15:00Z"},
+		{"0 8 * * *", "2023-05-01T08:00:00Z", "2023-05-02T08:00:00Z"},
+		{"30 9 * * 1", "2023-05-03T12:00:00Z", "2023-05-08T09:30:00Z"},
+		{"0 0 1 1-3 *", "2023-03-05T00:00:00Z", "2024-01-01T00:00:00Z"},
+		{"0 12 1 * 0", "2023-05-02T00:00:00Z", "2023-05-07T12:00:00Z"},
+	}
+
+	for _, testCase := range testCases {
+		schedule, err := lib.Cron(testCase.spec, time.UTC)
+		if err != nil {
+			t.Errorf("Cron(%q) failed: %v", testCase.spec, err)
+			continue
+		}
+		after, _ := time.Parse(time.RFC3339, testCase.after)
+		next := schedule.Next(after).Format(time.RFC3339)
+		if next != testCase.expected {
+			t.Errorf("Cron(%q).Next(%s) = %s; want %s", testCase.spec, testCase.after, next, testCase.expected)
+		}
+	}
+
+	for _, spec := range []string{"* * * *", "60 * * * *", "*/0 * * * *", "5-1 * * * *"} {
+		if _, err := lib.Cron(spec, time.UTC); err == nil {
+			t.Errorf("Cron(%q) should fail", spec)
+		}
+	}
+}
+
+func TestSchedulerSkipsOverlappingRuns(t *testing.T) {
+	clock := lib.NewFakeClock(time.Date(2023, 5, 1, 0, 0, 0, 0, time.UTC))
+	scheduler := lib.NewScheduler(clock)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	scheduler.Add(lib.Job{
+		Name:     "slow",
+		Schedule: lib.Every(time.Minute),
+		Run: func(ctx context.Context) error {
+			started <- struct{}{}
+			<-release
+			return nil
+		},
+	})
+	scheduler.Start()
+
+	clock.BlockUntil(1)
+	clock.Advance(time.Minute)
+	<-started
+
+	// the first run is still going, so this one is skipped
+	clock.BlockUntil(1)
+	clock.Advance(time.Minute)
+	clock.BlockUntil(1)
+	close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := scheduler.Stop(ctx); err != nil {
+		t.Fatalf("Stop() failed: %v", err)
+	}
+
+	status := scheduler.Status()[0]
+	if status.Runs != 1 || status.Skipped != 1 || status.Running {
+		t.Errorf("status = %+v; want 1 run and 1 skipped", status)
+	}
+	if want := clock.Now().Add(time.Minute); !status.Next.Equal(want) {
+		t.Errorf("next run = %v; want %v", status.Next, want)
+	}
+}
@@ -0,0 +1,94 @@
+package test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/di-th-hm-ms/AI-English/lib"
+)
+
+// Send the text to the bot on the console and get what it printed.
+func consoleSend(console *lib.ConsoleMessenger, out *bytes.Buffer, text string) string {
+	out.Reset()
+	lib.HandleMessage(console, lib.ConsoleMessage("tester", text))
+	return out.String()
+}
+
+func TestSettingsChangeTheProfile(t *testing.T) {
+	lib.SetObjectStore(lib.NewMemoryStore())
+	var out bytes.Buffer
+	console := lib.NewConsoleMessenger(&out)
+
+	if got := consoleSend(console, &out, "settings"); !strings.Contains(got, "Level: -") || !strings.Contains(got, "[Report off] settings report off") {
+		t.Errorf("unexpected settings:\n%s", got)
+	}
+	if got := consoleSend(console, &out, "settings level b1"); !strings.Contains(got, "Updated your level to b1.") {
+		t.Errorf("unexpected reply:\n%s", got)
+	}
+	if got := consoleSend(console, &out, "settings goals business"); !strings.Contains(got, "Updated your goals") {
+		t.Errorf("unexpected reply:\n%s", got)
+	}
+	if got := consoleSend(console, &out, "settings timezone Europe/London"); !strings.Contains(got, "Updated your timezone") {
+		t.Errorf("unexpected reply:\n%s", got)
+	}
+	profile, _ := lib.Profiles.Get("console-tester")
+	if profile.Level != "B1" || profile.Goals != "Business" || profile.Timezone != "Europe/London" {
+		t.Errorf("got %+v", profile)
+	}
+}
+
+func TestSettingsRejectInvalidValues(t *testing.T) {
+	lib.SetObjectStore(lib.NewMemoryStore())
+	var out bytes.Buffer
+	console := lib.NewConsoleMessenger(&out)
+
+	for text, question := range map[string]string{
+		"settings level Z9":           "What's your English level?",
+		"settings goals fun":          "What do you want English for?",
+		"settings timezone Mars/Base": "Which timezone are you in?",
+		"settings language klingon":   "What's your native language?",
+		"settings level":              "[B1] settings level B1",
+		"settings report maybe":       `Send "settings report on" or "settings report off".`,
+		"settings wotd sometimes":     `Send "settings wotd on" or "settings wotd off".`,
+	} {
+		if got := consoleSend(console, &out, text); !strings.Contains(got, question) {
+			t.Errorf("%q got:\n%s", text, got)
+		}
+	}
+	profile, _ := lib.Profiles.Get("console-tester")
+	if profile.Level != "" || profile.Goals != "" || profile.Timezone != "Asia/Tokyo" || profile.NativeLanguage != "" {
+		t.Errorf("an invalid value was saved: %+v", profile)
+	}
+}
+
+func TestSettingsToggleTheNotifications(t *testing.T) {
+	lib.SetObjectStore(lib.NewMemoryStore())
+	var out bytes.Buffer
+	console := lib.NewConsoleMessenger(&out)
+
+	consoleSend(console, &out, "settings level c1")
+	if got := consoleSend(console, &out, "settings report off"); !strings.Contains(got, "Weekly report: off") {
+		t.Errorf("unexpected reply:\n%s", got)
+	}
+	if profile, _ := lib.Profiles.Get("console-tester"); profile.Notifications.WeeklyReport {
+		t.Error("the weekly report is still on")
+	}
+
+	// the word of the day starts with the words of the user's level
+	if got := consoleSend(console, &out, "settings wotd on"); !strings.Contains(got, "Word of the day: on (c1)") {
+		t.Errorf("unexpected reply:\n%s", got)
+	}
+	if sub, exists := lib.GetWotdSubscription("console-tester"); !exists || sub.OptOut || sub.Segment != "c1" {
+		t.Errorf("got the subscription %+v", sub)
+	}
+	consoleSend(console, &out, "settings wotd off")
+	if sub, _ := lib.GetWotdSubscription("console-tester"); !sub.OptOut {
+		t.Error("the word of the day is still on")
+	}
+
+	got := consoleSend(console, &out, "settings")
+	if !strings.Contains(got, "Weekly report: off") || !strings.Contains(got, "Word of the day: off") || !strings.Contains(got, "[Report on] settings report on") {
+		t.Errorf("unexpected settings:\n%s", got)
+	}
+}
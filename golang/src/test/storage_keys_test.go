@@ -0,0 +1,124 @@
+package test
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/di-th-hm-ms/AI-English/lib"
+)
+
+func TestMigrateStorageKeys(t *testing.T) {
+	lib.SetObjectStore(lib.NewMemoryStore())
+	// looked up again after the deploy, before the migration
+	if _, _, err := lib.RecordLookup("U1", "take off"); err != nil {
+		t.Fatal(err)
+	}
+	old := map[string]string{
+		// recorded before the notebook
+		"users/U1/messages/take off":          "{userId: U1, messageId: 1}",
+		"users/U3/messages/look up":           "{userId: U3, messageId: 2}",
+		"users/U1/vocabulary/take off.json":   `{"word":"take off","firstSeen":"2023-05-01T09:00:00Z","lookupCount":2,"tags":["toeic"]}`,
+		"users/U1/vocabulary/what's up?.json": `{"word":"what's up?","firstSeen":"2023-05-02T09:00:00Z","lookupCount":1,"tags":[]}`,
+		"bots/users/U1/messages/take off":     "take off: to leave the ground",
+		"bots/users/U1/images/what's up?":     "\x89PNG",
+		"bots/users/U2/messages/look up":      "look up: to search for",
+	}
+	for key, data := range old {
+		lib.SaveObject(key, []byte(data), "")
+	}
+
+	var reported []string
+	result, err := lib.MigrateStorageKeys(context.Background(), true, func(from string, to string) {
+		reported = append(reported, from)
+	})
+	if err != nil || result.Moved != len(old) || len(reported) != len(old) || result.Skipped != 1 {
+		t.Fatalf("unexpected dry run %+v: %v", result, err)
+	}
+	if !lib.ObjectExists("users/U1/vocabulary/take off.json") {
+		t.Fatal("the dry run moved an object")
+	}
+
+	if result, err = lib.MigrateStorageKeys(context.Background(), false, func(string, string) {}); err != nil || result.Moved != len(old) || result.Failed != 0 {
+		t.Fatalf("unexpected migration %+v: %v", result, err)
+	}
+	for key := range old {
+		if lib.ObjectExists(key) {
+			t.Errorf("%s is still there", key)
+		}
+	}
+	entry, ok := lib.GetVocabEntry("U1", "take off")
+	if !ok || entry.LookupCount != 4 || entry.FirstSeen.Year() != 2023 || len(entry.Tags) != 1 {
+		t.Errorf("expected the entries to be merged, got %+v", entry)
+	}
+	if entry, ok = lib.GetVocabEntry("U3", "look up"); !ok || entry.LookupCount != 1 {
+		t.Errorf("expected the legacy lookup in the notebook, got %+v", entry)
+	}
+	page, err := lib.ListVocabulary("U1", "UP?", 1, 10)
+	if err != nil || len(page.Entries) != 1 || page.Entries[0].Word != "what's up?" {
+		t.Errorf("expected to find the migrated word, got %+v: %v", page, err)
+	}
+
+	// both records of take off went into one entry
+	if result, _ = lib.MigrateStorageKeys(context.Background(), false, func(string, string) {}); result.Moved != 0 || result.Skipped != len(old)-1 {
+		t.Errorf("expected a second run to skip everything, got %+v", result)
+	}
+}
+
+func TestWordKeysAreSafe(t *testing.T) {
+	lib.SetObjectStore(lib.NewMemoryStore())
+	words := []string{"take off", "Take off!", "what's up?", "../../etc", "こんにちは", strings.Repeat("very long sentence ", 20)}
+	for _, word := range words {
+		if _, _, err := lib.RecordLookup("U1", word); err != nil {
+			t.Fatal(err)
+		}
+	}
+	objects, _ := lib.ListObjects("users/U1/vocabulary/")
+	if len(objects) != len(words) {
+		t.Fatalf("expected a key per word, got %d", len(objects))
+	}
+	safe := regexp.MustCompile(`^users/U1/vocabulary/[a-z0-9-]{12,61}\.json$`)
+	for _, object := range objects {
+		if !safe.MatchString(*object.Key) {
+			t.Errorf("unsafe key %q", *object.Key)
+		}
+	}
+
+	page, _ := lib.ListVocabulary("U1", "TAKE OFF", 1, 1)
+	if len(page.Entries) != 1 || !page.HasNext {
+		t.Errorf("expected two pages of take off, got %+v", page)
+	}
+	page, _ = lib.ListVocabulary("U1", "こん", 1, 10)
+	if len(page.Entries) != 1 || page.Entries[0].Word != "こんにちは" {
+		t.Errorf("expected to find a word without a slug, got %+v", page)
+	}
+}
+
+func TestLegacyLookupsAreRead(t *testing.T) {
+	lib.SetObjectStore(lib.NewMemoryStore())
+	// as the bot recorded lookups before the notebook
+	lib.SaveObject("users/U1/messages/take off", []byte("{userId: U1, messageId: 1}"), "")
+	lib.SaveObject("users/U1/messages/look up", []byte("{userId: U1, messageId: 2}"), "")
+
+	if n, err := lib.CountTodaysLookups("U1"); err != nil || n != 2 {
+		t.Errorf("expected the legacy lookups to count, got %d: %v", n, err)
+	}
+	entry, ok := lib.GetVocabEntry("U1", "take off")
+	if !ok || entry.LookupCount != 1 {
+		t.Fatalf("expected a legacy entry, got %+v", entry)
+	}
+	if entry, isNew, err := lib.RecordLookup("U1", "take off"); err != nil || isNew || entry.LookupCount != 2 {
+		t.Errorf("expected the second lookup of a legacy word, got %+v %v: %v", entry, isNew, err)
+	}
+	if lib.ObjectExists("users/U1/messages/take off") {
+		t.Error("expected the legacy record to move into the notebook")
+	}
+	page, err := lib.ListVocabulary("U1", "", 1, 10)
+	if err != nil || len(page.Entries) != 2 {
+		t.Errorf("expected both words in the notebook, got %+v: %v", page, err)
+	}
+	if err = lib.DeleteVocabEntry("U1", "look up"); err != nil || lib.ObjectExists("users/U1/messages/look up") {
+		t.Errorf("expected to forget a legacy word: %v", err)
+	}
+}
@@ -0,0 +1,132 @@
+package test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/di-th-hm-ms/AI-English/lib"
+	"github.com/di-th-hm-ms/AI-English/lib/linetest"
+)
+
+// Write a self-signed certificate with the serial number and its key.
+func writeCertificate(t *testing.T, certFile string, keyFile string, serial int64) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600)
+}
+
+func TestCertificateIsReloaded(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCertificate(t, certFile, keyFile, 1)
+
+	config, _, err := lib.ServerTLSConfig(lib.TLSOptions{
+		Mode:           lib.TLSFiles,
+		CertFile:       certFile,
+		KeyFile:        keyFile,
+		ReloadInterval: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial := func() int64 {
+		cert, err := config.GetCertificate(&tls.ClientHelloInfo{ServerName: "localhost"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+		return leaf.SerialNumber.Int64()
+	}
+	if s := serial(); s != 1 {
+		t.Fatalf("expected the first certificate, got %d", s)
+	}
+
+	// a half-written pair keeps the old certificate
+	os.WriteFile(certFile, []byte("-----BEGIN CERT"), 0o600)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	time.Sleep(5 * time.Millisecond)
+	if s := serial(); s != 1 {
+		t.Errorf("expected to keep the first certificate, got %d", s)
+	}
+
+	writeCertificate(t, certFile, keyFile, 2)
+	later = later.Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+	time.Sleep(5 * time.Millisecond)
+	if s := serial(); s != 2 {
+		t.Errorf("expected the renewed certificate, got %d", s)
+	}
+
+	if _, _, err = lib.ServerTLSConfig(lib.TLSOptions{Mode: lib.TLSFiles}); err == nil {
+		t.Error("expected an error without the files")
+	}
+	if config, _, _ := lib.ServerTLSConfig(lib.TLSOptions{Mode: lib.TLSProxy}); config != nil {
+		t.Error("expected plain HTTP behind a proxy")
+	}
+}
+
+func TestClientIPBehindTrustedProxy(t *testing.T) {
+	lib.SetTrustedProxies([]string{"10.0.0.0/8"})
+	t.Cleanup(func() { lib.SetTrustedProxies(nil) })
+	const secret = "test-channel-secret"
+	_, router := startBot(t, secret)
+
+	post := func(remoteAddr string) {
+		req, _ := linetest.NewWebhookRequest(secret)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Forwarded-For", "203.0.113.5")
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	post("10.1.2.3:4321")
+	// anyone else can't choose the IP that is logged
+	post("198.51.100.7:4321")
+
+	files, _ := filepath.Glob(filepath.Join(lib.LogDir, lib.LogFile+"-*.log"))
+	if len(files) != 1 {
+		t.Fatalf("expected one webhook log, got %v", files)
+	}
+	data, _ := os.ReadFile(files[0])
+	var ips []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var entry map[string]interface{}
+		json.Unmarshal([]byte(line), &entry)
+		if entry["status"] != float64(http.StatusOK) {
+			t.Errorf("unexpected webhook log: %s", line)
+		}
+		ips = append(ips, entry["client_ip"].(string))
+	}
+	if strings.Join(ips, " ") != "203.0.113.5 198.51.100.7" {
+		t.Errorf("logged client IPs %v", ips)
+	}
+}
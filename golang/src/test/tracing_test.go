@@ -0,0 +1,96 @@
+package test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/di-th-hm-ms/AI-English/lib"
+	"github.com/di-th-hm-ms/AI-English/lib/linetest"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// Send the spans of the bot to a recorder for the test.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	lib.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { lib.SetTracerProvider(nil) })
+	return recorder
+}
+
+func TestTraceFollowsTheEventThroughTheQueue(t *testing.T) {
+	recorder := recordSpans(t)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	const secret = "test-channel-secret"
+	fake, router := startBot(t, secret)
+
+	req, _ := linetest.NewWebhookRequest(secret, linetest.TextMessageEvent("U1", "r1", "help"))
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("webhook returned %d", res.Code)
+	}
+	if _, err := fake.WaitForReplies(1, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for deadline := time.Now().Add(5 * time.Second); spans["dequeue message"] == nil && time.Now().Before(deadline); {
+		time.Sleep(20 * time.Millisecond)
+		for _, span := range recorder.Ended() {
+			spans[span.Name()] = span
+		}
+	}
+	for _, name := range []string{"/callback", "enqueue message", "dequeue message", "handleMessageEvent", "line message/reply"} {
+		span, exists := spans[name]
+		if !exists {
+			t.Fatalf("no %q span in %v", name, spans)
+		}
+		if span.SpanContext().TraceID().String() != traceID {
+			t.Errorf("%q is in trace %s, not the webhook's", name, span.SpanContext().TraceID())
+		}
+	}
+	if spans["dequeue message"].Parent().SpanID() != spans["enqueue message"].SpanContext().SpanID() {
+		t.Error("the worker's span doesn't continue from the one that queued the event")
+	}
+	if spans["line message/reply"].Parent().SpanID() != spans["handleMessageEvent"].SpanContext().SpanID() {
+		t.Error("the reply isn't a child of handleMessageEvent")
+	}
+}
+
+func TestSpansLeaveOutTheQuery(t *testing.T) {
+	recorder := recordSpans(t)
+	startBot(t, "test-channel-secret")
+
+	const token = "secret-access-token"
+	lib.VerifyAccessToken(context.Background(), token)
+	spans := recorder.Ended()
+	if len(spans) == 0 {
+		t.Fatal("no span for the call to LINE")
+	}
+	for _, span := range spans {
+		texts := []string{span.Name(), span.Status().Description}
+		for _, a := range span.Attributes() {
+			texts = append(texts, a.Value.Emit())
+		}
+		for _, event := range span.Events() {
+			for _, a := range event.Attributes {
+				texts = append(texts, a.Value.Emit())
+			}
+		}
+		for _, text := range texts {
+			if strings.Contains(text, token) {
+				t.Errorf("%q has the token in %q", span.Name(), text)
+			}
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/di-th-hm-ms/AI-English/lib"
+	"github.com/di-th-hm-ms/AI-English/lib/linetest"
+)
+
+func TestWebhookEndToEnd(t *testing.T) {
+	const secret = "test-channel-secret"
+	fake, router := startBot(t, secret)
+	fake.SetDisplayName("U1", "Aki")
+	post := func(events ...map[string]interface{}) int {
+		req, err := linetest.NewWebhookRequest(secret, events...)
+		if err != nil {
+			t.Fatalf("failed to build a webhook: %v", err)
+		}
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		return res.Code
+	}
+
+	req, _ := linetest.NewWebhookRequest("wrong-secret", linetest.TextMessageEvent("U1", "r0", "hello"))
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	if res.Code != http.StatusBadRequest {
+		t.Errorf("expected a bad signature to be rejected, got %d", res.Code)
+	}
+
+	steps := []struct {
+		event    map[string]interface{}
+		expected []string
+	}{
+		{linetest.FollowEvent("U1", "r1"), []string{"Hi Aki!", "What's your English level?"}},
+		{linetest.TextMessageEvent("U1", "r2", "b2"), []string{"What do you want English for?"}},
+		{linetest.TextMessageEvent("U1", "r3", "skip"), []string{"No problem."}},
+		{linetest.TextMessageEvent("U1", "r4", "take off"), []string{"memory://bots/users/U1/images/take-off-9f2bc7108cc4", "take off: an offline explanation"}},
+		{linetest.TextMessageEvent("U1", "r5", "take off"), []string{"take off: an offline explanation"}},
+		// cards go out as Flex
+		{linetest.TextMessageEvent("U1", "r6", "notebook"), []string{"Your vocabulary notebook"}},
+	}
+	for i, step := range steps {
+		if code := post(step.event); code != http.StatusOK {
+			t.Fatalf("step %d: webhook returned %d", i, code)
+		}
+		replies, err := fake.WaitForReplies(i+1, 5*time.Second)
+		if err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+		reply := replies[i]
+		if reply.ReplyToken != step.event["replyToken"] {
+			t.Errorf("step %d: replied to %s", i, reply.ReplyToken)
+		}
+		var texts []string
+		for _, message := range reply.Messages {
+			for _, field := range []string{"text", "originalContentUrl", "altText"} {
+				if value, ok := message[field].(string); ok {
+					texts = append(texts, value)
+				}
+			}
+		}
+		all := strings.Join(texts, "\n")
+		for _, expected := range step.expected {
+			if !strings.Contains(all, expected) {
+				t.Errorf("step %d: expected %q in the reply:\n%s", i, expected, all)
+			}
+		}
+	}
+
+	profile, exists := lib.Profiles.Get("U1")
+	if !exists || profile.Level != "B2" || profile.DisplayName != "Aki" || profile.OnboardingStep != "" {
+		t.Errorf("unexpected profile: %+v", profile)
+	}
+	if len(fake.Pushes()) != 0 {
+		t.Errorf("expected everything to be replied, got %d pushes", len(fake.Pushes()))
+	}
+}
+
+func TestOnboardingTakesOnlyTheChoices(t *testing.T) {
+	const secret = "test-channel-secret"
+	fake, router := startBot(t, secret)
+	answers := []struct {
+		text     string
+		expected string
+	}{
+		{"", "What's your English level?"},
+		{"b1", "What do you want English for?"},
+		// a word to look up isn't a goal
+		{"take off", "What do you want English for?"},
+		{"business", "Which timezone are you in?"},
+		{"Asia/Tokyo", "What's your native language?"},
+		{"klingon", "What's your native language?"},
+		{"JA", "You're all set!"},
+	}
+	for i, answer := range answers {
+		event := linetest.FollowEvent("U2", fmt.Sprintf("r%d", i))
+		if answer.text != "" {
+			event = linetest.TextMessageEvent("U2", fmt.Sprintf("r%d", i), answer.text)
+		}
+		req, _ := linetest.NewWebhookRequest(secret, event)
+		router.ServeHTTP(httptest.NewRecorder(), req)
+		replies, err := fake.WaitForReplies(i+1, 5*time.Second)
+		if err != nil {
+			t.Fatalf("answer %d: %v", i, err)
+		}
+		if text, _ := replies[i].Messages[len(replies[i].Messages)-1]["text"].(string); !strings.Contains(text, answer.expected) {
+			t.Errorf("after %q expected %q, got %q", answer.text, answer.expected, text)
+		}
+	}
+
+	profile, _ := lib.Profiles.Get("U2")
+	if profile.Goals != "Business" || profile.NativeLanguage != "ja" {
+		t.Errorf("unexpected profile: %+v", profile)
+	}
+}
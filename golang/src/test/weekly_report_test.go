@@ -0,0 +1,78 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/di-th-hm-ms/AI-English/lib"
+)
+
+func TestWeeklyReportIsSentOnSundayEveningOfEachUser(t *testing.T) {
+	fake, router := startBot(t, "test-channel-secret")
+	lib.SetPublicURL("https://bot.example.com")
+	t.Cleanup(func() { lib.SetPublicURL("") })
+
+	for userId, timezone := range map[string]string{"U1": "Asia/Tokyo", "U2": "America/New_York"} {
+		profile := lib.NewUserProfile(userId)
+		profile.Timezone = timezone
+		if err := lib.Profiles.Save(profile); err != nil {
+			t.Fatal(err)
+		}
+		lib.RecordActivity(userId, func(activity *lib.DailyActivity) { activity.Lookups++ })
+	}
+	pushedTo := func() []string {
+		var userIds []string
+		for _, push := range fake.Pushes() {
+			userIds = append(userIds, push.To)
+		}
+		return userIds
+	}
+
+	// 7 pm on Sunday in Tokyo, 6 am in New York
+	sunday := time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC)
+	if err := lib.SendWeeklyReports(context.Background(), sunday); err != nil {
+		t.Fatal(err)
+	}
+	if got := pushedTo(); len(got) != 1 || got[0] != "U1" {
+		t.Fatalf("pushed to %v, expected Tokyo only", got)
+	}
+	// the job runs again in the same hour, e.g. after a restart
+	if err := lib.SendWeeklyReports(context.Background(), sunday.Add(30*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if got := pushedTo(); len(got) != 1 {
+		t.Fatalf("pushed to %v, expected the rerun to push nothing", got)
+	}
+	if err := lib.SendWeeklyReports(context.Background(), sunday.Add(13*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if got := pushedTo(); len(got) != 2 || got[1] != "U2" {
+		t.Fatalf("pushed to %v, expected New York next", got)
+	}
+
+	// the chart is served by the bot rather than by a link that expires
+	push, _ := json.Marshal(fake.Pushes()[0].Messages)
+	const prefix = "https://bot.example.com/reports/U1/"
+	at := strings.Index(string(push), prefix)
+	if at < 0 {
+		t.Fatalf("the report has no chart of the bot: %s", push)
+	}
+	path := strings.TrimPrefix(string(push[at:]), "https://bot.example.com")
+	path = path[:strings.IndexByte(path, '"')]
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, httptest.NewRequest(http.MethodGet, path, nil))
+	if res.Code != http.StatusOK || res.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("GET %s returned %d %s", path, res.Code, res.Header().Get("Content-Type"))
+	}
+
+	res = httptest.NewRecorder()
+	router.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/reports/U1/2026-10-18.png", nil))
+	if res.Code != http.StatusNotFound {
+		t.Errorf("a chart without its random name returned %d", res.Code)
+	}
+}
@@ -0,0 +1,33 @@
+package test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/di-th-hm-ms/AI-English/lib"
+)
+
+func TestParseWordList(t *testing.T) {
+	testCases := []struct {
+		input    string
+		words    []string
+		tags     [][]string
+		rejected []string
+	}{
+		{"apple\nBanana\n\napple\n", []string{"apple", "banana"}, [][]string{nil, nil}, nil},
+		{"word,tag\ntake  off,TOEIC,verb\nこんにちは,toeic\n", []string{"take off"}, [][]string{{"toeic", "verb"}}, []string{"こんにちは"}},
+		{"run 3 times\n", nil, nil, []string{"run 3 times"}},
+	}
+
+	for _, testCase := range testCases {
+		words, tags, rejected, err := lib.ParseWordList([]byte(testCase.input))
+		if err != nil {
+			t.Errorf("ParseWordList(%q) failed: %v", testCase.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(words, testCase.words) || !reflect.DeepEqual(tags, testCase.tags) || !reflect.DeepEqual(rejected, testCase.rejected) {
+			t.Errorf("ParseWordList(%q) = %q, %q, %q; want %q, %q, %q", testCase.input,
+				words, tags, rejected, testCase.words, testCase.tags, testCase.rejected)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package test
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/di-th-hm-ms/AI-English/lib"
+	"github.com/di-th-hm-ms/AI-English/lib/linetest"
+)
+
+func multicasts(fake *linetest.Server) []linetest.Call {
+	var calls []linetest.Call
+	for _, call := range fake.Calls() {
+		if call.Path == "/v2/bot/message/multicast" {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+func TestWordOfTheDayIsDeliveredInEachTimezone(t *testing.T) {
+	fake, _ := startBot(t, "test-channel-secret")
+	var explained atomic.Int32
+	lib.SetExplainer(func(ctx context.Context, input string) (*lib.OpenaiResponse, error) {
+		explained.Add(1)
+		return lib.OfflineExplanation(ctx, input)
+	})
+
+	for _, sub := range []*lib.WotdSubscription{
+		{UserID: "U1", Segment: "b1"},
+		{UserID: "U2", Segment: "b1"},
+		{UserID: "U3", Segment: "c1", OptOut: true},
+	} {
+		if err := lib.SaveWotdSubscription(sub); err != nil {
+			t.Fatal(err)
+		}
+	}
+	profile := lib.NewUserProfile("U2")
+	profile.Timezone = "America/New_York"
+	if err := lib.Profiles.Save(profile); err != nil {
+		t.Fatal(err)
+	}
+	lastDelivered := func(userId string) string {
+		sub, _ := lib.GetWotdSubscription(userId)
+		return sub.LastDelivered
+	}
+
+	// noon in Tokyo, 11 pm in New York
+	noon := time.Date(2026, 10, 19, 3, 0, 0, 0, time.UTC)
+	fake.FailNext("/v2/bot/message/multicast", 1, http.StatusInternalServerError)
+	lib.DeliverWordOfTheDay(noon)
+	if got := lastDelivered("U1"); got != "" {
+		t.Errorf("U1 was marked on %q after a failed multicast", got)
+	}
+	if lib.ObjectExists("wordOfTheDay/cards/2026-10-19/c1.json") || lib.ObjectExists("wordOfTheDay/cards/2026-10-19/a2.json") {
+		t.Error("a card was made for a segment without subscribers")
+	}
+
+	lib.DeliverWordOfTheDay(noon.Add(15 * time.Minute))
+	lib.DeliverWordOfTheDay(noon.Add(30 * time.Minute))
+	calls := multicasts(fake)
+	if len(calls) != 2 {
+		t.Fatalf("%d multicasts, expected the failed one and its retry", len(calls))
+	}
+	if body := string(calls[1].Body); !strings.Contains(body, "U1") || strings.Contains(body, "U2") {
+		t.Errorf("the retry went to the wrong users: %s", body)
+	}
+	if got := lastDelivered("U1"); got != "2026-10-19" {
+		t.Errorf("U1 was marked on %q", got)
+	}
+
+	// 9 am in New York
+	lib.DeliverWordOfTheDay(noon.Add(10 * time.Hour))
+	calls = multicasts(fake)
+	if len(calls) != 3 {
+		t.Fatalf("%d multicasts, expected New York to get its word", len(calls))
+	}
+	if body := string(calls[2].Body); !strings.Contains(body, "U2") || strings.Contains(body, "U1") {
+		t.Errorf("the morning in New York went to the wrong users: %s", body)
+	}
+	if n := explained.Load(); n != 1 {
+		t.Errorf("explained %d times, expected one card for b1", n)
+	}
+}
+
+func TestWordOfTheDayKeepsAStopDuringTheDelivery(t *testing.T) {
+	fake, _ := startBot(t, "test-channel-secret")
+	if err := lib.SaveWotdSubscription(&lib.WotdSubscription{UserID: "U1", Segment: "b1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the user says "wotd stop" while the multicast is on its way
+	fake.OnNext("/v2/bot/message/multicast", func() {
+		sub, _ := lib.GetWotdSubscription("U1")
+		sub.OptOut = true
+		if err := lib.SaveWotdSubscription(sub); err != nil {
+			t.Error(err)
+		}
+	})
+	lib.DeliverWordOfTheDay(time.Date(2026, 10, 19, 3, 0, 0, 0, time.UTC))
+	if len(multicasts(fake)) != 1 {
+		t.Fatal("the word of the day wasn't delivered")
+	}
+	if sub, _ := lib.GetWotdSubscription("U1"); !sub.OptOut {
+		t.Error("marking the delivery undid the stop")
+	}
+}